@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+The append only file (AOF) keeps every mutation of the store on disk so that the store survives a restart.
+
+Each record is framed as
+
+	<payload length uint32><crc32 of payload uint32><payload>
+
+and the payload is
+
+	set:    op(3) key_len(uvarint) key version(int64) expirytime(uvarint) timestamp(int64) numbytes(uvarint) value_len(uvarint) value [flags(uvarint)]
+	delete: op(2) key_len(uvarint) key
+
+expirytime is in milliseconds and timestamp in unix nanoseconds. Logs written before expiry had millisecond precision
+hold set records with op 1 instead, whose expirytime and timestamp are in seconds; they are converted when read.
+flags were added after the first version of the format, so a set record without them is read with flags 0.
+
+A set record carries the complete state of the key (version and absolute expiry timestamp), so replaying the log
+simply overwrites keys in order and never has to recompute anything.
+*/
+
+const (
+	aof_op_set         byte = 3
+	aof_op_delete      byte = 2
+	aof_op_set_seconds byte = 1 // set records of logs written with second precision expiry
+)
+
+const (
+	fsync_always   = "always"
+	fsync_everysec = "everysec"
+	fsync_no       = "no"
+)
+
+var errBadRecord = errors.New("aof: corrupted record")
+
+type aof_log struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	policy string
+	dirty  bool
+	size   int64
+}
+
+/*
+aof is the log all write commands append to. It is nil when persistence is disabled.
+*/
+var aof *aof_log
+
+/*
+open_aof() opens (or creates) the log at path for appending. For the "everysec" and "no" policies a background
+goroutine flushes the buffered records once per second, and with "everysec" also fsyncs them.
+*/
+func open_aof(path string, policy string) (*aof_log, error) {
+
+	if policy != fsync_always && policy != fsync_everysec && policy != fsync_no {
+		return nil, fmt.Errorf("aof: unknown fsync policy %q", policy)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	log := &aof_log{
+		path:   path,
+		file:   file,
+		writer: bufio.NewWriter(file),
+		policy: policy,
+		size:   info.Size(),
+	}
+
+	if policy != fsync_always {
+		go log.periodic_flush()
+	}
+
+	return log, nil
+}
+
+func (log *aof_log) periodic_flush() {
+
+	ticker := time.NewTicker(time.Second)
+	for range ticker.C {
+		log.mu.Lock()
+		if log.file == nil {
+			log.mu.Unlock()
+			ticker.Stop()
+			return
+		}
+		if log.dirty {
+			if err := log.writer.Flush(); err != nil {
+				fmt.Printf("INT_ERR: Flushing aof: %s\n", err)
+			} else if log.policy == fsync_everysec {
+				if err := log.file.Sync(); err != nil {
+					fmt.Printf("INT_ERR: Syncing aof: %s\n", err)
+				}
+			}
+			log.dirty = false
+		}
+		log.mu.Unlock()
+	}
+}
+
+/*
+append() frames payload and writes it to the log. With the "always" policy the record is on stable storage when
+append() returns.
+*/
+func (log *aof_log) append(payload []byte) error {
+	return log.append_all([][]byte{payload})
+}
+
+/*
+append_all() is append() for several records, which the "always" policy syncs together
+*/
+func (log *aof_log) append_all(payloads [][]byte) error {
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	for _, payload := range payloads {
+		var header [8]byte
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+
+		if _, err := log.writer.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := log.writer.Write(payload); err != nil {
+			return err
+		}
+		log.size += int64(len(header) + len(payload))
+	}
+
+	if log.policy == fsync_always {
+		if err := log.writer.Flush(); err != nil {
+			return err
+		}
+		return log.file.Sync()
+	}
+
+	log.dirty = true
+	return nil
+}
+
+/*
+offset() returns the size of the log including records still buffered in memory
+*/
+func (log *aof_log) offset() int64 {
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.size
+}
+
+/*
+compact() drops the first offset bytes of the log, which a snapshot has made redundant, by copying the records after
+offset to a new file and renaming it over the log. Writers are blocked for the duration of the copy, which is only as
+long as the records appended while the snapshot was being written.
+*/
+func (log *aof_log) compact(offset int64) error {
+
+	if offset == 0 {
+		return nil
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if err := log.writer.Flush(); err != nil {
+		return err
+	}
+
+	src, err := os.Open(log.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp := log.path + ".rewrite"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	dst.Close()
+
+	if err := os.Rename(tmp, log.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	file, err := os.OpenFile(log.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	log.file.Close()
+	log.file = file
+	log.writer.Reset(file)
+	log.size -= offset
+	log.dirty = false
+	return sync_dir(filepath.Dir(log.path))
+}
+
+/*
+rewrite() replaces the whole log by payloads, which are written to a new file renamed over the log once synced
+*/
+func (log *aof_log) rewrite(payloads [][]byte) error {
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	tmp := log.path + ".rewrite"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer dst.Close()
+
+	writer := bufio.NewWriter(dst)
+	var size int64
+	for _, payload := range payloads {
+		var header [8]byte
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+		writer.Write(header[:])
+		writer.Write(payload)
+		size += int64(len(header) + len(payload))
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, log.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(log.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	log.file.Close()
+	log.file = file
+	log.writer.Reset(file)
+	log.size = size
+	log.dirty = false
+	return sync_dir(filepath.Dir(log.path))
+}
+
+func (log *aof_log) close() error {
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	err := log.writer.Flush()
+	if serr := log.file.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := log.file.Close(); err == nil {
+		err = cerr
+	}
+	log.file = nil
+	return err
+}
+
+/*
+aof_log_set() and aof_log_delete() are called by the store while it holds the lock of the key's shard, before the
+shard is modified, so that the order of records in the log is the order in which mutations were applied. They are no-ops when
+persistence is disabled.
+*/
+func aof_log_set(key string, val mapval) error {
+	if aof == nil {
+		return nil
+	}
+	return aof.append(encode_set_record(key, val))
+}
+
+func aof_log_delete(key string) error {
+	if aof == nil {
+		return nil
+	}
+	return aof.append(encode_delete_record(key))
+}
+
+func encode_set_record(key string, val mapval) []byte {
+
+	buf := make([]byte, 0, 1+3*binary.MaxVarintLen64+16+len(key)+len(val.value)+binary.MaxVarintLen64)
+	buf = append(buf, aof_op_set)
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(val.version))
+	buf = binary.AppendUvarint(buf, uint64(val.expirytime))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(val.timestamp))
+	buf = binary.AppendUvarint(buf, uint64(val.numbytes))
+	buf = binary.AppendUvarint(buf, uint64(len(val.value)))
+	buf = append(buf, val.value...)
+	buf = binary.AppendUvarint(buf, uint64(val.flags))
+	return buf
+}
+
+func encode_delete_record(key string) []byte {
+
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64+len(key))
+	buf = append(buf, aof_op_delete)
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	return buf
+}
+
+/*
+decode_record() is the inverse of encode_set_record() and encode_delete_record()
+*/
+func decode_record(payload []byte) (op byte, key string, val mapval, err error) {
+
+	r := bytes.NewReader(payload)
+
+	read_bytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return nil, errBadRecord
+		}
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		return b, nil
+	}
+
+	read_int64 := func() (int64, error) {
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, errBadRecord
+		}
+		return int64(binary.BigEndian.Uint64(b[:])), nil
+	}
+
+	if op, err = r.ReadByte(); err != nil {
+		return 0, "", val, errBadRecord
+	}
+	raw_key, err := read_bytes()
+	if err != nil {
+		return 0, "", val, err
+	}
+	key = string(raw_key)
+
+	switch op {
+	case aof_op_delete:
+
+	case aof_op_set, aof_op_set_seconds:
+		var u uint64
+		if val.version, err = read_int64(); err != nil {
+			return 0, "", val, err
+		}
+		if u, err = binary.ReadUvarint(r); err != nil {
+			return 0, "", val, errBadRecord
+		}
+		val.expirytime = int(u)
+		if val.timestamp, err = read_int64(); err != nil {
+			return 0, "", val, err
+		}
+		if u, err = binary.ReadUvarint(r); err != nil {
+			return 0, "", val, errBadRecord
+		}
+		val.numbytes = int(u)
+		if val.value, err = read_bytes(); err != nil {
+			return 0, "", val, err
+		}
+		if r.Len() > 0 {
+			if u, err = binary.ReadUvarint(r); err != nil || u > 1<<32-1 {
+				return 0, "", val, errBadRecord
+			}
+			val.flags = uint32(u)
+		}
+		if op == aof_op_set_seconds {
+			op = aof_op_set
+			val.expirytime *= 1000
+			val.timestamp *= int64(time.Second)
+		}
+
+	default:
+		return 0, "", val, errBadRecord
+	}
+
+	if r.Len() != 0 {
+		return 0, "", val, errBadRecord
+	}
+	return op, key, val, nil
+}
+
+/*
+replay_aof() rebuilds the store from the log at path. Keys which expired while the server was down are
+dropped. It returns the number of records applied.
+*/
+func replay_aof(path string) (int, error) {
+
+	return read_records(path, "aof", func(payload []byte) error {
+		op, key, val, err := decode_record(payload)
+		if err != nil {
+			return err
+		}
+		kv.apply_record(op, key, val)
+		return nil
+	})
+}
+
+/*
+read_records() calls fn with the payload of every record of the file at path, which is framed like the aof. If the
+last record is incomplete, fails its checksum or fn rejects it, which is what a crash in the middle of a write leaves
+behind, the file is truncated to the record before it and reading succeeds with everything before it. A bad record
+with others after it is not a torn write but a damaged file, and an error. name is the kind of file for the messages.
+It returns the number of records read.
+*/
+func read_records(path string, name string, fn func(payload []byte) error) (int, error) {
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(file)
+	var good_offset int64
+	var applied int
+	var header [8]byte
+
+	for {
+		_, err := io.ReadFull(reader, header[:])
+		if err == io.EOF {
+			return applied, nil
+		}
+		if err != nil {
+			break
+		}
+
+		/*
+			A length past the end of the file is a record which wasn't written completely, and isn't allocated
+		*/
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		end := good_offset + int64(len(header)) + length
+		if end > info.Size() {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			if end < info.Size() {
+				return applied, fmt.Errorf("%s %s: bad checksum of the record at offset %d", name, path, good_offset)
+			}
+			break
+		}
+		if err := fn(payload); err != nil {
+			if end < info.Size() {
+				return applied, fmt.Errorf("%s %s: bad record at offset %d: %s", name, path, good_offset, err)
+			}
+			break
+		}
+
+		good_offset = end
+		applied++
+	}
+
+	fmt.Printf("INT_ERR: %s %s has a bad tail, discarding %d bytes after offset %d\n", name, path, info.Size()-good_offset, good_offset)
+	if err := file.Truncate(good_offset); err != nil {
+		return applied, err
+	}
+	return applied, file.Sync()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+TestAofReplay() writes set and delete records through the log and checks that replaying it restores the keys with
+their original versions and expiry timestamps
+*/
+func TestAofReplay(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	log, err := open_aof(path, fsync_always)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof = log
+	defer func() { aof = nil }()
+
+	now := time.Now().UnixNano()
+	aof_log_set("aofkey1", mapval{expirytime: 0, version: 0, numbytes: 5, value: []byte("first"), timestamp: now})
+	aof_log_set("aofkey1", mapval{expirytime: 0, version: 1, numbytes: 6, value: []byte("second"), timestamp: now})
+	aof_log_set("aofkey2", mapval{expirytime: 100000, version: 7, numbytes: 5, value: []byte("mayur"), timestamp: now + int64(100*time.Second)})
+	aof_log_set("aofkey3", mapval{expirytime: 0, version: 0, numbytes: 5, value: []byte("gone!"), timestamp: now})
+	aof_log_delete("aofkey3")
+	aof_log_set("aofkey4", mapval{expirytime: 1000, version: 3, numbytes: 5, value: []byte("stale"), timestamp: now - int64(10*time.Second)})
+	log.close()
+
+	applied, err := replay_aof(path)
+	if err != nil || applied != 6 {
+		t.Fatalf("replay applied %d records, err %v", applied, err)
+	}
+
+	if val, ok := kv.get("aofkey1"); !ok || val.version != 1 || string(val.value) != "second" {
+		t.Errorf("aofkey1 = %+v", val)
+	}
+	if val, ok := kv.get("aofkey2"); !ok || val.version != 7 || val.timestamp != now+int64(100*time.Second) || val.expirytime != 100000 {
+		t.Errorf("aofkey2 = %+v", val)
+	}
+	if _, ok := kv.get("aofkey3"); ok {
+		t.Error("deleted key aofkey3 was replayed")
+	}
+	if _, ok := kv.get("aofkey4"); ok {
+		t.Error("expired key aofkey4 was replayed")
+	}
+}
+
+/*
+TestAofTruncatedTail() simulates a crash in the middle of a write and checks that replay keeps every complete record
+and cuts the partial one off the file
+*/
+func TestAofTruncatedTail(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	log, err := open_aof(path, fsync_always)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof = log
+	defer func() { aof = nil }()
+
+	aof_log_set("aoftail1", mapval{expirytime: 0, version: 4, numbytes: 5, value: []byte("mayur"), timestamp: time.Now().UnixNano()})
+	log.close()
+
+	info, _ := os.Stat(path)
+	good_size := info.Size()
+
+	partial := encode_set_record("aoftail2", mapval{expirytime: 0, version: 0, numbytes: 5, value: []byte("kale!"), timestamp: time.Now().UnixNano()})
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0, 0, 0, byte(len(partial)), 1, 2, 3, 4})
+	file.Write(partial[:len(partial)/2])
+	file.Close()
+
+	applied, err := replay_aof(path)
+	if err != nil || applied != 1 {
+		t.Fatalf("replay applied %d records, err %v", applied, err)
+	}
+
+	info, _ = os.Stat(path)
+	if info.Size() != good_size {
+		t.Errorf("aof size after recovery = %d, want %d", info.Size(), good_size)
+	}
+
+	val, ok := kv.get("aoftail1")
+	_, ok2 := kv.get("aoftail2")
+	if !ok || val.version != 4 || ok2 {
+		t.Errorf("aoftail1 = %+v, aoftail2 present = %v", val, ok2)
+	}
+}
+
+/*
+TestAofBadLength() checks that a record claiming more bytes than the file has is taken for an incomplete tail without
+allocating its length
+*/
+func TestAofBadLength(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	log, err := open_aof(path, fsync_always)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.append(encode_set_record("aoflength1", mapval{numbytes: 5, value: []byte("mayur"), timestamp: time.Now().UnixNano()}))
+	log.close()
+
+	info, _ := os.Stat(path)
+	good_size := info.Size()
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0xff, 0xff, 0xff, 0xf0, 1, 2, 3, 4, 5, 6})
+	file.Close()
+
+	applied, err := read_records(path, "aof", func(payload []byte) error { return nil })
+	if err != nil || applied != 1 {
+		t.Fatalf("read %d records, err %v", applied, err)
+	}
+	if info, _ = os.Stat(path); info.Size() != good_size {
+		t.Errorf("aof size after recovery = %d, want %d", info.Size(), good_size)
+	}
+}
+
+/*
+TestAofCorruptRecord() checks that a record failing its checksum is only discarded when it is the last one, and is an
+error when there are records after it
+*/
+func TestAofCorruptRecord(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	log, err := open_aof(path, fsync_always)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ends []int64
+	for _, key := range []string{"aofcrc1", "aofcrc2", "aofcrc3"} {
+		log.append(encode_set_record(key, mapval{numbytes: 5, value: []byte("mayur"), timestamp: time.Now().UnixNano()}))
+		ends = append(ends, log.offset())
+	}
+	log.close()
+
+	data, _ := os.ReadFile(path)
+	count := func(payload []byte) error { return nil }
+
+	middle := append([]byte(nil), data...)
+	middle[ends[1]-1] ^= 0xff
+	os.WriteFile(path, middle, 0644)
+	if _, err := read_records(path, "aof", count); err == nil {
+		t.Error("a bad record followed by good ones was read")
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Errorf("aof with a bad record in the middle was truncated to %d", info.Size())
+	}
+
+	last := append([]byte(nil), data...)
+	last[ends[2]-1] ^= 0xff
+	os.WriteFile(path, last, 0644)
+	if applied, err := read_records(path, "aof", count); err != nil || applied != 2 {
+		t.Errorf("read %d records, err %v", applied, err)
+	}
+	if info, _ := os.Stat(path); info.Size() != ends[1] {
+		t.Errorf("aof size after recovery = %d, want %d", info.Size(), ends[1])
+	}
+}
+
+/*
+TestAofSecondsRecords() replays a set record in the format used before expiry times had millisecond precision
+*/
+func TestAofSecondsRecords(t *testing.T) {
+
+	now := time.Now().Unix()
+	payload := encode_set_record("aofold", mapval{expirytime: 100, version: 2, numbytes: 5, value: []byte("mayur"), timestamp: now + 100})
+	payload[0] = aof_op_set_seconds
+
+	op, key, val, err := decode_record(payload)
+	if err != nil || op != aof_op_set || key != "aofold" {
+		t.Fatalf("decoded op %d key %q err %v", op, key, err)
+	}
+	if val.expirytime != 100000 || val.timestamp != (now+100)*int64(time.Second) || val.version != 2 {
+		t.Errorf("decoded %+v", val)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The change log gives every mutation of the store a sequence number and keeps the most recent ones, so that consumers
+such as a data warehouse loader can follow the store and resume where they stopped:
+
+	changes since <seq> [limit <n>]
+
+replies the changes after seq. Sequence numbers start at 1 and increase by one with every change, in the order the
+changes were applied, so a consumer which remembers the last sequence number it processed resumes from exactly there.
+The log keeps at most -cdc-retention changes and -cdc-retention-bytes bytes of keys and values; a consumer whose
+position is no longer in the log is told so with BEHIND and has to start over from a full copy of the store.
+
+With -cdc-file the log is also written to a file, framed like the aof, from which it is loaded on startup, so sequence
+numbers keep increasing across restarts. Without it they start again at 1. The file is rewritten to the retained
+changes when it has grown to twice their size.
+
+Every log has a random id, made when it starts empty and kept next to the file in <cdc-file>.id, so sequence numbers
+only mean the same changes under the same id. Followers resume by sequence number only from the log of the same id.
+*/
+
+/*
+Retention of the change log, set with -cdc-retention (0 disables it), -cdc-retention-bytes and -cdc-file
+*/
+var (
+	cdc_retention       = 100000
+	cdc_retention_bytes = 64 * 1024 * 1024
+	cdc_file            string
+)
+
+const cdc_batch = 1000 // changes a stream sends between checks for new ones
+
+/*
+change is one mutation of the store. val is the new value for set and cas, and the last value, without its bytes,
+for delete, expired and evicted.
+*/
+type change struct {
+	seq    uint64
+	event  string
+	key    string
+	val    mapval
+	offset int64 // where the change starts in the file, counting from the first change ever written to it
+}
+
+type change_log struct {
+	id      string // random id of the log, which sequence numbers are relative to
+	mutex   sync.Mutex
+	changes []change // oldest first, the sequence numbers are contiguous
+	next    uint64   // sequence number of the next change
+	bytes   int      // size of the keys and values of changes
+	limit   int
+	max     int
+	signal  chan bool // closed and replaced whenever a change is appended
+	file    *aof_log
+	base    int64 // offset of the start of the file
+	written int64 // offset of the end of the file
+}
+
+/*
+changelog records the changes of kv. It is nil when the change log is disabled.
+*/
+var changelog = new_change_log(cdc_retention, cdc_retention_bytes)
+
+func new_change_log(limit int, max int) *change_log {
+
+	if limit <= 0 {
+		return nil
+	}
+	return &change_log{id: new_log_id(), next: 1, limit: limit, max: max, signal: make(chan bool)}
+}
+
+func new_log_id() string {
+
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+/*
+Events of the file, stored as one byte in front of the aof record of the change. New events go at the end, so the
+codes of the files already written keep their meaning.
+*/
+var cdc_events = []string{"set", "cas", "delete", "expired", "evicted", "migrated"}
+
+func cdc_event_code(event string) byte {
+
+	for i, name := range cdc_events {
+		if name == event {
+			return byte(i)
+		}
+	}
+	return 0
+}
+
+/*
+record_change() is called by the store with the shard of key locked for every change it makes. It appends the change
+to the change log and notifies the connections watching the key.
+*/
+func record_change(event string, key string, val mapval) {
+
+	if changelog != nil {
+		changelog.append(event, key, val)
+	}
+	hub.notify(event, key, val.version)
+}
+
+func (cl *change_log) append(event string, key string, val mapval) {
+
+	if event != "set" && event != "cas" {
+		val.value = nil
+	}
+	val.stats = nil
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	c := change{seq: cl.next, event: event, key: key, val: val, offset: cl.written}
+	cl.next++
+	if cl.file != nil {
+		payload := encode_change(c)
+		if err := cl.file.append(payload); err != nil {
+			fmt.Printf("INT_ERR: Writing change log: %s\n", err)
+		}
+		cl.written += int64(8 + len(payload))
+	}
+	cl.push(c)
+
+	close(cl.signal)
+	cl.signal = make(chan bool)
+}
+
+/*
+push() adds c to the retained changes and drops the oldest ones over the limits. The caller must hold the mutex.
+*/
+func (cl *change_log) push(c change) {
+
+	cl.changes = append(cl.changes, c)
+	cl.bytes += len(c.key) + len(c.val.value)
+	for len(cl.changes) > cl.limit || (cl.bytes > cl.max && len(cl.changes) > 1) {
+		cl.bytes -= len(cl.changes[0].key) + len(cl.changes[0].val.value)
+		cl.changes[0] = change{}
+		cl.changes = cl.changes[1:]
+	}
+}
+
+/*
+read() returns up to max changes after the sequence number after. behind is true if after is not a position in the
+log, either because the changes after it were dropped or because it is ahead of the log. When there are no changes
+after it yet, wait is closed as soon as there are.
+*/
+func (cl *change_log) read(after uint64, max int) (changes []change, first uint64, behind bool, wait chan bool) {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	first = cl.next - uint64(len(cl.changes))
+	if after+1 < first || after >= cl.next {
+		return nil, first, true, nil
+	}
+	start := int(after + 1 - first)
+	end := start + max
+	if end > len(cl.changes) {
+		end = len(cl.changes)
+	}
+	changes = append(changes, cl.changes[start:end]...)
+	return changes, first, false, cl.signal
+}
+
+/*
+write_change() writes c in the format of the changes command:
+
+	CHANGE <seq> <event> <key> <version> <expiry> <numbytes>\r\n<value bytes>\r\n    (set and cas)
+	CHANGE <seq> <event> <key> <version>\r\n                                          (delete, expired, evicted)
+
+expiry is the unix time in milliseconds the key expires at, 0 for never
+*/
+func write_change(writer *bufio.Writer, c change) {
+
+	line := "CHANGE " + strconv.FormatUint(c.seq, 10) + " " + c.event + " " + c.key + " " + strconv.FormatInt(c.val.version, 10)
+	if c.event != "set" && c.event != "cas" {
+		writer.WriteString(line + "\r\n")
+		return
+	}
+	var expiry int64
+	if c.val.expirytime != 0 {
+		expiry = c.val.timestamp / int64(time.Millisecond)
+	}
+	writer.WriteString(line + " " + strconv.FormatInt(expiry, 10) + " " + strconv.Itoa(len(c.val.value)) + "\r\n")
+	writer.Write(c.val.value)
+	writer.WriteString("\r\n")
+}
+
+/*
+changes_command() runs changes since <seq>. With a limit it replies up to limit changes followed by END <seq>, the
+position to continue from. Without one it streams the changes, waiting for new ones, until the client disconnects or
+falls behind; it returns false when the connection must be closed.
+*/
+func changes_command(reader *bufio.Reader, writer *bufio.Writer, since uint64, limit int) bool {
+
+	if limit > 0 {
+		changes, first, behind, _ := changelog.read(since, limit)
+		if behind {
+			writer.WriteString("BEHIND " + strconv.FormatUint(first, 10) + "\r\n")
+			return true
+		}
+		for _, c := range changes {
+			write_change(writer, c)
+			since = c.seq
+		}
+		writer.WriteString("END " + strconv.FormatUint(since, 10) + "\r\n")
+		return true
+	}
+	return stream_changes(reader, writer, since)
+}
+
+/*
+stream_changes() writes the changes after since as they are made until the client disconnects or falls behind the
+log. It always returns false, as the connection can't be used for anything else afterwards.
+*/
+func stream_changes(reader *bufio.Reader, writer *bufio.Writer, since uint64) bool {
+
+	/*
+		The client has nothing to say while it is streaming, so anything it sends is discarded and the stream ends
+		when the connection does
+	*/
+	quit := make(chan bool)
+	go func() {
+		io.Copy(io.Discard, reader)
+		close(quit)
+	}()
+
+	for {
+		changes, first, behind, wait := changelog.read(since, cdc_batch)
+		if behind {
+			writer.WriteString("BEHIND " + strconv.FormatUint(first, 10) + "\r\n")
+			return false
+		}
+		for _, c := range changes {
+			write_change(writer, c)
+			since = c.seq
+		}
+		if len(changes) == cdc_batch {
+			continue
+		}
+		if writer.Flush() != nil {
+			return false
+		}
+		select {
+		case <-wait:
+		case <-quit:
+			return false
+		}
+	}
+}
+
+/*
+encode_change() encodes c for the file as seq(uint64) event(byte) followed by the aof record of the key, which for
+delete, expired and evicted is followed by the version(int64)
+*/
+func encode_change(c change) []byte {
+
+	buf := binary.BigEndian.AppendUint64(nil, c.seq)
+	buf = append(buf, cdc_event_code(c.event))
+	if c.event == "set" || c.event == "cas" {
+		return append(buf, encode_set_record(c.key, c.val)...)
+	}
+	buf = append(buf, encode_delete_record(c.key)...)
+	return binary.BigEndian.AppendUint64(buf, uint64(c.val.version))
+}
+
+func decode_change(payload []byte) (change, error) {
+
+	if len(payload) < 9 || int(payload[8]) >= len(cdc_events) {
+		return change{}, errBadRecord
+	}
+	c := change{seq: binary.BigEndian.Uint64(payload), event: cdc_events[payload[8]]}
+	record := payload[9:]
+	if c.event != "set" && c.event != "cas" {
+		if len(record) < 8 {
+			return change{}, errBadRecord
+		}
+		c.val.version = int64(binary.BigEndian.Uint64(record[len(record)-8:]))
+		record = record[:len(record)-8]
+	}
+	_, key, val, err := decode_record(record)
+	if err != nil {
+		return change{}, err
+	}
+	c.key = key
+	if c.event == "set" || c.event == "cas" {
+		c.val = val
+	}
+	return c, nil
+}
+
+/*
+open_file() loads the changes kept in the file at path and appends the following ones to it. The id of the log is
+loaded from path.id when the file has changes, and written there otherwise.
+*/
+func (cl *change_log) open_file(path string) error {
+
+	_, err := read_records(path, "change log", func(payload []byte) error {
+		c, err := decode_change(payload)
+		if err != nil || (len(cl.changes) > 0 && c.seq != cl.next) {
+			return errBadRecord
+		}
+		c.offset = cl.written
+		cl.next = c.seq + 1
+		cl.written += int64(8 + len(payload))
+		cl.push(c)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	id, err := os.ReadFile(path + ".id")
+	if err == nil && len(cl.changes) > 0 && strings.TrimSpace(string(id)) != "" {
+		cl.id = strings.TrimSpace(string(id))
+	} else if err = os.WriteFile(path+".id", []byte(cl.id+"\n"), 0644); err != nil {
+		return err
+	}
+	if cl.file, err = open_aof(path, fsync_everysec); err != nil {
+		return err
+	}
+	go cl.periodic_compact()
+	return nil
+}
+
+/*
+periodic_compact() rewrites the file to the retained changes whenever it has grown to twice their size
+*/
+func (cl *change_log) periodic_compact() {
+
+	ticker := time.NewTicker(time.Second)
+	for range ticker.C {
+		cl.mutex.Lock()
+		start := cl.written
+		if len(cl.changes) > 0 {
+			start = cl.changes[0].offset
+		}
+		if start-cl.base > 1024*1024 && start-cl.base > cl.written-start {
+			if err := cl.file.compact(start - cl.base); err != nil {
+				fmt.Printf("INT_ERR: Compacting change log: %s\n", err)
+			} else {
+				cl.base = start
+			}
+		}
+		cl.mutex.Unlock()
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+TestChangeLogRetention() checks that the log keeps the most recent changes within its limits and reports readers
+whose position is outside of it as behind
+*/
+func TestChangeLogRetention(t *testing.T) {
+
+	cl := new_change_log(10, 1000)
+	for i := 0; i < 25; i++ {
+		cl.append("set", "key"+strconv.Itoa(i), mapval{version: int64(i), value: []byte("v")})
+	}
+
+	changes, first, behind, _ := cl.read(15, 100)
+	if behind || first != 16 || len(changes) != 10 || changes[0].seq != 16 || changes[9].key != "key24" {
+		t.Fatalf("read(15) = %d changes from %d, behind %v", len(changes), first, behind)
+	}
+	if changes, _, behind, _ := cl.read(20, 2); behind || len(changes) != 2 || changes[1].seq != 22 {
+		t.Errorf("read(20, 2) = %v, behind %v", changes, behind)
+	}
+	if _, first, behind, _ := cl.read(14, 100); behind == false || first != 16 {
+		t.Errorf("read(14) is not behind the log starting at %d", first)
+	}
+	if _, _, behind, _ := cl.read(26, 100); behind == false {
+		t.Error("read(26) is not behind a log ending at 25")
+	}
+
+	/*
+		A reader at the end of the log waits for the next change
+	*/
+	changes, _, behind, wait := cl.read(25, 100)
+	if behind || len(changes) != 0 {
+		t.Fatalf("read(25) = %d changes, behind %v", len(changes), behind)
+	}
+	select {
+	case <-wait:
+		t.Fatal("wait was signalled without a change")
+	default:
+	}
+	cl.append("delete", "key24", mapval{version: 24, value: []byte("v")})
+	select {
+	case <-wait:
+	case <-time.After(time.Second):
+		t.Fatal("wait was not signalled by a change")
+	}
+	if changes, _, _, _ := cl.read(25, 100); len(changes) != 1 || changes[0].val.value != nil {
+		t.Errorf("delete was recorded as %v", changes)
+	}
+
+	/*
+		The byte limit drops changes before the count limit does
+	*/
+	cl = new_change_log(10, 100)
+	for i := 0; i < 5; i++ {
+		cl.append("set", "k", mapval{value: make([]byte, 40)})
+	}
+	if _, first, _, _ := cl.read(4, 100); first != 4 || cl.bytes > 100 {
+		t.Errorf("log of %d bytes starts at %d", cl.bytes, first)
+	}
+}
+
+/*
+TestChangeLogFile() checks that changes written to the file are loaded again with their sequence numbers, and that
+sequence numbers continue after them
+*/
+func TestChangeLogFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "changes.log")
+	cl := new_change_log(100, 1000)
+	if err := cl.open_file(path); err != nil {
+		t.Fatal(err)
+	}
+	val := new_mapval(time.Hour, []byte("value"), time.Now())
+	val.version = 3
+	cl.append("set", "a", val)
+	cl.append("cas", "a", val)
+	cl.append("expired", "b", mapval{version: 7})
+	if err := cl.file.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cl = new_change_log(2, 1000)
+	if err := cl.open_file(path); err != nil {
+		t.Fatal(err)
+	}
+	changes, first, behind, _ := cl.read(1, 100)
+	if behind || first != 2 || len(changes) != 2 {
+		t.Fatalf("loaded %d changes from %d, behind %v", len(changes), first, behind)
+	}
+	if c := changes[0]; c.seq != 2 || c.event != "cas" || c.key != "a" || string(c.val.value) != "value" || c.val.version != 3 || c.val.timestamp != val.timestamp {
+		t.Errorf("loaded %+v", c)
+	}
+	if c := changes[1]; c.seq != 3 || c.event != "expired" || c.key != "b" || c.val.version != 7 {
+		t.Errorf("loaded %+v", c)
+	}
+	cl.append("delete", "a", val)
+	if changes, _, _, _ := cl.read(3, 100); len(changes) != 1 || changes[0].seq != 4 {
+		t.Errorf("change after loading = %v", changes)
+	}
+	cl.file.close()
+
+	/*
+		The id is kept with the changes, and a new log gets a new one
+	*/
+	reloaded := new_change_log(100, 1000)
+	if err := reloaded.open_file(path); err != nil {
+		t.Fatal(err)
+	}
+	reloaded.file.close()
+	fresh := new_change_log(100, 1000)
+	if err := fresh.open_file(filepath.Join(t.TempDir(), "changes.log")); err != nil {
+		t.Fatal(err)
+	}
+	fresh.file.close()
+	if reloaded.id != cl.id || fresh.id == cl.id || fresh.id == "" {
+		t.Errorf("log ids %q, %q after reload and %q for a new file", cl.id, reloaded.id, fresh.id)
+	}
+}
+
+/*
+TestChangeEvents() checks that every event survives encode_change() and decode_change(), and a reload of the file
+*/
+func TestChangeEvents(t *testing.T) {
+
+	for _, event := range cdc_events {
+		c := change{seq: 9, event: event, key: "k", val: mapval{version: 4}}
+		got, err := decode_change(encode_change(c))
+		if err != nil || got.seq != 9 || got.event != event || got.key != "k" || got.val.version != 4 {
+			t.Errorf("%s decoded as %+v, %v", event, got, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "changes.log")
+	cl := new_change_log(100, 1000)
+	if err := cl.open_file(path); err != nil {
+		t.Fatal(err)
+	}
+	cl.append("migrated", "a", mapval{version: 2})
+	cl.append("set", "b", new_mapval(0, []byte("v"), time.Now()))
+	cl.file.close()
+
+	cl = new_change_log(100, 1000)
+	if err := cl.open_file(path); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.file.close()
+	changes, _, _, _ := cl.read(0, 100)
+	if len(changes) != 2 || changes[0].event != "migrated" || changes[1].key != "b" {
+		t.Errorf("loaded %+v", changes)
+	}
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A partitioned cluster. Servers started with -cluster <addr1>,...,<addrn>, every one with the same list in the same
+order, split the key space into cluster_slots hash slots and own a contiguous range of them each. A key belongs to the
+slot crc32(key) % cluster_slots; if the key has a non-empty part between { and the next }, only that part is hashed,
+so keys like user:{42}:name and user:{42}:mail are kept together for getm, transactions and scripts.
+
+A server only runs commands on the keys of its slots. For any other key it replies
+
+	MOVED <slot> <addr>\r\n
+
+with the server owning the slot, and cluster slots publishes the whole slot map so clients can send every key to the
+right server in the first place.
+
+A slot is moved to another server online with cluster migrate, sent to its owner. The owner marks the slot migrating
+and the target importing, then copies the keys of the slot over in batches, with their versions and expiry times,
+deleting each key once the target has it. Meanwhile the owner serves the keys it still has and replies
+
+	ASK <slot> <addr>\r\n
+
+for the others, which the client sends to the target preceded by asking\r\n; the target only serves a slot it imports
+to clients which asked. When no key is left, the target and then every other server learn the new owner, and the
+old owner replies MOVED from then on. Ownership changes carry an epoch, increased by every migration of the slot, so
+a server never goes back to an older owner.
+*/
+
+const cluster_slots = 16384
+
+/*
+Keys copied to the target of a migration per import
+*/
+const cluster_migrate_batch = 100
+
+/*
+Time a migration waits for the target to answer
+*/
+const cluster_timeout = 5 * time.Second
+
+/*
+cluster is the cluster state of the server, nil unless it was started with -cluster or -cluster-join
+*/
+var cluster *cluster_state
+
+var errCrossSlot = errors.New("ERR_CROSSSLOT")
+
+type cluster_state struct {
+	mutex     sync.RWMutex
+	self      string
+	nodes     []string              // every server known to be in the cluster, self included
+	owner     [cluster_slots]string // the server owning every slot
+	epoch     [cluster_slots]uint64 // the epoch of the owner of every slot
+	migrating map[int]string        // slots this server moves away, and where to
+	importing map[int]string        // slots moved here, and where from
+
+	/*
+		moving is held for writing by a migration while it deletes keys which were copied, and for reading by
+		commands while they check and use their keys, so a key can't leave between the two
+	*/
+	moving sync.RWMutex
+
+	migration sync.Mutex // a server runs one migration at a time
+}
+
+/*
+new_cluster_state() returns the state of server self in a cluster of nodes, splitting the slots evenly between them in
+the order given
+*/
+func new_cluster_state(self string, nodes []string) *cluster_state {
+
+	c := &cluster_state{self: self, migrating: make(map[int]string), importing: make(map[int]string)}
+	for _, node := range nodes {
+		c.add_node(node)
+	}
+	for slot := range c.owner {
+		if len(nodes) > 0 {
+			c.owner[slot] = nodes[slot*len(nodes)/cluster_slots]
+		}
+	}
+	c.add_node(self)
+	return c
+}
+
+func (c *cluster_state) add_node(node string) {
+
+	for _, n := range c.nodes {
+		if n == node {
+			return
+		}
+	}
+	c.nodes = append(c.nodes, node)
+}
+
+/*
+slot_of() returns the hash slot of key
+*/
+func slot_of(key string) int {
+
+	if open := strings.IndexByte(key, '{'); open >= 0 {
+		if end := strings.IndexByte(key[open+1:], '}'); end > 0 {
+			key = key[open+1 : open+1+end]
+		}
+	}
+	return int(crc32.ChecksumIEEE([]byte(key)) % cluster_slots)
+}
+
+/*
+route() returns "" if this server runs a command on keys, and otherwise the reply sending the client elsewhere. keys
+of a slot being migrated away are only served while ops still has them, so the caller must hold moving for reading or
+the locks of the store. asking is whether the client sent asking before the command.
+*/
+func (c *cluster_state) route(ops store_ops, keys []string, asking bool) string {
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	redirect := ""
+	for i, key := range keys {
+		slot := slot_of(key)
+		reply := ""
+		if owner := c.owner[slot]; owner == c.self {
+			if target, ok := c.migrating[slot]; ok {
+				if _, found := ops.get(key); found == false {
+					reply = "ASK " + strconv.Itoa(slot) + " " + target + "\r\n"
+				}
+			}
+		} else if _, ok := c.importing[slot]; ok == false || asking == false {
+			reply = "MOVED " + strconv.Itoa(slot) + " " + owner + "\r\n"
+		}
+
+		/*
+			Every key must be served by the same server, and in a slot being migrated they must all still be here
+			or all be gone
+		*/
+		if i > 0 && reply != redirect {
+			return error_message(errCrossSlot)
+		}
+		redirect = reply
+	}
+	return redirect
+}
+
+/*
+serve() returns run checked by route(), which writes where to go instead of running when this server doesn't serve
+keys, unless reply is false for noreply. Inside exec, which holds the locks of the store, run is checked as it is.
+It returns run unchanged when c is nil, outside a cluster.
+*/
+func (c *cluster_state) serve(keys []string, asking bool, reply bool, run func(ops store_ops, out *bufio.Writer)) func(ops store_ops, out *bufio.Writer) {
+
+	if c == nil {
+		return run
+	}
+	return func(ops store_ops, out *bufio.Writer) {
+		if _, locked := ops.(*txn); locked == false {
+			c.moving.RLock()
+			defer c.moving.RUnlock()
+		}
+		if redirect := c.route(ops, keys, asking); redirect != "" {
+			if reply {
+				out.WriteString(redirect)
+			}
+			return
+		}
+		run(ops, out)
+	}
+}
+
+/*
+set_owner() makes node the owner of slot unless the owner this server knows has a later epoch, and ends a migration
+of the slot to or from this server
+*/
+func (c *cluster_state) set_owner(slot int, node string, epoch uint64) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.add_node(node)
+	if epoch <= c.epoch[slot] {
+		return
+	}
+	c.owner[slot], c.epoch[slot] = node, epoch
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+}
+
+/*
+slot_ranges() returns the slot map as ranges of consecutive slots with the same owner
+*/
+func (c *cluster_state) slot_ranges() []slot_range {
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var ranges []slot_range
+	for slot, owner := range c.owner {
+		if n := len(ranges); n > 0 && ranges[n-1].owner == owner {
+			ranges[n-1].end = slot
+			continue
+		}
+		ranges = append(ranges, slot_range{slot, slot, owner})
+	}
+	return ranges
+}
+
+type slot_range struct {
+	start int
+	end   int
+	owner string
+}
+
+/*
+join_cluster() makes the server a member of the cluster seed is in, owning no slots until some are migrated to it
+*/
+func join_cluster(self string, seed string) error {
+
+	con, err := net.DialTimeout("tcp", seed, cluster_timeout)
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+	reader := bufio.NewReader(con)
+	if _, err := io.WriteString(con, "cluster slots\r\n"); err != nil {
+		return err
+	}
+
+	c := new_cluster_state(self, nil)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 1 && fields[0] == "END" {
+			break
+		}
+		if len(fields) != 4 || fields[0] != "SLOT" {
+			return fmt.Errorf("bad reply %q", line)
+		}
+		start, err := strconv.Atoi(fields[1])
+		end, eerr := strconv.Atoi(fields[2])
+		if err != nil || eerr != nil || start < 0 || start > end || end >= cluster_slots {
+			return fmt.Errorf("bad reply %q", line)
+		}
+		for slot := start; slot <= end; slot++ {
+			c.owner[slot] = fields[3]
+		}
+		c.add_node(fields[3])
+	}
+	cluster = c
+	return nil
+}
+
+/*
+cluster_command() runs the cluster commands of the text protocol on the cluster state c of store s:
+
+	cluster slots                               replies SLOT <start> <end> <addr>\r\n for every range of slots
+	                                            with the same owner, then END\r\n
+	cluster keyslot <key>                       replies KEYSLOT <slot>\r\n
+	cluster migrate <slot> <addr>               moves slot to the server listening on addr, replies
+	                                            MIGRATED <slot> <keys moved>\r\n
+	cluster setslot <slot> importing <addr>     sent by a migration to its target
+	cluster setslot <slot> node <addr> <epoch>  sent by a migration to every server when it is done
+	cluster import <numbytes>\r\n<records>\r\n   sent by a migration with keys for its target
+
+It returns false when the connection must be closed.
+*/
+func cluster_command(c *cluster_state, s *store, reader *bufio.Reader, writer *bufio.Writer, args []string) bool {
+
+	if c == nil || len(args) == 0 {
+		writer.WriteString("ERRCMDERR\r\n")
+		return true
+	}
+
+	var slot int
+	slot_ok := false
+	if len(args) >= 2 && (args[0] == "migrate" || args[0] == "setslot") {
+		n, err := strconv.Atoi(args[1])
+		slot, slot_ok = n, err == nil && n >= 0 && n < cluster_slots
+	}
+
+	switch {
+	case len(args) == 1 && args[0] == "slots":
+		for _, r := range c.slot_ranges() {
+			writer.WriteString("SLOT " + strconv.Itoa(r.start) + " " + strconv.Itoa(r.end) + " " + r.owner + "\r\n")
+		}
+		writer.WriteString("END\r\n")
+
+	case len(args) == 2 && args[0] == "keyslot":
+		writer.WriteString("KEYSLOT " + strconv.Itoa(slot_of(args[1])) + "\r\n")
+
+	case len(args) == 3 && args[0] == "migrate" && slot_ok:
+		moved, err := c.migrate(s, slot, args[2])
+		if err != nil {
+			fmt.Printf("INT_ERR: Migrating slot %d to %s: %s\n", slot, args[2], err)
+			writer.WriteString("ERR_MIGRATE " + err.Error() + "\r\n")
+			break
+		}
+		writer.WriteString("MIGRATED " + strconv.Itoa(slot) + " " + strconv.Itoa(moved) + "\r\n")
+
+	case len(args) == 4 && args[0] == "setslot" && args[2] == "importing" && slot_ok:
+		c.mutex.Lock()
+		c.add_node(args[3])
+		c.importing[slot] = args[3]
+		c.mutex.Unlock()
+		writer.WriteString("OK\r\n")
+
+	case len(args) == 5 && args[0] == "setslot" && args[2] == "node" && slot_ok:
+		epoch, err := strconv.ParseUint(args[4], 10, 64)
+		if err != nil {
+			writer.WriteString("ERRCMDERR\r\n")
+			break
+		}
+		c.set_owner(slot, args[3], epoch)
+		writer.WriteString("OK\r\n")
+
+	case len(args) == 2 && args[0] == "import":
+		numbytes, err := strconv.Atoi(args[1])
+		if err != nil {
+			numbytes = 0
+		}
+		payload, ok, err := read_value(reader, numbytes)
+		if err != nil {
+			return false
+		}
+		if ok == false {
+			writer.WriteString("ERRCMDERR\r\n")
+			break
+		}
+		count, err := c.import_records(s, payload)
+		if err != nil {
+			writer.WriteString("ERR_MIGRATE " + err.Error() + "\r\n")
+			break
+		}
+		writer.WriteString("IMPORTED " + strconv.Itoa(count) + "\r\n")
+
+	default:
+		writer.WriteString("ERRCMDERR\r\n")
+	}
+	return true
+}
+
+/*
+encode_import() encodes records for cluster import, each prefixed with its length as a uvarint. A delete record is
+followed by the version(int64) and expiry timestamp(int64) of the copy it takes back.
+*/
+func encode_import(records [][]byte) []byte {
+
+	var buf []byte
+	for _, record := range records {
+		buf = binary.AppendUvarint(buf, uint64(len(record)))
+		buf = append(buf, record...)
+	}
+	return buf
+}
+
+/*
+import_records() applies the records of a cluster import to s. Every key must be in a slot this server imports or owns.
+*/
+func (c *cluster_state) import_records(s *store, payload []byte) (int, error) {
+
+	r := bytes.NewReader(payload)
+	count := 0
+	for r.Len() > 0 {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return count, errBadRecord
+		}
+		record := make([]byte, n)
+		io.ReadFull(r, record)
+		var copied []byte
+		if len(record) > 16 && record[0] == aof_op_delete {
+			copied = record[len(record)-16:]
+			record = record[:len(record)-16]
+		}
+		op, key, val, err := decode_record(record)
+		if err != nil {
+			return count, err
+		}
+		if copied != nil {
+			val.version = int64(binary.BigEndian.Uint64(copied))
+			val.timestamp = int64(binary.BigEndian.Uint64(copied[8:]))
+		}
+
+		slot := slot_of(key)
+		c.mutex.RLock()
+		_, importing := c.importing[slot]
+		owned := c.owner[slot] == c.self
+		c.mutex.RUnlock()
+		if importing == false && owned == false {
+			return count, fmt.Errorf("slot %d is not imported", slot)
+		}
+
+		if err := s.import_entry(op, key, val); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+/*
+import_entry() stores an entry a migration copied here with its version and expiry time. A delete record, or a copy
+which expired on the way, only takes back the copy of the key with the same version and expiry time, as any other
+entry of the key was written here by a client sent with ASK and is the live one. It is logged to the aof and recorded
+as a set or delete change.
+*/
+func (s *store) import_entry(op byte, key string, val mapval) error {
+
+	sh := s.shard_for(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	if op == aof_op_delete || is_expired(val, time.Now().UnixNano()) {
+		old, ok := sh.memmap[key]
+		if ok == false || old.version != val.version || old.timestamp != val.timestamp {
+			return nil
+		}
+		if err := aof_log_delete(key); err != nil {
+			return err
+		}
+		sh.remove(key)
+		record_change("delete", key, old)
+		return nil
+	}
+	return sh.put(key, val, "set")
+}
+
+/*
+slot_keys() returns the keys of s in slot
+*/
+func (s *store) slot_keys(slot int) []string {
+
+	var keys []string
+	for _, sh := range s.shards {
+		sh.mutex.RLock()
+		for key := range sh.memmap {
+			if slot_of(key) == slot {
+				keys = append(keys, key)
+			}
+		}
+		sh.mutex.RUnlock()
+	}
+	return keys
+}
+
+/*
+export_entry() returns the record copying key to the target of a migration and the state it was copied in. copied
+holds the version and expiry time of the keys already copied. A key which is gone was either never copied, and
+nothing is sent, or was deleted here after its copy was sent, and a delete record takes back that copy only.
+*/
+func (s *store) export_entry(key string, copied map[string]mapval) ([]byte, watched_key) {
+
+	sh := s.shard_for(key)
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+
+	state := sh.watch_state(key)
+	if state.exists == false {
+		sent, ok := copied[key]
+		if ok == false {
+			return nil, state
+		}
+		delete(copied, key)
+		record := encode_delete_record(key)
+		record = binary.BigEndian.AppendUint64(record, uint64(sent.version))
+		return binary.BigEndian.AppendUint64(record, uint64(sent.timestamp)), state
+	}
+	val := sh.memmap[key]
+	copied[key] = mapval{version: val.version, timestamp: val.timestamp}
+	return encode_set_record(key, val), state
+}
+
+/*
+remove_migrated() deletes key, which was copied to the target of a migration in state, unless it changed since. The
+delete is logged to the aof and recorded as a migrated change, or an expired one for a key which had expired. It
+returns whether the key was deleted or already gone.
+*/
+func (s *store) remove_migrated(key string, state watched_key) (bool, error) {
+
+	sh := s.shard_for(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	if sh.watch_state(key) != state {
+		return false, nil
+	}
+	old, ok := sh.memmap[key]
+	if ok == false {
+		return true, nil
+	}
+	if err := aof_log_delete(key); err != nil {
+		return false, err
+	}
+	sh.remove(key)
+	if state.exists {
+		record_change("migrated", key, old)
+	} else {
+		record_change("expired", key, old)
+	}
+	return true, nil
+}
+
+/*
+cluster_conn is a connection of a migration to another server
+*/
+type cluster_conn struct {
+	con    net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func dial_cluster(addr string) (*cluster_conn, error) {
+
+	con, err := net.DialTimeout("tcp", addr, cluster_timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &cluster_conn{con, bufio.NewReader(con), bufio.NewWriter(con)}, nil
+}
+
+/*
+call() sends command, followed by payload as a value block if it isn't nil, and returns the reply line, which must
+start with expect
+*/
+func (cc *cluster_conn) call(command string, payload []byte, expect string) (string, error) {
+
+	cc.con.SetDeadline(time.Now().Add(cluster_timeout))
+	cc.writer.WriteString(command + "\r\n")
+	if payload != nil {
+		cc.writer.Write(payload)
+		cc.writer.WriteString("\r\n")
+	}
+	if err := cc.writer.Flush(); err != nil {
+		return "", err
+	}
+	line, err := cc.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, expect) == false {
+		return "", fmt.Errorf("%s replied %q", command, line)
+	}
+	return line, nil
+}
+
+/*
+migrate() moves slot of s to target while both keep serving it, and returns the number of keys moved. A migration
+which fails leaves the slot migrating, with every key on one of the two servers, and can be run again.
+
+The keys are copied in batches, each key being deleted afterwards only if it didn't change meanwhile, so the commands
+on the slot only wait for the deletes. The keys which changed are copied again at the end with moving held, which
+stops the commands on migrating slots until they are moved.
+*/
+func (c *cluster_state) migrate(s *store, slot int, target string) (int, error) {
+
+	c.migration.Lock()
+	defer c.migration.Unlock()
+
+	c.mutex.RLock()
+	owner, epoch := c.owner[slot], c.epoch[slot]
+	current, migrating := c.migrating[slot]
+	c.mutex.RUnlock()
+	if owner != c.self || target == c.self || (migrating && current != target) {
+		return 0, fmt.Errorf("slot %d is not owned here or moves elsewhere", slot)
+	}
+
+	cc, err := dial_cluster(target)
+	if err != nil {
+		return 0, err
+	}
+	defer cc.con.Close()
+	if _, err := cc.call("cluster setslot "+strconv.Itoa(slot)+" importing "+c.self, nil, "OK"); err != nil {
+		return 0, err
+	}
+	c.mutex.Lock()
+	c.add_node(target)
+	c.migrating[slot] = target
+	c.mutex.Unlock()
+
+	copied := make(map[string]mapval)
+	send := func(keys []string) ([]watched_key, error) {
+		var records [][]byte
+		states := make([]watched_key, len(keys))
+		for i, key := range keys {
+			var record []byte
+			if record, states[i] = s.export_entry(key, copied); record != nil {
+				records = append(records, record)
+			}
+		}
+		if len(records) == 0 {
+			return states, nil
+		}
+		payload := encode_import(records)
+		_, err := cc.call("cluster import "+strconv.Itoa(len(payload)), payload, "IMPORTED")
+		return states, err
+	}
+
+	moved := 0
+	var changed []string
+	keys := s.slot_keys(slot)
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > cluster_migrate_batch {
+			batch = batch[:cluster_migrate_batch]
+		}
+		keys = keys[len(batch):]
+		states, err := send(batch)
+		if err != nil {
+			return moved, err
+		}
+
+		c.moving.Lock()
+		for i, key := range batch {
+			removed, rerr := s.remove_migrated(key, states[i])
+			if rerr != nil {
+				err = rerr
+				break
+			}
+			if removed == false {
+				changed = append(changed, key)
+				continue
+			}
+			delete(copied, key)
+			if states[i].exists {
+				moved++
+			}
+		}
+		c.moving.Unlock()
+		if err != nil {
+			return moved, err
+		}
+	}
+
+	/*
+		Nothing changes the slot while moving is held, so what is copied now is final
+	*/
+	c.moving.Lock()
+	defer c.moving.Unlock()
+	for len(changed) > 0 {
+		batch := changed
+		if len(batch) > cluster_migrate_batch {
+			batch = batch[:cluster_migrate_batch]
+		}
+		changed = changed[len(batch):]
+		states, err := send(batch)
+		if err != nil {
+			return moved, err
+		}
+		for i, key := range batch {
+			if _, err := s.remove_migrated(key, states[i]); err != nil {
+				return moved, err
+			}
+			if states[i].exists {
+				moved++
+			}
+		}
+	}
+
+	/*
+		The target learns it owns the slot before this server starts sending clients there
+	*/
+	command := "cluster setslot " + strconv.Itoa(slot) + " node " + target + " " + strconv.FormatUint(epoch+1, 10)
+	if _, err := cc.call(command, nil, "OK"); err != nil {
+		return moved, err
+	}
+	c.set_owner(slot, target, epoch+1)
+
+	c.mutex.RLock()
+	nodes := append([]string(nil), c.nodes...)
+	c.mutex.RUnlock()
+	for _, node := range nodes {
+		if node == c.self || node == target {
+			continue
+		}
+		other, err := dial_cluster(node)
+		if err == nil {
+			_, err = other.call(command, nil, "OK")
+			other.con.Close()
+		}
+		if err != nil {
+			fmt.Printf("INT_ERR: Announcing the owner of slot %d to %s: %s\n", slot, node, err)
+		}
+	}
+	return moved, nil
+}
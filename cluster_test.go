@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+key_in() returns a key whose slot is owned by node in c
+*/
+func key_in(c *cluster_state, node string) string {
+
+	for i := 0; ; i++ {
+		key := "key" + strconv.Itoa(i)
+		if c.owner[slot_of(key)] == node {
+			return key
+		}
+	}
+}
+
+func TestSlotOf(t *testing.T) {
+
+	if slot_of("user:{42}:name") != slot_of("user:{42}:mail") || slot_of("user:{42}:name") != slot_of("42") {
+		t.Error("keys with the same hash tag are in different slots")
+	}
+	if slot_of("a{}b") == slot_of("") && slot_of("a{}c") == slot_of("") {
+		t.Error("empty hash tag is used")
+	}
+	for i := 0; i < 1000; i++ {
+		if slot := slot_of(strconv.Itoa(i)); slot < 0 || slot >= cluster_slots {
+			t.Fatalf("slot %d", slot)
+		}
+	}
+}
+
+func TestClusterRoute(t *testing.T) {
+
+	s := new_store(4)
+	c := new_cluster_state("a", []string{"a", "b"})
+	if c.owner[0] != "a" || c.owner[cluster_slots-1] != "b" {
+		t.Fatalf("slots 0 and %d owned by %s and %s", cluster_slots-1, c.owner[0], c.owner[cluster_slots-1])
+	}
+	local, remote := key_in(c, "a"), key_in(c, "b")
+	moved := "MOVED " + strconv.Itoa(slot_of(remote)) + " b\r\n"
+
+	if r := c.route(s, []string{local}, false); r != "" {
+		t.Errorf("local key routed to %q", r)
+	}
+	if r := c.route(s, []string{remote}, false); r != moved {
+		t.Errorf("remote key routed to %q", r)
+	}
+	if r := c.route(s, []string{local, remote}, false); r != "ERR_CROSSSLOT\r\n" {
+		t.Errorf("keys of two servers routed to %q", r)
+	}
+
+	/*
+		A slot being migrated away is served while the key is still here
+	*/
+	s.set(local, 0, []byte("x"))
+	c.migrating[slot_of(local)] = "b"
+	if r := c.route(s, []string{local}, false); r != "" {
+		t.Errorf("key not migrated yet routed to %q", r)
+	}
+	s.delete(local)
+	if r := c.route(s, []string{local}, false); r != "ASK "+strconv.Itoa(slot_of(local))+" b\r\n" {
+		t.Errorf("migrated key routed to %q", r)
+	}
+
+	/*
+		A slot being imported is only served after asking
+	*/
+	c.importing[slot_of(remote)] = "b"
+	if r := c.route(s, []string{remote}, false); r != moved {
+		t.Errorf("imported key routed to %q without asking", r)
+	}
+	if r := c.route(s, []string{remote}, true); r != "" {
+		t.Errorf("imported key routed to %q after asking", r)
+	}
+
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	ran := false
+	run := func(ops store_ops, out *bufio.Writer) { ran = true }
+	c.serve([]string{remote}, false, false, run)(s, out)
+	out.Flush()
+	if ran || buf.Len() != 0 {
+		t.Errorf("noreply command on a remote key ran or replied %q", buf.String())
+	}
+}
+
+func TestClusterSlots(t *testing.T) {
+
+	c := new_cluster_state("a", []string{"a", "b", "c"})
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	cluster_command(c, new_store(1), nil, writer, []string{"slots"})
+	cluster_command(c, new_store(1), nil, writer, []string{"keyslot", "{x}y"})
+	cluster_command(c, new_store(1), nil, writer, []string{"setslot", "16384", "node", "b", "1"})
+	writer.Flush()
+	want := "SLOT 0 5461 a\r\nSLOT 5462 10922 b\r\nSLOT 10923 16383 c\r\nEND\r\n" +
+		"KEYSLOT " + strconv.Itoa(slot_of("x")) + "\r\n" + "ERRCMDERR\r\n"
+	if buf.String() != want {
+		t.Errorf("replied %q, want %q", buf.String(), want)
+	}
+
+	c.set_owner(0, "c", 2)
+	c.set_owner(0, "b", 1)
+	if c.owner[0] != "c" {
+		t.Errorf("slot 0 went back to an older owner, %s", c.owner[0])
+	}
+}
+
+/*
+serve_cluster() runs the cluster commands of connections accepted on lis against c and s, as a target of migrations
+*/
+func serve_cluster(lis net.Listener, c *cluster_state, s *store) {
+
+	for {
+		con, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer con.Close()
+			reader := bufio.NewReader(con)
+			writer := bufio.NewWriter(con)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				args, ok := parse_keys(strings.Split(line, " ")[1:])
+				if ok == false || cluster_command(c, s, reader, writer, args) == false {
+					return
+				}
+				writer.Flush()
+			}
+		}()
+	}
+}
+
+/*
+TestClusterMigrate() moves a slot to another server while its keys are incremented, following the redirections as a
+client would
+*/
+func TestClusterMigrate(t *testing.T) {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	target := lis.Addr().String()
+
+	src_store, dst_store := new_store(4), new_store(4)
+	src := new_cluster_state("src", []string{"src"})
+	dst := new_cluster_state(target, []string{"src"})
+	go serve_cluster(lis, dst, dst_store)
+
+	slot := slot_of("m")
+	for i := 0; i < 250; i++ {
+		key := "{m}:" + strconv.Itoa(i)
+		src_store.set(key, 0, []byte("first"))
+		src_store.set(key, time.Hour, []byte("second"))
+	}
+	src_store.set("{m}:gone", time.Nanosecond, []byte("x"))
+	src_store.set("other", 0, []byte("stays"))
+
+	/*
+		A key which expired here before it was copied was written on the target by a client sent with ASK, and that
+		write must survive the migration
+	*/
+	src_store.set("{m}:asked", time.Nanosecond, []byte("old"))
+	dst_store.set("{m}:asked", 0, []byte("asked"))
+	before, _ := src_store.get("{m}:7")
+
+	/*
+		incr() increments key on whichever server serves it
+	*/
+	incr := func(key string) {
+		run := func(ops store_ops, out *bufio.Writer) {
+			if _, err := ops.incr(key, 1, true, 1, 0); err != nil {
+				out.WriteString(error_message(err))
+			}
+		}
+		for {
+			var buf bytes.Buffer
+			out := bufio.NewWriter(&buf)
+			src.serve([]string{key}, false, true, run)(src_store, out)
+			out.Flush()
+			if buf.Len() == 0 {
+				return
+			}
+			asking := strings.HasPrefix(buf.String(), "ASK")
+			buf.Reset()
+			dst.serve([]string{key}, asking, true, run)(dst_store, out)
+			out.Flush()
+			if buf.Len() == 0 {
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	counters := []string{"{m}:counter1", "{m}:counter2", "{m}:counter3"}
+	for _, key := range counters {
+		incr(key)
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for i := 1; i < 500; i++ {
+				incr(key)
+			}
+		}(key)
+	}
+
+	moved, err := src.migrate(src_store, slot, target)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved < 253 {
+		t.Errorf("moved %d keys", moved)
+	}
+
+	if keys := src_store.slot_keys(slot); len(keys) > 1 || (len(keys) == 1 && keys[0] != "{m}:gone") {
+		t.Errorf("keys left behind: %v", keys)
+	}
+	if _, ok := src_store.get("other"); ok == false {
+		t.Error("key of another slot was moved")
+	}
+	after, ok := dst_store.get("{m}:7")
+	if ok == false || string(after.value) != "second" || after.version != before.version || after.timestamp != before.timestamp {
+		t.Errorf("moved key is %+v, was %+v", after, before)
+	}
+	for _, key := range counters {
+		if val, ok := dst_store.get(key); ok == false || string(val.value) != "500" {
+			t.Errorf("%s = %q after 500 increments", key, val.value)
+		}
+	}
+	if val, ok := dst_store.get("{m}:asked"); ok == false || string(val.value) != "asked" {
+		t.Errorf("write on the target lost by the migration, %q", val.value)
+	}
+
+	moved_reply := "MOVED " + strconv.Itoa(slot) + " " + target + "\r\n"
+	if r := src.route(src_store, []string{"{m}:7"}, false); r != moved_reply {
+		t.Errorf("old owner routes to %q", r)
+	}
+	if r := dst.route(dst_store, []string{"{m}:7"}, false); r != "" || len(dst.importing) != 0 {
+		t.Errorf("new owner routes to %q", r)
+	}
+	if _, err := src.migrate(src_store, slot, target); err == nil {
+		t.Error("slot which is not owned was migrated")
+	}
+}
+
+/*
+TestClusterRetract() checks that a key deleted on the source after it was copied takes back the copy on the target,
+but not a value a client wrote there since
+*/
+func TestClusterRetract(t *testing.T) {
+
+	src, dst := new_store(4), new_store(4)
+	c := new_cluster_state("dst", []string{"dst"})
+	copied := make(map[string]mapval)
+	import_one := func(record []byte) {
+		t.Helper()
+		if _, err := c.import_records(dst, encode_import([][]byte{record})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src.set("retract", 0, []byte("x"))
+	copy, _ := src.export_entry("retract", copied)
+	import_one(copy)
+	src.delete("retract")
+	retract, _ := src.export_entry("retract", copied)
+	if retract == nil {
+		t.Fatal("no record for a copied key deleted on the source")
+	}
+	import_one(retract)
+	if _, ok := dst.get("retract"); ok {
+		t.Error("copy of a deleted key kept on the target")
+	}
+
+	import_one(copy)
+	dst.set("retract", 0, []byte("client"))
+	import_one(retract)
+	if val, ok := dst.get("retract"); ok == false || string(val.value) != "client" {
+		t.Errorf("client write on the target = %q after the delete record", val.value)
+	}
+
+	if record, _ := src.export_entry("never", copied); record != nil {
+		t.Error("record sent for a key which was never copied")
+	}
+}
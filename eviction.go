@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The store can be given a memory limit. Every entry is accounted as the length of its key and value plus a fixed
+overhead for the map entry, mapval, access statistics and heap node, and when a write would take the store over the
+limit, keys are evicted first according to the configured policy:
+
+	noeviction    writes fail with ERR_OOM
+	allkeys-lru   evict the least recently used key
+	allkeys-lfu   evict the least frequently used key
+	volatile-ttl  evict the key which expires soonest, as found at the top of the shards' expiry heaps
+
+Like Redis, LRU and LFU are approximated by sampling a few keys from every shard and evicting the best candidate
+among them, which avoids keeping a global ordered list that every get would have to lock.
+*/
+
+const (
+	policy_noeviction   = "noeviction"
+	policy_allkeys_lru  = "allkeys-lru"
+	policy_allkeys_lfu  = "allkeys-lfu"
+	policy_volatile_ttl = "volatile-ttl"
+)
+
+const (
+	entry_overhead   = 128
+	eviction_samples = 5
+	lfu_init_val     = 5
+	lfu_log_factor   = 10
+	lfu_decay_time   = 60 // seconds for the LFU counter to lose one unit
+)
+
+var errOutOfMemory = errors.New("ERR_OOM")
+
+/*
+entry_stats is shared by every copy of a mapval, so that get can record accesses while only holding the read lock
+*/
+type entry_stats struct {
+	last_access int64 // unix nanoseconds
+	lfu_counter int32
+	lfu_decayed int64 // unix seconds of the last decay of lfu_counter
+}
+
+func valid_policy(policy string) bool {
+	switch policy {
+	case policy_noeviction, policy_allkeys_lru, policy_allkeys_lfu, policy_volatile_ttl:
+		return true
+	}
+	return false
+}
+
+func entry_size(key string, val mapval) int64 {
+	return int64(len(key) + len(val.value) + entry_overhead)
+}
+
+func new_stats(now time.Time) *entry_stats {
+	return &entry_stats{
+		last_access: now.UnixNano(),
+		lfu_counter: lfu_init_val,
+		lfu_decayed: now.Unix(),
+	}
+}
+
+/*
+touch() records an access at now: the LRU clock is moved forward and the LFU counter, after decaying it for the time
+since its last access, is incremented with a probability that falls as it grows, so that it behaves like a logarithm
+of the access count
+*/
+func (st *entry_stats) touch(now time.Time) {
+
+	atomic.StoreInt64(&st.last_access, now.UnixNano())
+
+	counter := st.lfu(now.Unix())
+	if counter < 255 {
+		base := counter - lfu_init_val
+		if base < 0 {
+			base = 0
+		}
+		if rand.Float64() < 1.0/float64(base*lfu_log_factor+1) {
+			atomic.CompareAndSwapInt32(&st.lfu_counter, counter, counter+1)
+		}
+	}
+}
+
+/*
+lfu() returns the LFU counter after applying the decay due at now
+*/
+func (st *entry_stats) lfu(now int64) int32 {
+
+	decayed := atomic.LoadInt64(&st.lfu_decayed)
+	counter := atomic.LoadInt32(&st.lfu_counter)
+	periods := (now - decayed) / lfu_decay_time
+	if periods <= 0 {
+		return counter
+	}
+
+	next := counter - int32(periods)
+	if next < 0 || periods > 255 {
+		next = 0
+	}
+	if atomic.CompareAndSwapInt64(&st.lfu_decayed, decayed, decayed+periods*lfu_decay_time) {
+		atomic.CompareAndSwapInt32(&st.lfu_counter, counter, next)
+	}
+	return next
+}
+
+/*
+memory_used() returns the number of bytes accounted to the entries of the store
+*/
+func (s *store) memory_used() int64 {
+
+	var used int64
+	for _, sh := range s.shards {
+		used += atomic.LoadInt64(&sh.used)
+	}
+	return used
+}
+
+/*
+make_room() evicts keys until size more bytes fit under the memory limit. It must be called without any shard lock
+held, as it locks the shards it evicts from.
+*/
+func (s *store) make_room(size int64) error {
+
+	if s.max_memory <= 0 {
+		return nil
+	}
+
+	for s.memory_used()+size > s.max_memory {
+		if s.policy == policy_noeviction || size > s.max_memory {
+			return errOutOfMemory
+		}
+		if !s.evict_one() {
+			return errOutOfMemory
+		}
+	}
+	return nil
+}
+
+/*
+room() returns errOutOfMemory if storing val in place of the current entry of key would take the store over its memory
+limit. Only the growth is charged, so overwriting a key with a value of the same size always fits. It is called with
+the shard locked, right before the entry is stored, so two writes to the key can't both take the last free bytes.
+*/
+func (sh *shard) room(key string, val mapval) error {
+
+	if sh.s == nil || sh.s.max_memory <= 0 {
+		return nil
+	}
+	grow := entry_size(key, val)
+	if old, ok := sh.memmap[key]; ok {
+		grow -= entry_size(key, old)
+	}
+	if grow > 0 && sh.s.memory_used()+grow > sh.s.max_memory {
+		return errOutOfMemory
+	}
+	return nil
+}
+
+/*
+write() runs fn, a write of key, with the shard of key locked. Keys can't be evicted while the lock is held, so when
+fn finds no room one key is evicted with the lock released and fn runs again.
+*/
+func (s *store) write(key string, fn func(sh *shard) error) error {
+
+	sh := s.shard_for(key)
+	for {
+		sh.mutex.Lock()
+		err := fn(sh)
+		sh.mutex.Unlock()
+		if err != errOutOfMemory || s.policy == policy_noeviction || s.evict_one() == false {
+			return err
+		}
+	}
+}
+
+type eviction_candidate struct {
+	sh    *shard
+	key   string
+	stats *entry_stats
+	score int64
+}
+
+/*
+evict_one() removes the best key to evict according to the policy. It returns false if there is no key the policy
+allows to evict.
+*/
+func (s *store) evict_one() bool {
+
+	var best *eviction_candidate
+	now := time.Now()
+	offset := rand.Intn(len(s.shards))
+
+	for i := range s.shards {
+		sh := s.shards[(offset+i)%len(s.shards)]
+		sh.mutex.RLock()
+		if s.policy == policy_volatile_ttl {
+			best = sh.soonest_expiring(best)
+		} else {
+			best = sh.sample(best, s.policy, now)
+		}
+		sh.mutex.RUnlock()
+	}
+
+	if best == nil {
+		return false
+	}
+
+	/*
+		The key may have been overwritten between sampling and now, in which case some other key will be picked by the
+		next round
+	*/
+	best.sh.mutex.Lock()
+	defer best.sh.mutex.Unlock()
+	if val, ok := best.sh.memmap[best.key]; ok && val.stats == best.stats {
+		if err := aof_log_delete(best.key); err != nil {
+			fmt.Printf("INT_ERR: Writing aof: %s\n", err)
+			return false
+		}
+		best.sh.remove(best.key)
+		record_change("evicted", best.key, val)
+	}
+	return true
+}
+
+/*
+sample() looks at a few keys of the shard, relying on the random start of map iteration, and returns whichever of
+them and best is the better candidate. Lower scores are evicted first. The caller must hold the read lock.
+*/
+func (sh *shard) sample(best *eviction_candidate, policy string, now time.Time) *eviction_candidate {
+
+	n := 0
+	for key, val := range sh.memmap {
+		if n == eviction_samples {
+			break
+		}
+		n++
+
+		var score int64
+		if policy == policy_allkeys_lfu {
+			score = int64(val.stats.lfu(now.Unix()))<<40 | (atomic.LoadInt64(&val.stats.last_access)/int64(time.Second))&(1<<40-1)
+		} else {
+			score = atomic.LoadInt64(&val.stats.last_access)
+		}
+		if best == nil || score < best.score {
+			best = &eviction_candidate{sh, key, val.stats, score}
+		}
+	}
+	return best
+}
+
+/*
+soonest_expiring() returns whichever of the shard's earliest expiring key and best expires first. The caller must hold
+the read lock.
+*/
+func (sh *shard) soonest_expiring(best *eviction_candidate) *eviction_candidate {
+
+	if sh.exp_heap.Len() == 0 {
+		return best
+	}
+	item := sh.exp_heap[0]
+	if best == nil || item.priority < best.score {
+		best = &eviction_candidate{sh, item.value, sh.memmap[item.value].stats, item.priority}
+	}
+	return best
+}
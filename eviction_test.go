@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func new_limited_store(policy string, keys int) *store {
+
+	s := new_store(4)
+	s.policy = policy
+	s.max_memory = int64(keys) * (int64(len("evictkey00")+len("mayur")) + entry_overhead)
+	return s
+}
+
+/*
+TestMemoryAccounting() checks that the accounted memory follows sets, overwrites, deletes and expiry exactly
+*/
+func TestMemoryAccounting(t *testing.T) {
+
+	s := new_store(4)
+	s.set("acctkey1", 0, []byte("mayur"))
+	s.set("acctkey2", time.Second, []byte("kale"))
+	s.set("acctkey1", 0, []byte("mayurkale"))
+
+	want := int64(len("acctkey1")+len("mayurkale")+entry_overhead) + int64(len("acctkey2")+len("kale")+entry_overhead)
+	if used := s.memory_used(); used != want {
+		t.Errorf("memory used = %d, want %d", used, want)
+	}
+
+	s.delete("acctkey1")
+	for _, sh := range s.shards {
+		sh.expire(time.Now().Add(2 * time.Second).UnixNano())
+	}
+	if used := s.memory_used(); used != 0 {
+		t.Errorf("memory used = %d after removing every key", used)
+	}
+}
+
+/*
+TestNoEviction() checks that writes fail with ERR_OOM once the limit is reached and that no key is lost, while
+overwrites which don't grow the store still succeed
+*/
+func TestNoEviction(t *testing.T) {
+
+	s := new_limited_store(policy_noeviction, 10)
+	for i := 0; i < 10; i++ {
+		if _, err := s.set("evictkey"+strconv.Itoa(10+i), 0, []byte("mayur")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.set("evictkey99", 0, []byte("mayur")); err != errOutOfMemory {
+		t.Errorf("set over the limit returned %v", err)
+	}
+	if _, err := s.set("evictkey10", 0, []byte("kale!")); err != nil {
+		t.Errorf("overwrite of the same size at the limit returned %v", err)
+	}
+	if _, err := s.append_value("evictkey11", []byte("x"), false); err != errOutOfMemory {
+		t.Errorf("append at the limit returned %v", err)
+	}
+	if used := s.memory_used(); used != s.max_memory {
+		t.Errorf("memory used = %d, limit %d", used, s.max_memory)
+	}
+	if error_message(errOutOfMemory) != "ERR_OOM\r\n" {
+		t.Errorf("reply for out of memory is %q", error_message(errOutOfMemory))
+	}
+}
+
+/*
+TestLruEviction() keeps reading half of the keys and checks that the keys evicted to make room come from the other half
+*/
+func TestLruEviction(t *testing.T) {
+
+	s := new_limited_store(policy_allkeys_lru, 20)
+	for i := 0; i < 20; i++ {
+		s.set("evictkey"+strconv.Itoa(10+i), 0, []byte("mayur"))
+	}
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 10; i++ {
+		s.get("evictkey" + strconv.Itoa(10+i))
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := s.set("evictkey"+strconv.Itoa(50+i), 0, []byte("mayur")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if used := s.memory_used(); used > s.max_memory {
+		t.Errorf("memory used %d is over the limit %d", used, s.max_memory)
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := s.get("evictkey" + strconv.Itoa(10+i)); !ok {
+			t.Errorf("recently used key evictkey%d was evicted", 10+i)
+		}
+	}
+}
+
+/*
+TestLfuEviction() reads one key many times and checks it outlives keys that were never read
+*/
+func TestLfuEviction(t *testing.T) {
+
+	s := new_limited_store(policy_allkeys_lfu, 10)
+	for i := 0; i < 10; i++ {
+		s.set("evictkey"+strconv.Itoa(10+i), 0, []byte("mayur"))
+	}
+	for i := 0; i < 1000; i++ {
+		s.get("evictkey10")
+	}
+
+	for i := 0; i < 9; i++ {
+		s.set("evictkey"+strconv.Itoa(50+i), 0, []byte("mayur"))
+	}
+	if _, ok := s.get("evictkey10"); !ok {
+		t.Error("frequently used key was evicted")
+	}
+}
+
+/*
+TestVolatileTtlEviction() checks that the key expiring soonest is evicted first, that keys without expiry are never
+evicted and that a write fails when only such keys are left
+*/
+func TestVolatileTtlEviction(t *testing.T) {
+
+	s := new_limited_store(policy_volatile_ttl, 3)
+	s.set("evictkey10", 100*time.Second, []byte("mayur"))
+	s.set("evictkey11", 10*time.Second, []byte("mayur"))
+	s.set("evictkey12", 0, []byte("mayur"))
+
+	s.set("evictkey13", 0, []byte("mayur"))
+	if _, ok := s.get("evictkey11"); ok {
+		t.Error("soonest expiring key was not evicted")
+	}
+	if _, ok := s.get("evictkey10"); !ok {
+		t.Error("later expiring key was evicted")
+	}
+
+	s.set("evictkey14", 0, []byte("mayur"))
+	if _, err := s.set("evictkey15", 0, []byte("mayur")); err != errOutOfMemory {
+		t.Errorf("set with only persistent keys left returned %v", err)
+	}
+}
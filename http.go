@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+The HTTP gateway serves the same store as handleconnection for services that cannot open raw TCP connections.
+
+	GET    /v1/keys/{key}            replies {"key", "value", "value_base64", "version", "ttl", "ttl_ms"} with -1 for
+	                                 no expiry, or the raw value when the request accepts application/octet-stream.
+	                                 value is only there if the value is valid UTF-8, value_base64 always is
+	PUT    /v1/keys/{key}?ttl=<ttl>  stores the request body as the value and replies {"key", "version"}. ttl is
+	                                 given like the exptime of the text protocol, in seconds or with an ms suffix
+	DELETE /v1/keys/{key}            removes the key
+
+The ETag of a key is its version. PUT and DELETE with If-Match: <version> only succeed while the key still has that
+version, like cas. PUT with If-None-Match: * only creates the key and PUT with If-Match: * only overwrites it.
+
+Errors are replied as {"error": <the text protocol error>} with 404 for ERRNOTFOUND, 412 for ERR_VERSION, 409 for
+ERR_EXISTS and 507 for ERR_OOM.
+*/
+
+const (
+	http_keys_prefix = "/v1/keys/"
+	http_max_value   = 512 * 1024 * 1024
+)
+
+var errBadRequest = errors.New("ERRCMDERR")
+
+type http_value struct {
+	Key         string  `json:"key"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 []byte  `json:"value_base64"`
+	Version     int64   `json:"version"`
+	Ttl         int64   `json:"ttl"`
+	TtlMs       int64   `json:"ttl_ms"`
+}
+
+type http_stored struct {
+	Key     string `json:"key"`
+	Version int64  `json:"version"`
+}
+
+/*
+serve_http() handles every connection accepted on lis with the HTTP gateway
+*/
+func serve_http(lis net.Listener) {
+
+	error := http.Serve(lis, http.HandlerFunc(handle_http))
+	if error != nil && !errors.Is(error, net.ErrClosed) {
+		fmt.Printf("INT_ERR: Serving http: %s\n", error)
+	}
+}
+
+/*
+handle_http() routes one request to the handler for its method
+*/
+func handle_http(w http.ResponseWriter, r *http.Request) {
+
+	key := strings.TrimPrefix(r.URL.Path, http_keys_prefix)
+	if key == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	if valid_key(key) == false {
+		write_http_error(w, errBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		http_get(w, r, key)
+	case http.MethodPut:
+		http_put(w, r, key)
+	case http.MethodDelete:
+		http_delete(w, r, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func http_get(w http.ResponseWriter, r *http.Request, key string) {
+
+	val, ok := kv.get(key)
+	if ok == false {
+		write_http_error(w, errNotFound)
+		return
+	}
+
+	ttl_ms := resp_ttl(val)
+	ttl := ttl_ms
+	if ttl > 0 {
+		ttl = (ttl + 999) / 1000
+	}
+	w.Header().Set("ETag", http_etag(val.version))
+
+	if strings.Contains(r.Header.Get("Accept"), "application/octet-stream") {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(val.value)))
+		w.Write(val.value)
+		return
+	}
+	/*
+		JSON strings are unicode, so a value which isn't valid UTF-8 would come back changed and is only given as base64
+	*/
+	reply := http_value{Key: key, ValueBase64: val.value, Version: val.version, Ttl: ttl, TtlMs: ttl_ms}
+	if utf8.Valid(val.value) {
+		text := string(val.value)
+		reply.Value = &text
+	}
+	write_http_json(w, http.StatusOK, reply)
+}
+
+func http_put(w http.ResponseWriter, r *http.Request, key string) {
+
+	var expirytime time.Duration
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		var ok bool
+		if expirytime, ok = parse_expiry(ttl); !ok {
+			write_http_error(w, errBadRequest)
+			return
+		}
+	}
+
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, http_max_value))
+	if err != nil {
+		write_http_error(w, errBadRequest)
+		return
+	}
+
+	if_match := r.Header.Get("If-Match")
+	if_none_match := r.Header.Get("If-None-Match")
+
+	var version int64
+	switch {
+	case if_match == "*":
+		version, err = kv.replace(key, expirytime, value)
+	case if_match != "":
+		expected, ok := parse_http_etag(if_match)
+		if !ok {
+			write_http_error(w, errBadRequest)
+			return
+		}
+		version, err = kv.cas(key, expirytime, expected, value)
+	case if_none_match == "*":
+		version, err = kv.add(key, expirytime, value)
+	case if_none_match != "":
+		write_http_error(w, errBadRequest)
+		return
+	default:
+		version, err = kv.set(key, expirytime, value)
+	}
+	if err != nil {
+		write_http_error(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", http_etag(version))
+	write_http_json(w, http.StatusOK, http_stored{Key: key, Version: version})
+}
+
+func http_delete(w http.ResponseWriter, r *http.Request, key string) {
+
+	version := int64(-1)
+	if if_match := r.Header.Get("If-Match"); if_match != "" && if_match != "*" {
+		expected, ok := parse_http_etag(if_match)
+		if !ok {
+			write_http_error(w, errBadRequest)
+			return
+		}
+		version = expected
+	}
+
+	if err := kv.delete_if(key, version); err != nil {
+		write_http_error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+http_etag() returns the strong entity tag for version
+*/
+func http_etag(version int64) string {
+	return "\"" + strconv.FormatInt(version, 10) + "\""
+}
+
+/*
+parse_http_etag() parses the version out of an If-Match header, quoted or not
+*/
+func parse_http_etag(header string) (int64, bool) {
+
+	tag := strings.TrimSpace(header)
+	if len(tag) >= 2 && tag[0] == '"' && tag[len(tag)-1] == '"' {
+		tag = tag[1 : len(tag)-1]
+	}
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version < 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+func write_http_json(w http.ResponseWriter, status int, body interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+/*
+write_http_error() replies with the status code and text protocol error for an error returned by a store operation
+*/
+func write_http_error(w http.ResponseWriter, err error) {
+
+	status := http.StatusInternalServerError
+	switch err {
+	case errBadRequest:
+		status = http.StatusBadRequest
+	case errNotFound:
+		status = http.StatusNotFound
+	case errVersion:
+		status = http.StatusPreconditionFailed
+	case errExists:
+		status = http.StatusConflict
+	case errOutOfMemory:
+		status = http.StatusInsufficientStorage
+	case errReadOnly:
+		status = http.StatusMisdirectedRequest
+	case errNotReplicated:
+		status = http.StatusNotImplemented
+	}
+	message := err.Error()
+	if err == errReadOnly {
+		message += " " + replica_of
+	}
+	if status == http.StatusInternalServerError {
+		message = strings.TrimSpace(error_message(err))
+	}
+	write_http_json(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func dial_http(t *testing.T) string {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go serve_http(lis)
+	return "http://" + lis.Addr().String() + http_keys_prefix
+}
+
+func http_do(t *testing.T, method string, url string, body string, headers ...string) (*http.Response, string) {
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+/*
+TestHttpGateway() walks a key through put, get, conditional put and delete and checks the status codes and ETags
+*/
+func TestHttpGateway(t *testing.T) {
+
+	base := dial_http(t)
+	kv.delete("httpkey")
+
+	resp, _ := http_do(t, "GET", base+"httpkey", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get of missing key = %d", resp.StatusCode)
+	}
+
+	resp, body := http_do(t, "PUT", base+"httpkey?ttl=100", "mayur\r\nkale", "If-None-Match", "*")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"0"` {
+		t.Fatalf("put = %d %s %q", resp.StatusCode, resp.Header.Get("ETag"), body)
+	}
+	resp, _ = http_do(t, "PUT", base+"httpkey", "x", "If-None-Match", "*")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("create of existing key = %d", resp.StatusCode)
+	}
+
+	resp, body = http_do(t, "GET", base+"httpkey", "")
+	var got http_value
+	json.Unmarshal([]byte(body), &got)
+	if resp.StatusCode != http.StatusOK || got.Value == nil || *got.Value != "mayur\r\nkale" || string(got.ValueBase64) != "mayur\r\nkale" || got.Version != 0 || got.Ttl != 100 || resp.Header.Get("ETag") != `"0"` {
+		t.Errorf("get = %d %q", resp.StatusCode, body)
+	}
+	_, body = http_do(t, "GET", base+"httpkey", "", "Accept", "application/octet-stream")
+	if body != "mayur\r\nkale" {
+		t.Errorf("raw get = %q", body)
+	}
+
+	resp, body = http_do(t, "PUT", base+"httpkey", "kale", "If-Match", `"5"`)
+	if resp.StatusCode != http.StatusPreconditionFailed || !strings.Contains(body, "ERR_VERSION") {
+		t.Errorf("put with stale version = %d %q", resp.StatusCode, body)
+	}
+	resp, _ = http_do(t, "PUT", base+"httpkey", "kale", "If-Match", `"0"`)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"1"` {
+		t.Errorf("put with version = %d %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if val, _ := kv.get("httpkey"); string(val.value) != "kale" || val.expirytime != 0 {
+		t.Errorf("store has %+v after put", val)
+	}
+
+	resp, _ = http_do(t, "PUT", base+"httpkey?ttl=abc", "kale")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("put with bad ttl = %d", resp.StatusCode)
+	}
+
+	resp, _ = http_do(t, "DELETE", base+"httpkey", "", "If-Match", "0")
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("delete with stale version = %d", resp.StatusCode)
+	}
+	resp, _ = http_do(t, "DELETE", base+"httpkey", "", "If-Match", "1")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete = %d", resp.StatusCode)
+	}
+	resp, _ = http_do(t, "DELETE", base+"httpkey", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("delete of missing key = %d", resp.StatusCode)
+	}
+	resp, _ = http_do(t, "PUT", base+"httpkey", "kale", "If-Match", "1")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("put with version on missing key = %d", resp.StatusCode)
+	}
+}
+
+/*
+TestHttpBinaryValue() checks that a value which isn't valid UTF-8 comes back unchanged as value_base64, and without a
+mangled value
+*/
+func TestHttpBinaryValue(t *testing.T) {
+
+	base := dial_http(t)
+	value := "\xff\xfe\x00mayur\x80"
+	resp, body := http_do(t, "PUT", base+"httpbinary", value)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("put = %d %q", resp.StatusCode, body)
+	}
+	defer kv.delete("httpbinary")
+
+	resp, body = http_do(t, "GET", base+"httpbinary", "")
+	var got http_value
+	if err := json.Unmarshal([]byte(body), &got); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("get = %d %q, %v", resp.StatusCode, body, err)
+	}
+	if string(got.ValueBase64) != value || got.Value != nil {
+		t.Errorf("get = %q", body)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Every shard keeps its keys in a skip list next to memmap, so that keys can be listed in lexical order. The skip list is
+modified together with memmap in store_entry() and remove(), under the shard's write lock, and read under its read
+lock.
+*/
+
+const (
+	skiplist_max_level = 32
+	skiplist_p         = 4 // a node reaches the next level with probability 1/skiplist_p
+)
+
+type skipnode struct {
+	key  string
+	next []*skipnode
+}
+
+type skiplist struct {
+	head  skipnode
+	level int
+	size  int
+}
+
+func new_skiplist() *skiplist {
+	return &skiplist{head: skipnode{next: make([]*skipnode, skiplist_max_level)}, level: 1}
+}
+
+/*
+find() returns, for every level, the last node whose key is less than key
+*/
+func (sl *skiplist) find(key string, update []*skipnode) {
+
+	node := &sl.head
+	for level := sl.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+		update[level] = node
+	}
+}
+
+/*
+insert() adds key unless it is already there
+*/
+func (sl *skiplist) insert(key string) {
+
+	var update [skiplist_max_level]*skipnode
+	sl.find(key, update[:])
+	if next := update[0].next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := 1
+	for level < skiplist_max_level && rand.Intn(skiplist_p) == 0 {
+		level++
+	}
+	for ; sl.level < level; sl.level++ {
+		update[sl.level] = &sl.head
+	}
+
+	node := &skipnode{key: key, next: make([]*skipnode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	sl.size++
+}
+
+/*
+delete() removes key if it is there
+*/
+func (sl *skiplist) delete(key string) {
+
+	var update [skiplist_max_level]*skipnode
+	sl.find(key, update[:])
+	node := update[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.size--
+}
+
+/*
+seek() returns the first node whose key is not less than key, or nil. The following keys are reached through
+next[0].
+*/
+func (sl *skiplist) seek(key string) *skipnode {
+
+	var update [skiplist_max_level]*skipnode
+	sl.find(key, update[:])
+	return update[0].next[0]
+}
+
+/*
+scan_cursor() is one step of an incremental scan of the whole key space. The cursor names a shard and the key in it
+the step starts at, "0" starts a new scan and is returned once the scan is complete. A step looks at about count keys
+and only holds the lock of one shard at a time while doing so. Because every shard is walked in key order, a key which
+exists from the start to the end of the scan is returned exactly once; keys written or deleted during the scan may or
+may not be. Only keys matching the glob pattern match are returned, and expired keys never are. All keys are strings,
+so a type other than "string" matches nothing. ok is false if the cursor is not valid.
+*/
+func (s *store) scan_cursor(cursor string, match string, count int, type_name string) (keys []string, next string, ok bool) {
+
+	shard, start, ok := parse_scan_cursor(cursor, len(s.shards))
+	if ok == false {
+		return nil, "", false
+	}
+	now := time.Now().UnixNano()
+
+	for examined := 0; shard < len(s.shards) && examined < count; {
+		sh := s.shards[shard]
+		sh.mutex.RLock()
+		node := sh.index.seek(start)
+		for ; node != nil && examined < count; node = node.next[0] {
+			examined++
+			val := sh.memmap[node.key]
+			if !is_expired(val, now) && (type_name == "" || type_name == "string") && (match == "" || glob_match(match, node.key)) {
+				keys = append(keys, node.key)
+			}
+		}
+		if node != nil {
+			start = node.key
+		}
+		sh.mutex.RUnlock()
+
+		if node == nil {
+			shard++
+			start = ""
+		}
+	}
+
+	if shard == len(s.shards) {
+		return keys, "0", true
+	}
+	return keys, strconv.Itoa(shard) + ":" + hex.EncodeToString([]byte(start)), true
+}
+
+/*
+parse_scan_cursor() splits a cursor made by scan_cursor() into the shard and the hex encoded key it names
+*/
+func parse_scan_cursor(cursor string, shards int) (shard int, key string, ok bool) {
+
+	if cursor == "0" {
+		return 0, "", true
+	}
+	index, encoded, found := strings.Cut(cursor, ":")
+	shard, err := strconv.Atoi(index)
+	if found == false || err != nil || shard < 0 || shard >= shards {
+		return 0, "", false
+	}
+	raw, err := hex.DecodeString(encoded)
+	if err != nil {
+		return 0, "", false
+	}
+	return shard, string(raw), true
+}
+
+/*
+glob_match() reports whether s matches the glob pattern, with the syntax of Redis: * matches any run of bytes, ? any
+single byte, [abc], [a-z] and [^abc] a byte from, or not from, a set and \ escapes the next byte. Only the last * is
+ever retried, one byte further each time, so the match takes at most len(pattern)*len(s) steps whatever the pattern.
+*/
+func glob_match(pattern string, s string) bool {
+
+	p, i := 0, 0
+	star, retry := -1, 0 // pattern position after the last * and the byte of s it was last tried from
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			p++
+			star, retry = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if width, ok := glob_byte(pattern[p:], s[i]); ok {
+				p += width
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		retry++
+		p, i = star, retry
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+/*
+glob_byte() reports whether c matches the first element of pattern, which is not a *, and returns its width
+*/
+func glob_byte(pattern string, c byte) (int, bool) {
+
+	switch pattern[0] {
+	case '?':
+		return 1, true
+
+	case '[':
+		end := 1
+		if end < len(pattern) && pattern[end] == '^' {
+			end++
+		}
+		if end < len(pattern) && pattern[end] == ']' {
+			end++
+		}
+		for end < len(pattern) && pattern[end] != ']' {
+			if pattern[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(pattern) {
+			return 0, false
+		}
+		return end + 1, class_match(pattern[1:end], c)
+
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
+
+/*
+class_match() reports whether c is in the character class, which is the text between the brackets
+*/
+func class_match(class string, c byte) bool {
+
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		lo := class[i]
+		if lo == '\\' && i+1 < len(class) {
+			i++
+			lo = class[i]
+		}
+		hi := lo
+		if i+2 < len(class) && class[i+1] == '-' {
+			hi = class[i+2]
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	return matched != negate
+}
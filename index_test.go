@@ -0,0 +1,205 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+TestSkiplist() applies random inserts and deletes to a skip list and a map and checks that walking the skip list gives
+the keys of the map in order
+*/
+func TestSkiplist(t *testing.T) {
+
+	sl := new_skiplist()
+	keys := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		key := "key" + strconv.Itoa(rand.Intn(1000))
+		if rand.Intn(3) == 0 {
+			sl.delete(key)
+			delete(keys, key)
+		} else {
+			sl.insert(key)
+			keys[key] = true
+		}
+	}
+
+	var want []string
+	for key := range keys {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+
+	var got []string
+	for node := sl.seek(""); node != nil; node = node.next[0] {
+		got = append(got, node.key)
+	}
+	if len(got) != len(want) || sl.size != len(want) {
+		t.Fatalf("skip list has %d keys (size %d), want %d", len(got), sl.size, len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("key %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	if node := sl.seek(want[10] + "\x00"); node == nil || node.key != want[11] {
+		t.Errorf("seek after %q did not find %q", want[10], want[11])
+	}
+}
+
+/*
+TestStoreScan() lists keys of a sharded store by range and by prefix, following the cursor from page to page, and
+checks that deleted and expired keys are left out
+*/
+func TestStoreScan(t *testing.T) {
+
+	s := new_store(4)
+	for i := 0; i < 50; i++ {
+		s.set("user:"+strconv.Itoa(100+i), 0, []byte("mayur"))
+		s.set("item:"+strconv.Itoa(100+i), 0, []byte("kale"))
+	}
+	s.delete("user:105")
+	s.set("user:106", time.Nanosecond, []byte("gone"))
+	time.Sleep(time.Millisecond)
+
+	var got []string
+	cursor := ""
+	for pages := 0; pages == 0 || cursor != ""; pages++ {
+		var entries []scan_entry
+		entries, cursor = s.scan(cursor, "", "user:", 7)
+		if len(entries) > 7 || pages > 10 {
+			t.Fatalf("page %d has %d keys", pages, len(entries))
+		}
+		for _, entry := range entries {
+			got = append(got, entry.key)
+		}
+	}
+	if len(got) != 48 || got[0] != "user:100" || got[5] != "user:107" || got[47] != "user:149" {
+		t.Errorf("prefix scan returned %d keys: %v", len(got), got)
+	}
+
+	entries, cursor := s.scan("item:120", "item:125", "", 100)
+	if len(entries) != 5 || entries[0].key != "item:120" || entries[4].key != "item:124" || cursor != "" {
+		t.Errorf("range scan returned %d keys, cursor %q", len(entries), cursor)
+	}
+}
+
+/*
+TestGlobMatch() checks the glob syntax accepted by the match option of scan
+*/
+func TestGlobMatch(t *testing.T) {
+
+	cases := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:42", true},
+		{"user:*", "item:42", false},
+		{"*:42", "user:42", true},
+		{"u?er", "user", true},
+		{"u?er", "uer", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"key[0-9]", "key7", true},
+		{"key[0-9]", "keyx", false},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"[abc", "a", false},
+		{"*[abc", "xa", false},
+		{"a*", "a", true},
+		{"*?", "", false},
+		{"*a\\", "xa\\", true},
+		{"**b", "aab", true},
+	}
+	for _, c := range cases {
+		if got := glob_match(c.pattern, c.s); got != c.want {
+			t.Errorf("glob_match(%q, %q) = %v", c.pattern, c.s, got)
+		}
+	}
+
+	/*
+		A pattern with many stars against a long key which almost matches must not backtrack exponentially
+	*/
+	start := time.Now()
+	if glob_match("*a*a*a*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 200)) {
+		t.Error("pathological pattern matched")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("pathological pattern took %v", elapsed)
+	}
+}
+
+/*
+TestScanCursor() runs cursor scans while other keys are written and deleted, and checks that every key which exists for
+the whole scan is returned exactly once and that expired keys are skipped
+*/
+func TestScanCursor(t *testing.T) {
+
+	s := new_store(4)
+	for i := 0; i < 500; i++ {
+		s.set("stay:"+strconv.Itoa(i), 0, []byte("mayur"))
+	}
+	s.set("gone:0", time.Nanosecond, []byte("kale"))
+	time.Sleep(time.Millisecond)
+
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				done <- true
+				return
+			default:
+			}
+			s.set("churn:"+strconv.Itoa(i%300), 0, []byte("x"))
+			s.delete("churn:" + strconv.Itoa((i+150)%300))
+		}
+	}()
+
+	seen := make(map[string]int)
+	cursor := "0"
+	for steps := 0; steps == 0 || cursor != "0"; steps++ {
+		var keys []string
+		var ok bool
+		keys, cursor, ok = s.scan_cursor(cursor, "", 10, "")
+		if !ok || steps > 1000 {
+			t.Fatalf("step %d failed, cursor %q", steps, cursor)
+		}
+		for _, key := range keys {
+			seen[key]++
+		}
+	}
+	stop <- true
+	<-done
+
+	for i := 0; i < 500; i++ {
+		if n := seen["stay:"+strconv.Itoa(i)]; n != 1 {
+			t.Errorf("stay:%d returned %d times", i, n)
+		}
+	}
+	if seen["gone:0"] != 0 {
+		t.Error("expired key was returned")
+	}
+
+	keys, cursor, _ := s.scan_cursor("0", "stay:1?", 10000, "")
+	if len(keys) != 10 || cursor != "0" {
+		t.Errorf("match returned %d keys, cursor %q", len(keys), cursor)
+	}
+	if keys, _, _ := s.scan_cursor("0", "", 10000, "hash"); len(keys) != 0 {
+		t.Errorf("type hash returned %d keys", len(keys))
+	}
+	if _, _, ok := s.scan_cursor("9:00", "", 10, ""); ok {
+		t.Error("cursor of a shard which does not exist was accepted")
+	}
+}
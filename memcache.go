@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+The memcache listener serves the same store with the memcached binary protocol, so applications using memcached
+clients can be pointed at this server. The CAS unique of an item is its version plus one, as memcached reserves 0 for
+"no CAS"; flags are stored with the item and returned unchanged.
+
+Supported opcodes are get, getk, set, add, replace, delete, increment, decrement, append, prepend, touch, gat, noop,
+version, quit and the quiet variants of all of them. Quiet commands only reply on errors (and quiet gets only on a
+hit); noop flushes every pending reply.
+*/
+
+const (
+	mc_magic_request  = 0x80
+	mc_magic_response = 0x81
+	mc_header_size    = 24
+	mc_max_key        = 250
+	mc_max_body       = 1 << 20
+	mc_version        = "1.6.0-kvstore"
+
+	/*
+		Expiration times larger than 30 days are absolute unix times, as in memcached
+	*/
+	mc_relative_expiry_max = 60 * 60 * 24 * 30
+)
+
+const (
+	mc_op_get        = 0x00
+	mc_op_set        = 0x01
+	mc_op_add        = 0x02
+	mc_op_replace    = 0x03
+	mc_op_delete     = 0x04
+	mc_op_increment  = 0x05
+	mc_op_decrement  = 0x06
+	mc_op_quit       = 0x07
+	mc_op_getq       = 0x09
+	mc_op_noop       = 0x0a
+	mc_op_version    = 0x0b
+	mc_op_getk       = 0x0c
+	mc_op_getkq      = 0x0d
+	mc_op_append     = 0x0e
+	mc_op_prepend    = 0x0f
+	mc_op_setq       = 0x11
+	mc_op_addq       = 0x12
+	mc_op_replaceq   = 0x13
+	mc_op_deleteq    = 0x14
+	mc_op_incrementq = 0x15
+	mc_op_decrementq = 0x16
+	mc_op_quitq      = 0x17
+	mc_op_appendq    = 0x19
+	mc_op_prependq   = 0x1a
+	mc_op_touch      = 0x1c
+	mc_op_gat        = 0x1d
+	mc_op_gatq       = 0x1e
+)
+
+const (
+	mc_status_ok              = 0x00
+	mc_status_key_not_found   = 0x01
+	mc_status_key_exists      = 0x02
+	mc_status_too_large       = 0x03
+	mc_status_invalid_args    = 0x04
+	mc_status_not_stored      = 0x05
+	mc_status_non_numeric     = 0x06
+	mc_status_unknown_command = 0x81
+	mc_status_out_of_memory   = 0x82
+	mc_status_internal_error  = 0x84
+)
+
+var (
+	errNotStored  = errors.New("memcache: not stored")
+	errNonNumeric = errors.New("memcache: value is not a number")
+)
+
+type mc_request struct {
+	opcode byte
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+type mc_conn struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+/*
+serve_memcache() handles every connection accepted on lis with the memcached binary protocol
+*/
+func serve_memcache(lis net.Listener) {
+
+	for {
+		con, error := lis.Accept()
+		if errors.Is(error, net.ErrClosed) {
+			return
+		}
+		if error != nil {
+			fmt.Printf("INT_ERR: Accepting memcache data: %s\n", error)
+			continue
+		}
+		go handle_memcache_connection(con)
+	}
+}
+
+func handle_memcache_connection(con net.Conn) {
+
+	defer con.Close()
+	c := &mc_conn{
+		reader: bufio.NewReader(con),
+		writer: bufio.NewWriter(con),
+	}
+
+	for {
+		req, status, err := c.read_request()
+		if err != nil {
+			return
+		}
+
+		quit := false
+		if status != mc_status_ok {
+			c.write_response(req, status, nil, nil, nil, 0)
+		} else {
+			quit = c.execute(req)
+		}
+
+		if quit || c.reader.Buffered() == 0 {
+			if err := c.writer.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+/*
+read_request() reads one request packet. A packet which can be framed but not served, such as one with an oversized
+body, is consumed and reported through status so that the connection stays in sync.
+*/
+func (c *mc_conn) read_request() (*mc_request, int, error) {
+
+	var header [mc_header_size]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return nil, 0, err
+	}
+	if header[0] != mc_magic_request {
+		return nil, 0, errors.New("memcache: bad magic")
+	}
+
+	key_len := int(binary.BigEndian.Uint16(header[2:4]))
+	extras_len := int(header[4])
+	body_len := int(binary.BigEndian.Uint32(header[8:12]))
+	req := &mc_request{
+		opcode: header[1],
+		opaque: binary.BigEndian.Uint32(header[12:16]),
+		cas:    binary.BigEndian.Uint64(header[16:24]),
+	}
+
+	if key_len+extras_len > body_len {
+		return nil, 0, errors.New("memcache: bad body length")
+	}
+	if body_len > mc_max_body+mc_max_key+32 {
+		if _, err := io.CopyN(io.Discard, c.reader, int64(body_len)); err != nil {
+			return nil, 0, err
+		}
+		return req, mc_status_too_large, nil
+	}
+
+	body := make([]byte, body_len)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return nil, 0, err
+	}
+	req.extras = body[:extras_len]
+	req.key = body[extras_len : extras_len+key_len]
+	req.value = body[extras_len+key_len:]
+
+	if key_len > mc_max_key || (key_len > 0 && valid_key(string(req.key)) == false) {
+		return req, mc_status_invalid_args, nil
+	}
+	return req, mc_status_ok, nil
+}
+
+/*
+write_response() writes a response packet for req. Error statuses carry their description as the value, like
+memcached does.
+*/
+func (c *mc_conn) write_response(req *mc_request, status int, extras []byte, key []byte, value []byte, cas uint64) {
+
+	if status != mc_status_ok && value == nil {
+		value = []byte(mc_status_text(status))
+	}
+
+	var header [mc_header_size]byte
+	header[0] = mc_magic_response
+	header[1] = req.opcode
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(key)))
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(header[6:8], uint16(status))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(header[12:16], req.opaque)
+	binary.BigEndian.PutUint64(header[16:24], cas)
+
+	c.writer.Write(header[:])
+	c.writer.Write(extras)
+	c.writer.Write(key)
+	c.writer.Write(value)
+}
+
+func mc_status_text(status int) string {
+
+	switch status {
+	case mc_status_key_not_found:
+		return "Not found"
+	case mc_status_key_exists:
+		return "Data exists for key."
+	case mc_status_too_large:
+		return "Too large."
+	case mc_status_invalid_args:
+		return "Invalid arguments"
+	case mc_status_not_stored:
+		return "Not stored."
+	case mc_status_non_numeric:
+		return "Non-numeric server-side value for incr or decr"
+	case mc_status_unknown_command:
+		return "Unknown command"
+	case mc_status_out_of_memory:
+		return "Out of memory"
+	}
+	return "Internal error"
+}
+
+/*
+mc_status() maps an error returned by a store operation to a response status
+*/
+func mc_status(err error) int {
+
+	switch err {
+	case nil:
+		return mc_status_ok
+	case errNotFound:
+		return mc_status_key_not_found
+	case errVersion, errExists:
+		return mc_status_key_exists
+	case errNotStored, errReadOnly, errNotReplicated:
+		return mc_status_not_stored
+	case errNonNumeric:
+		return mc_status_non_numeric
+	case errOutOfMemory:
+		return mc_status_out_of_memory
+	}
+	fmt.Printf("INT_ERR: %s\n", err)
+	return mc_status_internal_error
+}
+
+/*
+mc_cas() converts a version to the CAS unique sent to clients, mc_version_of() converts it back
+*/
+func mc_cas(version int64) uint64 {
+	return uint64(version) + 1
+}
+
+func mc_version_of(cas uint64) int64 {
+	return int64(cas - 1)
+}
+
+/*
+mc_expiry() converts a memcached expiration time to the time to live the store works with. An absolute time which is
+already in the past gives a negative ttl, so the item is stored expired and is never visible.
+*/
+func mc_expiry(exptime uint32) time.Duration {
+
+	if exptime <= mc_relative_expiry_max {
+		return time.Duration(exptime) * time.Second
+	}
+	left := time.Until(time.Unix(int64(exptime), 0))
+	if left == 0 {
+		left = -1
+	}
+	return left
+}
+
+func is_quiet(opcode byte) bool {
+
+	switch opcode {
+	case mc_op_getq, mc_op_getkq, mc_op_setq, mc_op_addq, mc_op_replaceq, mc_op_deleteq, mc_op_incrementq,
+		mc_op_decrementq, mc_op_quitq, mc_op_appendq, mc_op_prependq, mc_op_gatq:
+		return true
+	}
+	return false
+}
+
+/*
+execute() runs one request and writes its response. It returns true when the connection should be closed.
+*/
+func (c *mc_conn) execute(req *mc_request) bool {
+
+	quiet := is_quiet(req.opcode)
+	key := string(req.key)
+
+	reply := func(status int, extras []byte, key []byte, value []byte, cas uint64) {
+		if quiet && status == mc_status_ok {
+			return
+		}
+		c.write_response(req, status, extras, key, value, cas)
+	}
+
+	switch req.opcode {
+
+	case mc_op_noop, mc_op_version:
+		if len(req.extras) != 0 || len(req.key) != 0 || len(req.value) != 0 {
+			reply(mc_status_invalid_args, nil, nil, nil, 0)
+			break
+		}
+		if req.opcode == mc_op_version {
+			reply(mc_status_ok, nil, nil, []byte(mc_version), 0)
+		} else {
+			reply(mc_status_ok, nil, nil, nil, 0)
+		}
+
+	case mc_op_quit, mc_op_quitq:
+		reply(mc_status_ok, nil, nil, nil, 0)
+		return true
+
+	case mc_op_get, mc_op_getq, mc_op_getk, mc_op_getkq, mc_op_gat, mc_op_gatq:
+		is_gat := req.opcode == mc_op_gat || req.opcode == mc_op_gatq
+		if len(req.key) == 0 || len(req.value) != 0 || (is_gat && len(req.extras) != 4) || (!is_gat && len(req.extras) != 0) {
+			reply(mc_status_invalid_args, nil, nil, nil, 0)
+			break
+		}
+
+		var val mapval
+		var err error
+		if is_gat {
+			val, err = mc_touch(key, binary.BigEndian.Uint32(req.extras))
+		} else if v, ok := kv.get(key); ok {
+			val = v
+		} else {
+			err = errNotFound
+		}
+
+		var resp_key []byte
+		if req.opcode == mc_op_getk || req.opcode == mc_op_getkq {
+			resp_key = req.key
+		}
+		if err != nil {
+			/*
+				quiet gets say nothing about a miss
+			*/
+			if err == errNotFound && (req.opcode == mc_op_getq || req.opcode == mc_op_getkq || req.opcode == mc_op_gatq) {
+				break
+			}
+			c.write_response(req, mc_status(err), nil, resp_key, nil, 0)
+			break
+		}
+		extras := binary.BigEndian.AppendUint32(nil, val.flags)
+		c.write_response(req, mc_status_ok, extras, resp_key, val.value, mc_cas(val.version))
+
+	case mc_op_set, mc_op_setq, mc_op_add, mc_op_addq, mc_op_replace, mc_op_replaceq:
+		if len(req.extras) != 8 || len(req.key) == 0 {
+			reply(mc_status_invalid_args, nil, nil, nil, 0)
+			break
+		}
+		if len(req.value) > mc_max_body {
+			reply(mc_status_too_large, nil, nil, nil, 0)
+			break
+		}
+		flags := binary.BigEndian.Uint32(req.extras[0:4])
+		expirytime := mc_expiry(binary.BigEndian.Uint32(req.extras[4:8]))
+
+		cond := cond_always
+		if req.opcode == mc_op_add || req.opcode == mc_op_addq {
+			cond = cond_absent
+		} else if req.opcode == mc_op_replace || req.opcode == mc_op_replaceq {
+			cond = cond_present
+		}
+
+		value := append([]byte(nil), req.value...)
+		val, err := kv.update(key, func(old *mapval) (mapval, error) {
+			if cond == cond_absent && old != nil {
+				return mapval{}, errExists
+			}
+			if (cond == cond_present || req.cas != 0) && old == nil {
+				return mapval{}, errNotFound
+			}
+			if req.cas != 0 && old.version != mc_version_of(req.cas) {
+				return mapval{}, errVersion
+			}
+			new_val := new_mapval(expirytime, value, time.Now())
+			new_val.flags = flags
+			return new_val, nil
+		})
+		if err != nil {
+			reply(mc_status(err), nil, nil, nil, 0)
+			break
+		}
+		reply(mc_status_ok, nil, nil, nil, mc_cas(val.version))
+
+	case mc_op_append, mc_op_appendq, mc_op_prepend, mc_op_prependq:
+		if len(req.extras) != 0 || len(req.key) == 0 {
+			reply(mc_status_invalid_args, nil, nil, nil, 0)
+			break
+		}
+		prepend := req.opcode == mc_op_prepend || req.opcode == mc_op_prependq
+		val, err := kv.update(key, func(old *mapval) (mapval, error) {
+			if old == nil {
+				return mapval{}, errNotStored
+			}
+			if req.cas != 0 && old.version != mc_version_of(req.cas) {
+				return mapval{}, errVersion
+			}
+			new_val := *old
+			if prepend {
+				new_val.value = concat(req.value, old.value)
+			} else {
+				new_val.value = concat(old.value, req.value)
+			}
+			return new_val, nil
+		})
+		if err != nil {
+			reply(mc_status(err), nil, nil, nil, 0)
+			break
+		}
+		reply(mc_status_ok, nil, nil, nil, mc_cas(val.version))
+
+	case mc_op_delete, mc_op_deleteq:
+		if len(req.extras) != 0 || len(req.key) == 0 || len(req.value) != 0 {
+			reply(mc_status_invalid_args, nil, nil, nil, 0)
+			break
+		}
+		version := int64(-1)
+		if req.cas != 0 {
+			version = mc_version_of(req.cas)
+		}
+		reply(mc_status(kv.delete_if(key, version)), nil, nil, nil, 0)
+
+	case mc_op_increment, mc_op_incrementq, mc_op_decrement, mc_op_decrementq:
+		if len(req.extras) != 20 || len(req.key) == 0 || len(req.value) != 0 {
+			reply(mc_status_invalid_args, nil, nil, nil, 0)
+			break
+		}
+		delta := binary.BigEndian.Uint64(req.extras[0:8])
+		initial := binary.BigEndian.Uint64(req.extras[8:16])
+		exptime := binary.BigEndian.Uint32(req.extras[16:20])
+		decrement := req.opcode == mc_op_decrement || req.opcode == mc_op_decrementq
+
+		var result uint64
+		val, err := kv.update(key, func(old *mapval) (mapval, error) {
+			if old == nil {
+				/*
+					An expiration of all ones means the counter must not be created
+				*/
+				if exptime == 0xffffffff {
+					return mapval{}, errNotFound
+				}
+				result = initial
+				return new_mapval(mc_expiry(exptime), []byte(strconv.FormatUint(result, 10)), time.Now()), nil
+			}
+			if req.cas != 0 && old.version != mc_version_of(req.cas) {
+				return mapval{}, errVersion
+			}
+
+			current, err := strconv.ParseUint(string(old.value), 10, 64)
+			if err != nil {
+				return mapval{}, errNonNumeric
+			}
+			if !decrement {
+				result = current + delta
+			} else if delta > current {
+				result = 0
+			} else {
+				result = current - delta
+			}
+			new_val := *old
+			new_val.value = []byte(strconv.FormatUint(result, 10))
+			return new_val, nil
+		})
+		if err != nil {
+			reply(mc_status(err), nil, nil, nil, 0)
+			break
+		}
+		reply(mc_status_ok, nil, nil, binary.BigEndian.AppendUint64(nil, result), mc_cas(val.version))
+
+	case mc_op_touch:
+		if len(req.extras) != 4 || len(req.key) == 0 || len(req.value) != 0 {
+			reply(mc_status_invalid_args, nil, nil, nil, 0)
+			break
+		}
+		val, err := mc_touch(key, binary.BigEndian.Uint32(req.extras))
+		if err != nil {
+			reply(mc_status(err), nil, nil, nil, 0)
+			break
+		}
+		reply(mc_status_ok, nil, nil, nil, mc_cas(val.version))
+
+	default:
+		c.write_response(req, mc_status_unknown_command, nil, nil, nil, 0)
+	}
+
+	return false
+}
+
+/*
+mc_touch() gives key a new expiration time without changing its value
+*/
+func mc_touch(key string, exptime uint32) (mapval, error) {
+
+	return kv.touch(key, mc_expiry(exptime))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type mc_response struct {
+	opcode byte
+	status int
+	cas    uint64
+	extras []byte
+	key    string
+	value  string
+}
+
+/*
+mc_packet() encodes a binary protocol request
+*/
+func mc_packet(opcode byte, key string, extras []byte, value string, cas uint64) []byte {
+
+	packet := make([]byte, mc_header_size)
+	packet[0] = mc_magic_request
+	packet[1] = opcode
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(key)))
+	packet[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(packet[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(packet[12:16], 0xdeadbeef)
+	binary.BigEndian.PutUint64(packet[16:24], cas)
+	packet = append(packet, extras...)
+	packet = append(packet, key...)
+	return append(packet, value...)
+}
+
+func mc_read(t *testing.T, reader *bufio.Reader) mc_response {
+
+	header := make([]byte, mc_header_size)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != mc_magic_response || binary.BigEndian.Uint32(header[12:16]) != 0xdeadbeef {
+		t.Fatalf("bad response header %x", header)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	io.ReadFull(reader, body)
+	key_len := int(binary.BigEndian.Uint16(header[2:4]))
+	extras_len := int(header[4])
+	return mc_response{
+		opcode: header[1],
+		status: int(binary.BigEndian.Uint16(header[6:8])),
+		cas:    binary.BigEndian.Uint64(header[16:24]),
+		extras: body[:extras_len],
+		key:    string(body[extras_len : extras_len+key_len]),
+		value:  string(body[extras_len+key_len:]),
+	}
+}
+
+func mc_set_extras(flags uint32, exptime uint32) []byte {
+	return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, flags), exptime)
+}
+
+func mc_counter_extras(delta uint64, initial uint64, exptime uint32) []byte {
+	extras := binary.BigEndian.AppendUint64(nil, delta)
+	extras = binary.BigEndian.AppendUint64(extras, initial)
+	return binary.BigEndian.AppendUint32(extras, exptime)
+}
+
+func dial_memcache(t *testing.T) (net.Conn, *bufio.Reader) {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go serve_memcache(lis)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+/*
+TestMemcacheStorage() covers set, add, replace, cas, append, prepend, getk and delete
+*/
+func TestMemcacheStorage(t *testing.T) {
+
+	conn, reader := dial_memcache(t)
+	kv.delete("mckey")
+
+	conn.Write(mc_packet(mc_op_set, "mckey", mc_set_extras(42, 0), "mayur", 0))
+	resp := mc_read(t, reader)
+	if resp.status != mc_status_ok || resp.cas != 1 {
+		t.Fatalf("set = %+v", resp)
+	}
+
+	conn.Write(mc_packet(mc_op_getk, "mckey", nil, "", 0))
+	resp = mc_read(t, reader)
+	if resp.status != mc_status_ok || resp.key != "mckey" || resp.value != "mayur" || binary.BigEndian.Uint32(resp.extras) != 42 || resp.cas != 1 {
+		t.Fatalf("getk = %+v", resp)
+	}
+
+	conn.Write(mc_packet(mc_op_add, "mckey", mc_set_extras(0, 0), "x", 0))
+	if resp = mc_read(t, reader); resp.status != mc_status_key_exists {
+		t.Errorf("add of existing key = %+v", resp)
+	}
+	conn.Write(mc_packet(mc_op_replace, "mcmissing", mc_set_extras(0, 0), "x", 0))
+	if resp = mc_read(t, reader); resp.status != mc_status_key_not_found {
+		t.Errorf("replace of missing key = %+v", resp)
+	}
+
+	conn.Write(mc_packet(mc_op_set, "mckey", mc_set_extras(0, 0), "kale", 7))
+	if resp = mc_read(t, reader); resp.status != mc_status_key_exists {
+		t.Errorf("set with stale cas = %+v", resp)
+	}
+	conn.Write(mc_packet(mc_op_set, "mckey", mc_set_extras(0, 0), "kale", 1))
+	if resp = mc_read(t, reader); resp.status != mc_status_ok || resp.cas != 2 {
+		t.Errorf("set with cas = %+v", resp)
+	}
+
+	conn.Write(mc_packet(mc_op_append, "mckey", nil, "!", 0))
+	mc_read(t, reader)
+	conn.Write(mc_packet(mc_op_prepend, "mckey", nil, "mayur ", 0))
+	mc_read(t, reader)
+	if val, ok := kv.get("mckey"); !ok || string(val.value) != "mayur kale!" || val.version != 3 {
+		t.Errorf("after append and prepend the store has %+v", val)
+	}
+
+	/*
+		The text protocol sees the same key and version
+	*/
+	if _, err := kv.cas("mckey", 0, 3, []byte("text")); err != nil {
+		t.Errorf("cas with the version from memcache failed: %s", err)
+	}
+
+	conn.Write(mc_packet(mc_op_delete, "mckey", nil, "", 1))
+	if resp = mc_read(t, reader); resp.status != mc_status_key_exists {
+		t.Errorf("delete with stale cas = %+v", resp)
+	}
+	conn.Write(mc_packet(mc_op_delete, "mckey", nil, "", 0))
+	if resp = mc_read(t, reader); resp.status != mc_status_ok {
+		t.Errorf("delete = %+v", resp)
+	}
+	conn.Write(mc_packet(mc_op_get, "mckey", nil, "", 0))
+	if resp = mc_read(t, reader); resp.status != mc_status_key_not_found {
+		t.Errorf("get after delete = %+v", resp)
+	}
+
+	/*
+		Keys with spaces or control characters can't be written in the lines of changes and watchkeys
+	*/
+	conn.Write(mc_packet(mc_op_set, "mc key", mc_set_extras(0, 0), "x", 0))
+	if resp = mc_read(t, reader); resp.status != mc_status_invalid_args {
+		t.Errorf("set of a key with a space = %+v", resp)
+	}
+	if _, ok := kv.get("mc key"); ok {
+		t.Error("key with a space was stored")
+	}
+
+	/*
+		An absolute expiration time in the past stores the item expired, in the same update as its value
+	*/
+	past := uint32(time.Now().Add(-time.Hour).Unix())
+	conn.Write(mc_packet(mc_op_set, "mcpast", mc_set_extras(0, past), "x", 0))
+	if resp = mc_read(t, reader); resp.status != mc_status_ok {
+		t.Errorf("set with a past exptime = %+v", resp)
+	}
+	conn.Write(mc_packet(mc_op_get, "mcpast", nil, "", 0))
+	if resp = mc_read(t, reader); resp.status != mc_status_key_not_found {
+		t.Errorf("get after a set with a past exptime = %+v", resp)
+	}
+	kv.set("mcpast", 0, []byte("x"))
+	conn.Write(mc_packet(mc_op_touch, "mcpast", binary.BigEndian.AppendUint32(nil, past), "", 0))
+	if resp = mc_read(t, reader); resp.status != mc_status_ok {
+		t.Errorf("touch with a past exptime = %+v", resp)
+	}
+	if _, ok := kv.get("mcpast"); ok {
+		t.Error("key touched with a past exptime is visible")
+	}
+}
+
+/*
+TestMemcacheCounters() covers increment and decrement including creating the counter and non numeric values
+*/
+func TestMemcacheCounters(t *testing.T) {
+
+	conn, reader := dial_memcache(t)
+	kv.delete("mccounter")
+
+	conn.Write(mc_packet(mc_op_increment, "mccounter", mc_counter_extras(1, 0, 0xffffffff), "", 0))
+	if resp := mc_read(t, reader); resp.status != mc_status_key_not_found {
+		t.Errorf("increment of missing counter without create = %+v", resp)
+	}
+
+	conn.Write(mc_packet(mc_op_increment, "mccounter", mc_counter_extras(1, 10, 0), "", 0))
+	if resp := mc_read(t, reader); resp.status != mc_status_ok || binary.BigEndian.Uint64([]byte(resp.value)) != 10 {
+		t.Errorf("increment creating counter = %+v", resp)
+	}
+	conn.Write(mc_packet(mc_op_increment, "mccounter", mc_counter_extras(5, 0, 0), "", 0))
+	if resp := mc_read(t, reader); binary.BigEndian.Uint64([]byte(resp.value)) != 15 {
+		t.Errorf("increment = %+v", resp)
+	}
+	conn.Write(mc_packet(mc_op_decrement, "mccounter", mc_counter_extras(100, 0, 0), "", 0))
+	if resp := mc_read(t, reader); binary.BigEndian.Uint64([]byte(resp.value)) != 0 {
+		t.Errorf("decrement below zero = %+v", resp)
+	}
+
+	kv.set("mccounter", 0, []byte("abc"))
+	conn.Write(mc_packet(mc_op_increment, "mccounter", mc_counter_extras(1, 0, 0), "", 0))
+	if resp := mc_read(t, reader); resp.status != mc_status_non_numeric {
+		t.Errorf("increment of text = %+v", resp)
+	}
+}
+
+/*
+TestMemcacheQuiet() pipelines quiet commands ended by a noop and checks that only the hit, the error and the noop
+are answered
+*/
+func TestMemcacheQuiet(t *testing.T) {
+
+	conn, reader := dial_memcache(t)
+	kv.delete("mcquiet")
+	kv.delete("mcmissing")
+
+	var batch []byte
+	batch = append(batch, mc_packet(mc_op_setq, "mcquiet", mc_set_extras(0, 100), "mayur", 0)...)
+	batch = append(batch, mc_packet(mc_op_getkq, "mcmissing", nil, "", 0)...)
+	batch = append(batch, mc_packet(mc_op_getkq, "mcquiet", nil, "", 0)...)
+	batch = append(batch, mc_packet(mc_op_addq, "mcquiet", mc_set_extras(0, 0), "x", 0)...)
+	batch = append(batch, mc_packet(mc_op_touch, "mcquiet", binary.BigEndian.AppendUint32(nil, 0), "", 0)...)
+	batch = append(batch, mc_packet(mc_op_noop, "", nil, "", 0)...)
+	batch = append(batch, mc_packet(mc_op_version, "", nil, "", 0)...)
+	conn.Write(batch)
+
+	if resp := mc_read(t, reader); resp.opcode != mc_op_getkq || resp.key != "mcquiet" || resp.value != "mayur" {
+		t.Errorf("first reply = %+v", resp)
+	}
+	if resp := mc_read(t, reader); resp.opcode != mc_op_addq || resp.status != mc_status_key_exists {
+		t.Errorf("second reply = %+v", resp)
+	}
+	if resp := mc_read(t, reader); resp.opcode != mc_op_touch || resp.status != mc_status_ok {
+		t.Errorf("third reply = %+v", resp)
+	}
+	if resp := mc_read(t, reader); resp.opcode != mc_op_noop {
+		t.Errorf("fourth reply = %+v", resp)
+	}
+	if resp := mc_read(t, reader); resp.opcode != mc_op_version || resp.value != mc_version {
+		t.Errorf("fifth reply = %+v", resp)
+	}
+	if val, _ := kv.get("mcquiet"); val.expirytime != 0 {
+		t.Errorf("touch left expirytime %d", val.expirytime)
+	}
+}
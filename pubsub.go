@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Publish/subscribe of the text protocol. A connection which subscribes to a channel or pattern, or watches keys with
+watchkeys, is in push mode until it has no subscriptions left: messages published to its channels and events of its
+keys are pushed to it as they arrive and it can only send the commands which subscribe and unsubscribe.
+
+Events are emitted by the store whenever a key is written (set, and cas for a write by cas), deleted (delete), expired
+by the active expiry cycle or when read (expired) or evicted for memory (evicted), while the shard is still locked, so
+the events of a key arrive in the order of its versions.
+
+Publishers never write to a subscriber's connection. A message is appended to the subscriber's output buffer and
+written by the subscriber's own writer goroutine, so a subscriber which stops reading only fills its own buffer. When
+the buffer would grow over -pubsub-buffer-limit bytes the subscriber is disconnected and its messages are dropped.
+*/
+
+/*
+Output buffer limit of a subscriber in bytes, set with -pubsub-buffer-limit
+*/
+var pubsub_buffer_limit = 8 * 1024 * 1024
+
+/*
+Kinds of subscriptions
+*/
+const (
+	sub_channel = iota
+	sub_pattern
+	sub_key
+	sub_prefix // a watched prefix of keys, given as the prefix followed by *
+	sub_kinds
+)
+
+type subscriber struct {
+	con  net.Conn
+	subs [sub_kinds]map[string]bool // only used by the connection's goroutine, under hub.mutex
+
+	mutex    sync.Mutex
+	queue    [][]byte
+	queued   int  // bytes in queue
+	slow     bool // disconnected for going over the buffer limit
+	stopping bool
+	wake     chan bool
+	done     chan bool
+}
+
+type pubsub_hub struct {
+	mutex    sync.RWMutex
+	subs     [sub_kinds]map[string]map[*subscriber]bool
+	watchers int64 // number of key and prefix subscriptions, read atomically so writes skip notify() without them
+}
+
+var hub = new_hub()
+
+func new_hub() *pubsub_hub {
+
+	h := &pubsub_hub{}
+	for kind := range h.subs {
+		h.subs[kind] = make(map[string]map[*subscriber]bool)
+	}
+	return h
+}
+
+/*
+new_subscriber() puts con in push mode. From now on everything written to con goes through push().
+*/
+func new_subscriber(con net.Conn) *subscriber {
+
+	sub := &subscriber{
+		con:  con,
+		wake: make(chan bool, 1),
+		done: make(chan bool),
+	}
+	for kind := range sub.subs {
+		sub.subs[kind] = make(map[string]bool)
+	}
+	go sub.write_loop()
+	return sub
+}
+
+/*
+push() queues msg for the subscriber without waiting for it to be written. It returns false, and disconnects the
+subscriber, if msg does not fit in the output buffer.
+*/
+func (sub *subscriber) push(msg []byte) bool {
+
+	sub.mutex.Lock()
+	if sub.slow == true {
+		sub.mutex.Unlock()
+		return false
+	}
+	if sub.queued+len(msg) > pubsub_buffer_limit {
+		sub.slow = true
+		sub.queue = nil
+		sub.queued = 0
+		sub.mutex.Unlock()
+		fmt.Printf("Disconnecting slow subscriber %s\n", sub.con.RemoteAddr())
+		sub.con.Close()
+		return false
+	}
+	sub.queue = append(sub.queue, msg)
+	sub.queued += len(msg)
+	sub.mutex.Unlock()
+
+	select {
+	case sub.wake <- true:
+	default:
+	}
+	return true
+}
+
+/*
+write_loop() writes the queued messages to the connection until stop() is called
+*/
+func (sub *subscriber) write_loop() {
+
+	writer := bufio.NewWriter(sub.con)
+	for {
+		<-sub.wake
+		sub.mutex.Lock()
+		queue, stopping := sub.queue, sub.stopping
+		sub.queue = nil
+		sub.queued = 0
+		sub.mutex.Unlock()
+
+		for _, msg := range queue {
+			writer.Write(msg)
+		}
+		if writer.Flush() != nil {
+			sub.con.Close()
+		}
+		if stopping {
+			close(sub.done)
+			return
+		}
+	}
+}
+
+/*
+stop() waits until everything queued has been written and ends push mode
+*/
+func (sub *subscriber) stop() {
+
+	sub.mutex.Lock()
+	sub.stopping = true
+	sub.mutex.Unlock()
+	select {
+	case sub.wake <- true:
+	default:
+	}
+	<-sub.done
+}
+
+func (sub *subscriber) count() int {
+
+	n := 0
+	for _, own := range sub.subs {
+		n += len(own)
+	}
+	return n
+}
+
+/*
+subscribe() adds sub to the channel, pattern, key or prefix name. It returns false if sub was already there.
+*/
+func (h *pubsub_hub) subscribe(sub *subscriber, kind int, name string) bool {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	subs, own := h.subs[kind], sub.subs[kind]
+	if own[name] {
+		return false
+	}
+	own[name] = true
+	if subs[name] == nil {
+		subs[name] = make(map[*subscriber]bool)
+	}
+	subs[name][sub] = true
+	if kind == sub_key || kind == sub_prefix {
+		atomic.AddInt64(&h.watchers, 1)
+	}
+	return true
+}
+
+/*
+unsubscribe() removes sub from the channel, pattern, key or prefix name. It returns false if sub wasn't there.
+*/
+func (h *pubsub_hub) unsubscribe(sub *subscriber, kind int, name string) bool {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	subs, own := h.subs[kind], sub.subs[kind]
+	if own[name] == false {
+		return false
+	}
+	delete(own, name)
+	delete(subs[name], sub)
+	if len(subs[name]) == 0 {
+		delete(subs, name)
+	}
+	if kind == sub_key || kind == sub_prefix {
+		atomic.AddInt64(&h.watchers, -1)
+	}
+	return true
+}
+
+/*
+subscriptions() returns the names of the given kind sub is subscribed to in lexical order
+*/
+func (h *pubsub_hub) subscriptions(sub *subscriber, kind int) []string {
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	names := make([]string, 0, len(sub.subs[kind]))
+	for name := range sub.subs[kind] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+publish() pushes payload to every subscriber of channel and of a pattern matching it, and returns the number of
+subscribers it was queued for
+*/
+func (h *pubsub_hub) publish(channel string, payload []byte) int {
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	receivers := 0
+	if subs := h.subs[sub_channel][channel]; len(subs) > 0 {
+		msg := append([]byte("MESSAGE "+channel+" "+strconv.Itoa(len(payload))+"\r\n"), payload...)
+		msg = append(msg, "\r\n"...)
+		for sub := range subs {
+			if sub.push(msg) {
+				receivers++
+			}
+		}
+	}
+	for pattern, subs := range h.subs[sub_pattern] {
+		if !glob_match(pattern, channel) {
+			continue
+		}
+		msg := append([]byte("PMESSAGE "+pattern+" "+channel+" "+strconv.Itoa(len(payload))+"\r\n"), payload...)
+		msg = append(msg, "\r\n"...)
+		for sub := range subs {
+			if sub.push(msg) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+/*
+notify() pushes an event of key, whose version is now version, to every subscriber watching the key or a prefix of
+it. It is called by the store with the shard locked.
+*/
+func (h *pubsub_hub) notify(event string, key string, version int64) {
+
+	if atomic.LoadInt64(&h.watchers) == 0 {
+		return
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	msg := []byte("EVENT " + event + " " + key + " " + strconv.FormatInt(version, 10) + "\r\n")
+	for sub := range h.subs[sub_key][key] {
+		sub.push(msg)
+	}
+	for prefix, subs := range h.subs[sub_prefix] {
+		if strings.HasPrefix(key, prefix) {
+			for sub := range subs {
+				sub.push(msg)
+			}
+		}
+	}
+}
+
+/*
+subscription_kind() returns the kind of subscription name is for a command, and name without the * of a prefix
+*/
+func subscription_kind(command string, name string) (int, string) {
+
+	switch command {
+	case "psubscribe", "punsubscribe":
+		return sub_pattern, name
+	case "watchkeys", "unwatchkeys":
+		if strings.HasSuffix(name, "*") {
+			return sub_prefix, strings.TrimSuffix(name, "*")
+		}
+		return sub_key, name
+	}
+	return sub_channel, name
+}
+
+/*
+pubsub_command() runs subscribe, psubscribe, watchkeys and their unsubscribing commands for the connection con,
+whose subscriber is sub, or nil when it is not in push mode yet. It returns the subscriber, or nil once the
+connection has left push mode. Replies go through the subscriber so they stay in order with the messages pushed.
+*/
+func pubsub_command(con net.Conn, sub *subscriber, command string, names []string) *subscriber {
+
+	reply := strings.ToUpper(command) + "D "
+	if strings.HasSuffix(command, "watchkeys") {
+		reply = strings.ToUpper(strings.TrimSuffix(command, "keys")) + "ING "
+	}
+
+	switch command {
+	case "subscribe", "psubscribe", "watchkeys":
+		if sub == nil {
+			sub = new_subscriber(con)
+		}
+		for _, name := range names {
+			kind, target := subscription_kind(command, name)
+			hub.subscribe(sub, kind, target)
+			sub.push([]byte(reply + name + " " + strconv.Itoa(sub.count()) + "\r\n"))
+		}
+
+	case "unsubscribe", "punsubscribe", "unwatchkeys":
+		if len(names) == 0 {
+			kind, _ := subscription_kind(command, "")
+			names = hub.subscriptions(sub, kind)
+			if kind == sub_key {
+				for _, prefix := range hub.subscriptions(sub, sub_prefix) {
+					names = append(names, prefix+"*")
+				}
+			}
+		}
+		if len(names) == 0 {
+			sub.push([]byte(reply + "- " + strconv.Itoa(sub.count()) + "\r\n"))
+		}
+		for _, name := range names {
+			kind, target := subscription_kind(command, name)
+			hub.unsubscribe(sub, kind, target)
+			sub.push([]byte(reply + name + " " + strconv.Itoa(sub.count()) + "\r\n"))
+		}
+		if sub.count() == 0 {
+			sub.stop()
+			return nil
+		}
+	}
+	return sub
+}
+
+/*
+leave_pubsub() removes every subscription of sub when its connection ends
+*/
+func leave_pubsub(sub *subscriber) {
+
+	for kind := range sub.subs {
+		for _, name := range hub.subscriptions(sub, kind) {
+			hub.unsubscribe(sub, kind, name)
+		}
+	}
+	sub.stop()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+TestSlowSubscriber() publishes to a subscriber which never reads and checks that it is disconnected once its output
+buffer is full, without the publisher ever waiting for it
+*/
+func TestSlowSubscriber(t *testing.T) {
+
+	limit := pubsub_buffer_limit
+	pubsub_buffer_limit = 1024
+	defer func() { pubsub_buffer_limit = limit }()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	sub := new_subscriber(server)
+	hub.subscribe(sub, sub_channel, "slowchannel")
+
+	payload := []byte(strings.Repeat("x", 100))
+	start := time.Now()
+	delivered := 0
+	for i := 0; i < 100; i++ {
+		delivered += hub.publish("slowchannel", payload)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("publishing to a stalled subscriber took %s", time.Since(start))
+	}
+	if delivered == 0 || delivered > 11 {
+		t.Errorf("%d messages were queued for a subscriber with room for about 8", delivered)
+	}
+
+	/*
+		The subscriber was disconnected, so reading from the other end fails once the message being written is read
+	*/
+	reader := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, err := reader.ReadBytes('\n'); err != nil {
+			if strings.Contains(err.Error(), "timeout") {
+				t.Error("slow subscriber was not disconnected")
+			}
+			break
+		}
+	}
+	leave_pubsub(sub)
+	if len(hub.subs[sub_channel]["slowchannel"]) != 0 {
+		t.Error("subscriber was not removed from the channel")
+	}
+}
+
+/*
+TestKeyEvents() watches a key and a prefix and checks the events of writes, deletes, expiry and eviction
+*/
+func TestKeyEvents(t *testing.T) {
+
+	server, client := net.Pipe()
+	sub := new_subscriber(server)
+	hub.subscribe(sub, sub_key, "eventkey")
+	hub.subscribe(sub, sub_prefix, "eventprefix:")
+	defer leave_pubsub(sub)
+	defer client.Close()
+
+	s := new_store(2)
+
+	s.set("eventkey", 0, []byte("mayur"))
+	s.cas("eventkey", 0, 0, []byte("kale"))
+	s.incr("eventprefix:n", 1, true, 0, 0)
+	s.delete("eventkey")
+	s.set("othereventkey", 0, []byte("mayur"))
+	s.delete("othereventkey")
+	s.set("eventprefix:x", time.Millisecond, []byte("mayur"))
+	time.Sleep(2 * time.Millisecond)
+	for _, sh := range s.shards {
+		sh.expire(time.Now().UnixNano())
+	}
+	s.max_memory = 2 * (int64(len("eventprefix:0")+len("mayur")) + entry_overhead)
+	s.policy = policy_allkeys_lru
+	s.set("eventprefix:1", 0, []byte("mayur"))
+	s.set("eventprefix:2", 0, []byte("mayur"))
+
+	want := []string{
+		"EVENT set eventkey 0\r\n",
+		"EVENT cas eventkey 1\r\n",
+		"EVENT set eventprefix:n 0\r\n",
+		"EVENT delete eventkey 1\r\n",
+		"EVENT set eventprefix:x 0\r\n",
+		"EVENT expired eventprefix:x 0\r\n",
+		"EVENT set eventprefix:1 0\r\n",
+	}
+	reader := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	for i, line := range want {
+		data, err := reader.ReadBytes('\n')
+		if string(data) != line {
+			t.Fatalf("event %d = %q, %v, want %q", i, data, err, line)
+		}
+	}
+
+	/*
+		There is only room for two keys, so the last set evicts one of the other two
+	*/
+	data, _ := reader.ReadBytes('\n')
+	if string(data) != "EVENT evicted eventprefix:n 0\r\n" && string(data) != "EVENT evicted eventprefix:1 0\r\n" {
+		t.Errorf("event %q instead of an eviction", data)
+	}
+	if data, _ := reader.ReadBytes('\n'); string(data) != "EVENT set eventprefix:2 0\r\n" {
+		t.Errorf("event %q after the eviction", data)
+	}
+}
@@ -0,0 +1,991 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Raft replication of the store, for a cluster of servers which all hold the same keys and stay consistent when some of
+them fail. Writes are proposed by the leader as entries of the raft log and every node applies an entry to its store
+once a majority of the members has it, so a write acknowledged to a client survives as long as a majority does.
+
+The node below is driven from the outside: tick() is called every raft_tick, messages from other nodes are handed to
+step(), and messages to them go out through a raft_transport. The state it must not forget across a restart is kept in
+the raft log file of raft_log.go.
+
+Entries are applied the same way on every node, which needs some care:
+  - a write carries the time it was proposed at, and expiry times are absolute, so whether a key is live is decided
+    by the entry and not by the clock of the node applying it
+  - stores of a cluster don't expire keys on their own. The leader proposes an expire entry for every expired key it
+    finds, and reads just skip expired keys until it is applied.
+
+A read is linearizable with the read index of the Raft paper: the leader remembers its commit index, makes sure it is
+still the leader by a round of heartbeats acknowledged by a majority, and serves the read from its store once it has
+applied up to the remembered index.
+
+The log is compacted into a snapshot of the store every raft_snapshot_entries applied entries. A follower which needs
+entries the leader no longer has gets the snapshot instead.
+
+Membership changes add or remove one member at a time, which is safe without a joint configuration because any two
+majorities of the old and the new configuration overlap. A configuration takes effect on a node as soon as it is in
+its log, and the next change is only accepted once it is committed. A removed leader steps down once its removal is
+committed.
+*/
+
+const (
+	raft_follower = iota
+	raft_candidate
+	raft_leader
+)
+
+var raft_state_names = []string{"follower", "candidate", "leader"}
+
+const (
+	raft_tick            = 50 * time.Millisecond // interval of tick() on a server
+	raft_election_ticks  = 10                    // ticks without a leader before an election, randomized up to twice as many
+	raft_heartbeat_ticks = 1
+	raft_max_batch       = 512 // entries per append message
+	raft_timeout         = 5 * time.Second
+)
+
+/*
+Applied entries kept in the log before it is compacted into a snapshot
+*/
+var raft_snapshot_entries = 10000
+
+/*
+Kinds of log entries. A noop is appended by every new leader, so that it commits the entries of earlier terms.
+*/
+const (
+	entry_noop = iota
+	entry_command
+	entry_config // data is the members of the new configuration joined by ,
+)
+
+type raft_entry struct {
+	term uint64
+	kind byte
+	data []byte
+}
+
+/*
+Kinds of messages
+*/
+const (
+	msg_vote = iota
+	msg_vote_reply
+	msg_append
+	msg_append_reply
+	msg_snapshot // replied with msg_append_reply
+)
+
+/*
+raft_message is any message between nodes. index and log_term are the last entry of the candidate in a vote, the entry
+before entries in an append and the entry the follower matches (or a hint where to retry from when ok is false) in an
+append reply. read is the read index round of the leader when the message was sent, echoed by the reply.
+*/
+type raft_message struct {
+	kind     byte
+	from     string
+	to       string
+	term     uint64
+	index    uint64
+	log_term uint64
+	entries  []raft_entry
+	commit   uint64
+	ok       bool
+	read     uint64
+	snapshot *raft_snapshot
+}
+
+/*
+raft_snapshot is the store after the entry index of term was applied, and the members at that point
+*/
+type raft_snapshot struct {
+	index   uint64
+	term    uint64
+	members []string
+	entries []snapshot_entry
+}
+
+type raft_transport interface {
+	send(msg raft_message)
+}
+
+var (
+	errNotLeader     = errors.New("ERR_NOTLEADER")
+	errRaftBusy      = errors.New("ERR_BUSY")
+	errTimeout       = errors.New("ERR_TIMEOUT")
+	errNotReplicated = errors.New("ERR_NOTREPLICATED")
+)
+
+type raft_result struct {
+	version int64
+	err     error
+}
+
+/*
+raft_proposal is a write waiting for its entry to be applied. done receives its result, or errNotLeader if the entry
+was replaced by one of another leader.
+*/
+type raft_proposal struct {
+	term uint64
+	done chan raft_result
+}
+
+/*
+raft_read is a read waiting until the leader confirmed its leadership in round and applied up to index. index is 0
+until the leader has committed an entry of its term.
+*/
+type raft_read struct {
+	index uint64
+	round uint64
+	done  chan error
+}
+
+type raft_node struct {
+	mutex     sync.Mutex
+	id        string
+	s         *store
+	transport raft_transport
+
+	state     int
+	term      uint64
+	voted_for string
+	leader    string
+	members   []string // the latest configuration in the log
+	config    uint64   // index of the entry of members, 0 if it comes from the snapshot
+
+	snap    *raft_snapshot
+	log     []raft_entry // the entries after snap.index
+	commit  uint64
+	applied uint64
+
+	elapsed int // ticks since the last election or message of the leader
+	timeout int
+
+	votes      map[string]bool
+	next       map[string]uint64
+	match      map[string]uint64
+	acks       map[string]uint64 // latest read round acknowledged by every member
+	active     map[string]bool   // members the leader heard from since the last check_quorum()
+	checked    int               // ticks since the last check_quorum()
+	read_round uint64
+	reads      []*raft_read
+	waiting    map[uint64]*raft_proposal
+	expiring   map[string]bool // keys the leader proposed an expire entry for
+
+	storage    *aof_log // the raft log file, nil if the node keeps its state in memory only
+	saved_term uint64
+	saved_vote string
+	saved      uint64 // entries up to this index are in the file
+	rewrite    bool   // the snapshot changed since the file was written
+}
+
+/*
+new_raft_node() returns the node id replicating into s. members is the initial configuration, the same on every node
+starting the cluster, or empty for a node which waits to be added to a running cluster.
+*/
+func new_raft_node(id string, members []string, s *store, transport raft_transport) *raft_node {
+
+	s.log_expiry = true
+	n := &raft_node{
+		id:        id,
+		s:         s,
+		transport: transport,
+		snap:      &raft_snapshot{members: sorted_members(members)},
+		waiting:   make(map[uint64]*raft_proposal),
+		expiring:  make(map[string]bool),
+	}
+	n.members = n.snap.members
+	n.reset_timeout()
+	return n
+}
+
+func sorted_members(members []string) []string {
+
+	sorted := append([]string(nil), members...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func (n *raft_node) reset_timeout() {
+
+	n.elapsed = 0
+	n.timeout = raft_election_ticks + rand.Intn(raft_election_ticks)
+}
+
+func (n *raft_node) last_index() uint64 {
+	return n.snap.index + uint64(len(n.log))
+}
+
+/*
+term_at() returns the term of the entry at index, or 0 if the node doesn't have it
+*/
+func (n *raft_node) term_at(index uint64) uint64 {
+
+	if index == n.snap.index {
+		return n.snap.term
+	}
+	if index < n.snap.index || index > n.last_index() {
+		return 0
+	}
+	return n.log[index-n.snap.index-1].term
+}
+
+func (n *raft_node) is_member(id string) bool {
+
+	for _, m := range n.members {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+quorum() reports whether has() is true for a majority of the members
+*/
+func (n *raft_node) quorum(has func(m string) bool) bool {
+
+	count := 0
+	for _, m := range n.members {
+		if has(m) {
+			count++
+		}
+	}
+	return count > len(n.members)/2
+}
+
+func (n *raft_node) send(msg raft_message) {
+
+	n.persist()
+	msg.from = n.id
+	msg.term = n.term
+	n.transport.send(msg)
+}
+
+/*
+tick() advances the election and heartbeat timers by one tick
+*/
+func (n *raft_node) tick() {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.elapsed++
+	if n.state == raft_leader {
+		if n.elapsed >= raft_heartbeat_ticks {
+			n.elapsed = 0
+			n.broadcast()
+		}
+		n.check_quorum()
+		if n.state == raft_leader {
+			n.propose_expiry()
+		}
+		return
+	}
+	if n.elapsed >= n.timeout && n.is_member(n.id) {
+		n.campaign()
+	}
+}
+
+/*
+check_quorum() makes a leader which hasn't heard from a majority for an election timeout step down, so that clients
+of a leader cut off from the others are redirected instead of waiting for writes which can't commit
+*/
+func (n *raft_node) check_quorum() {
+
+	n.checked++
+	if n.checked < raft_election_ticks {
+		return
+	}
+	n.checked = 0
+	if n.quorum(func(m string) bool { return m == n.id || n.active[m] }) == false {
+		n.become_follower(n.term, "")
+	}
+	n.active = make(map[string]bool)
+}
+
+func (n *raft_node) campaign() {
+
+	n.state = raft_candidate
+	n.term++
+	n.voted_for = n.id
+	n.leader = ""
+	n.votes = map[string]bool{n.id: true}
+	n.reset_timeout()
+	if n.quorum(func(m string) bool { return n.votes[m] }) {
+		n.become_leader()
+		return
+	}
+	last := n.last_index()
+	for _, m := range n.members {
+		if m != n.id {
+			n.send(raft_message{kind: msg_vote, to: m, index: last, log_term: n.term_at(last)})
+		}
+	}
+}
+
+func (n *raft_node) become_follower(term uint64, leader string) {
+
+	if term > n.term {
+		n.term = term
+		n.voted_for = ""
+	}
+	n.state = raft_follower
+	n.leader = leader
+	for _, r := range n.reads {
+		r.done <- errNotLeader
+	}
+	n.reads = nil
+	n.expiring = make(map[string]bool)
+}
+
+func (n *raft_node) become_leader() {
+
+	n.state = raft_leader
+	n.leader = n.id
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.acks = make(map[string]uint64)
+	n.active = make(map[string]bool)
+	for _, m := range n.members {
+		n.next[m] = n.last_index() + 1
+	}
+	n.append(raft_entry{term: n.term, kind: entry_noop})
+	n.broadcast()
+	n.advance_commit()
+}
+
+/*
+append() adds e to the end of the log and returns its index
+*/
+func (n *raft_node) append(e raft_entry) uint64 {
+
+	n.log = append(n.log, e)
+	index := n.last_index()
+	if e.kind == entry_config {
+		n.members = decode_members(e.data)
+		n.config = index
+	}
+	return index
+}
+
+/*
+truncate() drops the entries from index on, which conflict with the log of the leader
+*/
+func (n *raft_node) truncate(index uint64) {
+
+	n.log = n.log[:index-n.snap.index-1]
+	if n.saved >= index {
+		n.saved = index - 1
+	}
+	for i, p := range n.waiting {
+		if i >= index {
+			p.done <- raft_result{err: errNotLeader}
+			delete(n.waiting, i)
+		}
+	}
+	n.members, n.config = n.snap.members, 0
+	for i, e := range n.log {
+		if e.kind == entry_config {
+			n.members, n.config = decode_members(e.data), n.snap.index+uint64(i)+1
+		}
+	}
+}
+
+func decode_members(data []byte) []string {
+
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(string(data), ",")
+}
+
+/*
+step() handles a message from another node
+*/
+func (n *raft_node) step(msg raft_message) {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	/*
+		A node which still hears from its leader ignores elections, so that a removed member, which no longer gets
+		heartbeats, can't disrupt the cluster by starting them
+	*/
+	if msg.kind == msg_vote && msg.term > n.term && n.leader != "" && n.elapsed < raft_election_ticks {
+		return
+	}
+
+	if msg.term > n.term {
+		leader := ""
+		if msg.kind == msg_append || msg.kind == msg_snapshot {
+			leader = msg.from
+		}
+		n.become_follower(msg.term, leader)
+	}
+	if msg.term < n.term {
+		switch msg.kind {
+		case msg_vote:
+			n.send(raft_message{kind: msg_vote_reply, to: msg.from})
+		case msg_append, msg_snapshot:
+			n.send(raft_message{kind: msg_append_reply, to: msg.from})
+		}
+		return
+	}
+
+	switch msg.kind {
+	case msg_vote:
+		last := n.last_index()
+		up_to_date := msg.log_term > n.term_at(last) || (msg.log_term == n.term_at(last) && msg.index >= last)
+		grant := (n.voted_for == "" || n.voted_for == msg.from) && up_to_date
+		if grant {
+			n.voted_for = msg.from
+			n.reset_timeout()
+		}
+		n.send(raft_message{kind: msg_vote_reply, to: msg.from, ok: grant})
+
+	case msg_vote_reply:
+		if n.state != raft_candidate {
+			return
+		}
+		n.votes[msg.from] = msg.ok
+		if n.quorum(func(m string) bool { return n.votes[m] }) {
+			n.become_leader()
+		}
+
+	case msg_append:
+		if n.state != raft_follower {
+			n.become_follower(n.term, msg.from)
+		}
+		n.leader = msg.from
+		n.reset_timeout()
+		n.handle_append(msg)
+
+	case msg_snapshot:
+		if n.state != raft_follower {
+			n.become_follower(n.term, msg.from)
+		}
+		n.leader = msg.from
+		n.reset_timeout()
+		if msg.snapshot.index > n.commit {
+			n.install(msg.snapshot)
+		}
+		n.send(raft_message{kind: msg_append_reply, to: msg.from, ok: true, index: msg.snapshot.index, read: msg.read})
+
+	case msg_append_reply:
+		if n.state != raft_leader {
+			return
+		}
+		n.active[msg.from] = true
+		if msg.read > n.acks[msg.from] {
+			n.acks[msg.from] = msg.read
+		}
+		if msg.ok {
+			if msg.index > n.match[msg.from] {
+				n.match[msg.from] = msg.index
+			}
+			if n.next[msg.from] <= n.match[msg.from] {
+				n.next[msg.from] = n.match[msg.from] + 1
+			}
+			n.advance_commit()
+			if n.next[msg.from] <= n.last_index() {
+				n.send_append(msg.from)
+			}
+		} else {
+			next := msg.index + 1
+			if next > n.next[msg.from] {
+				next = n.next[msg.from]
+			}
+			if next < 1 {
+				next = 1
+			}
+			n.next[msg.from] = next
+			n.send_append(msg.from)
+		}
+		n.check_reads()
+	}
+}
+
+func (n *raft_node) handle_append(msg raft_message) {
+
+	reply := raft_message{kind: msg_append_reply, to: msg.from, read: msg.read}
+
+	/*
+		Entries up to the snapshot are committed, so they match the leader's
+	*/
+	if msg.index < n.snap.index {
+		skip := n.snap.index - msg.index
+		if uint64(len(msg.entries)) <= skip {
+			msg.entries = nil
+		} else {
+			msg.entries = msg.entries[skip:]
+		}
+		msg.index, msg.log_term = n.snap.index, n.snap.term
+	}
+
+	if msg.index > n.last_index() || n.term_at(msg.index) != msg.log_term {
+		reply.index = msg.index - 1
+		if reply.index > n.last_index() {
+			reply.index = n.last_index()
+		}
+		n.send(reply)
+		return
+	}
+
+	for i, e := range msg.entries {
+		index := msg.index + uint64(i) + 1
+		if index <= n.last_index() {
+			if n.term_at(index) == e.term {
+				continue
+			}
+			n.truncate(index)
+		}
+		n.append(e)
+	}
+
+	last_new := msg.index + uint64(len(msg.entries))
+	if msg.commit > n.commit && last_new > n.commit {
+		n.commit = msg.commit
+		if n.commit > last_new {
+			n.commit = last_new
+		}
+		n.apply()
+	}
+	reply.ok = true
+	reply.index = last_new
+	n.send(reply)
+}
+
+/*
+broadcast() sends every other member the entries it doesn't have yet, or a heartbeat
+*/
+func (n *raft_node) broadcast() {
+
+	for _, m := range n.members {
+		if m != n.id {
+			n.send_append(m)
+		}
+	}
+}
+
+/*
+send_append() sends to the entries after the ones it was last sent, and optimistically expects it to accept them. If
+it doesn't, its reply tells where to start again.
+*/
+func (n *raft_node) send_append(to string) {
+
+	next, ok := n.next[to]
+	if ok == false {
+		next = n.last_index() + 1
+	}
+	if next <= n.snap.index {
+		n.send(raft_message{kind: msg_snapshot, to: to, snapshot: n.snap, read: n.read_round})
+		n.next[to] = n.snap.index + 1
+		return
+	}
+
+	prev := next - 1
+	entries := n.log[prev-n.snap.index:]
+	if len(entries) > raft_max_batch {
+		entries = entries[:raft_max_batch]
+	}
+	n.send(raft_message{kind: msg_append, to: to, index: prev, log_term: n.term_at(prev), entries: entries, commit: n.commit, read: n.read_round})
+	n.next[to] = next + uint64(len(entries))
+}
+
+/*
+advance_commit() commits the latest entry of the current term a majority has. Entries of earlier terms are committed
+with it, never by counting.
+*/
+func (n *raft_node) advance_commit() {
+
+	n.persist()
+	for index := n.last_index(); index > n.commit && n.term_at(index) == n.term; index-- {
+		has := func(m string) bool { return m == n.id || n.match[m] >= index }
+		if n.quorum(has) {
+			n.commit = index
+			n.apply()
+			n.broadcast()
+			return
+		}
+	}
+}
+
+/*
+apply() applies the committed entries to the store and hands the results to the proposals waiting for them
+*/
+func (n *raft_node) apply() {
+
+	for n.applied < n.commit {
+		n.applied++
+		e := n.log[n.applied-n.snap.index-1]
+
+		var result raft_result
+		if e.kind == entry_command {
+			cmd, err := decode_command(e.data)
+			if err != nil {
+				result.err = err
+			} else {
+				result.version, result.err = n.s.apply_command(cmd)
+				if cmd.op == raft_op_expire {
+					delete(n.expiring, cmd.key)
+				}
+			}
+		}
+		if p, ok := n.waiting[n.applied]; ok {
+			delete(n.waiting, n.applied)
+			if p.term != e.term {
+				result = raft_result{err: errNotLeader}
+			}
+			p.done <- result
+		}
+	}
+
+	if n.state == raft_leader && n.config <= n.commit && n.is_member(n.id) == false {
+		n.become_follower(n.term, "")
+	}
+	n.check_reads()
+	n.compact()
+}
+
+/*
+compact() replaces the applied entries by a snapshot of the store once there are raft_snapshot_entries of them
+*/
+func (n *raft_node) compact() {
+
+	if n.applied-n.snap.index < uint64(raft_snapshot_entries) {
+		return
+	}
+
+	members := n.snap.members
+	for _, e := range n.log[:n.applied-n.snap.index] {
+		if e.kind == entry_config {
+			members = decode_members(e.data)
+		}
+	}
+	snap := &raft_snapshot{index: n.applied, term: n.term_at(n.applied), members: members, entries: n.s.snapshot_entries()}
+	n.log = append([]raft_entry(nil), n.log[n.applied-n.snap.index:]...)
+	n.snap = snap
+	n.rewrite = true
+}
+
+/*
+install() replaces the store by the snapshot of the leader, keeping the entries after it if the log has them
+*/
+func (n *raft_node) install(snap *raft_snapshot) {
+
+	if snap.index < n.last_index() && n.term_at(snap.index) == snap.term {
+		n.log = append([]raft_entry(nil), n.log[snap.index-n.snap.index:]...)
+	} else {
+		n.log = nil
+	}
+	n.snap = snap
+	n.rewrite = true
+
+	fresh := new_store(len(n.s.shards))
+	for _, entry := range snap.entries {
+		fresh.shard_for(entry.key).store_entry(entry.key, entry.val)
+	}
+	n.s.replace_contents(fresh)
+	n.commit, n.applied = snap.index, snap.index
+
+	for i, p := range n.waiting {
+		if i <= snap.index {
+			p.done <- raft_result{err: errNotLeader}
+			delete(n.waiting, i)
+		}
+	}
+	n.members, n.config = snap.members, 0
+	for i, e := range n.log {
+		if e.kind == entry_config {
+			n.members, n.config = decode_members(e.data), snap.index+uint64(i)+1
+		}
+	}
+}
+
+/*
+propose() appends cmd to the log of the leader. The result arrives on the done channel of the proposal once the entry
+is applied.
+*/
+func (n *raft_node) propose(cmd raft_command) (*raft_proposal, error) {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.state != raft_leader {
+		return nil, errNotLeader
+	}
+	return n.propose_entry(raft_entry{term: n.term, kind: entry_command, data: encode_command(cmd)}), nil
+}
+
+func (n *raft_node) propose_entry(e raft_entry) *raft_proposal {
+
+	p := &raft_proposal{term: n.term, done: make(chan raft_result, 1)}
+	n.waiting[n.append(e)] = p
+	n.broadcast()
+	n.advance_commit()
+	return p
+}
+
+/*
+change_members() proposes to add or remove member. Only one change may be in progress at a time, and only once the
+leader has committed an entry of its term, otherwise it returns errRaftBusy.
+*/
+func (n *raft_node) change_members(member string, add bool) (*raft_proposal, error) {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.state != raft_leader {
+		return nil, errNotLeader
+	}
+	if n.config > n.commit || n.term_at(n.commit) != n.term {
+		return nil, errRaftBusy
+	}
+	if n.is_member(member) == add {
+		if add {
+			return nil, errExists
+		}
+		return nil, errNotFound
+	}
+
+	var members []string
+	for _, m := range n.members {
+		if m != member {
+			members = append(members, m)
+		}
+	}
+	if add {
+		members = sorted_members(append(members, member))
+	}
+	return n.propose_entry(raft_entry{term: n.term, kind: entry_config, data: []byte(strings.Join(members, ","))}), nil
+}
+
+/*
+read_index() starts a linearizable read. Once done receives nil the store can be read.
+*/
+func (n *raft_node) read_index() (*raft_read, error) {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.state != raft_leader {
+		return nil, errNotLeader
+	}
+	n.read_round++
+	r := &raft_read{round: n.read_round, done: make(chan error, 1)}
+	n.reads = append(n.reads, r)
+	n.broadcast()
+	n.check_reads()
+	return r, nil
+}
+
+func (n *raft_node) check_reads() {
+
+	if n.state != raft_leader {
+		return
+	}
+	committed := n.term_at(n.commit) == n.term
+	pending := n.reads[:0]
+	for _, r := range n.reads {
+		if r.index == 0 && committed {
+			r.index = n.commit
+		}
+		confirmed := n.quorum(func(m string) bool { return m == n.id || n.acks[m] >= r.round })
+		if r.index != 0 && confirmed && n.applied >= r.index {
+			r.done <- nil
+		} else {
+			pending = append(pending, r)
+		}
+	}
+	n.reads = pending
+}
+
+/*
+propose_expiry() proposes an expire entry for keys of the leader's store which have expired
+*/
+func (n *raft_node) propose_expiry() {
+
+	if n.term_at(n.commit) != n.term {
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, key := range n.s.expired_keys(now, expire_batch) {
+		if n.expiring[key] == false {
+			n.expiring[key] = true
+			n.append(raft_entry{term: n.term, kind: entry_command, data: encode_command(raft_command{op: raft_op_expire, now: now, key: key})})
+		}
+	}
+	n.advance_commit()
+}
+
+/*
+status() returns the state of the node, its term, the leader it knows of and the members
+*/
+func (n *raft_node) status() (state string, term uint64, leader string, members []string) {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return raft_state_names[n.state], n.term, n.leader, n.members
+}
+
+/*
+Operations of raft commands
+*/
+const (
+	raft_op_set = iota
+	raft_op_cas
+	raft_op_delete
+	raft_op_expire
+)
+
+/*
+raft_command is a write of the store. now is the time it was proposed, which decides whether keys are live. val holds
+the value of set and cas, with an absolute expiry time.
+*/
+type raft_command struct {
+	op      byte
+	cond    byte // condition of set, as for set_if()
+	now     int64
+	version int64 // the version cas expects
+	key     string
+	val     mapval
+}
+
+/*
+encode_command() encodes cmd as op(byte) cond(byte) now(int64) version(int64) followed by the aof set record of key
+*/
+func encode_command(cmd raft_command) []byte {
+
+	buf := []byte{cmd.op, cmd.cond}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(cmd.now))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(cmd.version))
+	return append(buf, encode_set_record(cmd.key, cmd.val)...)
+}
+
+func decode_command(data []byte) (raft_command, error) {
+
+	if len(data) < 18 {
+		return raft_command{}, errBadRecord
+	}
+	cmd := raft_command{op: data[0], cond: data[1]}
+	cmd.now = int64(binary.BigEndian.Uint64(data[2:]))
+	cmd.version = int64(binary.BigEndian.Uint64(data[10:]))
+	_, key, val, err := decode_record(data[18:])
+	if err != nil {
+		return raft_command{}, err
+	}
+	cmd.key, cmd.val = key, val
+	return cmd, nil
+}
+
+/*
+apply_command() applies cmd to the store and returns the version of the key it wrote
+*/
+func (s *store) apply_command(cmd raft_command) (int64, error) {
+
+	sh := s.shard_for(cmd.key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	old, ok := sh.memmap[cmd.key]
+	live := ok == true && !is_expired(old, cmd.now)
+
+	switch cmd.op {
+	case raft_op_set:
+		if cmd.cond == cond_absent && live {
+			return 0, errExists
+		}
+		if cmd.cond == cond_present && !live {
+			return 0, errNotFound
+		}
+		val := cmd.val
+		val.version = 0
+		if ok == true {
+			val.version = old.version + 1
+		}
+		sh.store_entry(cmd.key, val)
+		record_change("set", cmd.key, val)
+		return val.version, nil
+
+	case raft_op_cas:
+		if !live {
+			return 0, errNotFound
+		}
+		if old.version != cmd.version {
+			return 0, errVersion
+		}
+		val := cmd.val
+		val.version = old.version + 1
+		sh.store_entry(cmd.key, val)
+		record_change("cas", cmd.key, val)
+		return val.version, nil
+
+	case raft_op_delete:
+		if !live {
+			return 0, errNotFound
+		}
+		sh.remove(cmd.key)
+		record_change("delete", cmd.key, old)
+		return old.version, nil
+
+	case raft_op_expire:
+		if ok == true && is_expired(old, cmd.now) {
+			sh.remove(cmd.key)
+			record_change("expired", cmd.key, old)
+		}
+		return 0, nil
+	}
+	return 0, errBadRecord
+}
+
+/*
+snapshot_entries() returns every entry of the store, expired or not, as the state machine of a raft snapshot
+*/
+func (s *store) snapshot_entries() []snapshot_entry {
+
+	s.rlock_all()
+	defer s.runlock_all()
+
+	var entries []snapshot_entry
+	for _, sh := range s.shards {
+		for key, val := range sh.memmap {
+			val.stats = nil
+			entries = append(entries, snapshot_entry{key, val})
+		}
+	}
+	return entries
+}
+
+/*
+expired_keys() returns up to max keys which have expired at now. The expired nodes of a heap are a subtree at its top,
+so only they and their children are looked at.
+*/
+func (s *store) expired_keys(now int64, max int) []string {
+
+	var keys []string
+	for _, sh := range s.shards {
+		sh.mutex.RLock()
+		stack := []int{0}
+		for len(stack) > 0 && len(keys) < max {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if i >= len(sh.exp_heap) || sh.exp_heap[i].priority >= now {
+				continue
+			}
+			keys = append(keys, sh.exp_heap[i].value)
+			stack = append(stack, 2*i+1, 2*i+2)
+		}
+		sh.mutex.RUnlock()
+	}
+	return keys
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+/*
+The raft log file keeps what a node must not forget across a restart: its term, the member it voted for, its latest
+snapshot and the entries after it. A node which came back without them could vote twice in a term, or lose entries a
+majority was counted on for, so everything is synced to the file before the node sends a message or counts itself
+for a commit.
+
+The file is framed like the aof, and holds records of three kinds:
+
+	state:    op(1) term(uint64) voted_for
+	snapshot: op(2) the snapshot as in raft messages
+	entry:    op(3) index(uint64) term(uint64) kind(byte) data
+
+Records are replayed in order. An entry replaces the one at its index and drops the entries after it, which is how
+the log of a follower is truncated. When a snapshot is taken or installed the file is rewritten with the state, the
+snapshot and the entries after it.
+*/
+
+const (
+	raft_record_state    byte = 1
+	raft_record_snapshot byte = 2
+	raft_record_entry    byte = 3
+)
+
+/*
+open_log() loads the state of the node from the raft log file at path, if there is one, and writes everything it
+changes to it from then on
+*/
+func (n *raft_node) open_log(path string) error {
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	loaded, err := read_records(path, "raft log", func(payload []byte) error {
+		return n.load_record(payload)
+	})
+	if err != nil {
+		return err
+	}
+	if n.storage, err = open_aof(path, fsync_always); err != nil {
+		return err
+	}
+
+	if loaded > 0 {
+		fresh := new_store(len(n.s.shards))
+		for _, entry := range n.snap.entries {
+			fresh.shard_for(entry.key).store_entry(entry.key, entry.val)
+		}
+		n.s.replace_contents(fresh)
+		n.commit, n.applied = n.snap.index, n.snap.index
+		n.members, n.config = n.snap.members, 0
+		for i, e := range n.log {
+			if e.kind == entry_config {
+				n.members, n.config = decode_members(e.data), n.snap.index+uint64(i)+1
+			}
+		}
+	}
+
+	/*
+		A new file starts with the members of the node, so a restart doesn't depend on its flags
+	*/
+	n.rewrite = true
+	n.persist()
+	return nil
+}
+
+func (n *raft_node) load_record(payload []byte) error {
+
+	if len(payload) == 0 {
+		return errBadRecord
+	}
+	r := bytes.NewReader(payload[1:])
+	var err error
+	switch payload[0] {
+	case raft_record_state:
+		if n.term, err = read_uint64(r); err != nil {
+			return err
+		}
+		n.voted_for = string(payload[9:])
+
+	case raft_record_snapshot:
+		snap, err := decode_snapshot(r)
+		if err != nil || r.Len() != 0 {
+			return errBadRecord
+		}
+		n.snap, n.log = snap, nil
+
+	case raft_record_entry:
+		if len(payload) < 18 {
+			return errBadRecord
+		}
+		index := binary.BigEndian.Uint64(payload[1:])
+		e := raft_entry{term: binary.BigEndian.Uint64(payload[9:]), kind: payload[17], data: payload[18:]}
+		if index <= n.snap.index {
+			return nil
+		}
+		if index > n.last_index()+1 {
+			return errBadRecord
+		}
+		n.log = append(n.log[:index-n.snap.index-1], e)
+
+	default:
+		return errBadRecord
+	}
+	return nil
+}
+
+/*
+persist() writes the changes of the state and the log since it last ran to the raft log file, and syncs it. A node
+which can't keep its state must not go on, so it exits the server.
+*/
+func (n *raft_node) persist() {
+
+	if n.storage == nil {
+		return
+	}
+
+	var records [][]byte
+	if n.rewrite || n.term != n.saved_term || n.voted_for != n.saved_vote {
+		records = append(records, append(binary.BigEndian.AppendUint64([]byte{raft_record_state}, n.term), n.voted_for...))
+	}
+	from := n.saved + 1
+	if n.rewrite {
+		records = append(records, append_snapshot([]byte{raft_record_snapshot}, n.snap))
+		from = n.snap.index + 1
+	}
+	for index := from; index <= n.last_index(); index++ {
+		e := n.log[index-n.snap.index-1]
+		record := binary.BigEndian.AppendUint64([]byte{raft_record_entry}, index)
+		record = binary.BigEndian.AppendUint64(record, e.term)
+		records = append(records, append(append(record, e.kind), e.data...))
+	}
+
+	var err error
+	if n.rewrite {
+		err = n.storage.rewrite(records)
+	} else if len(records) > 0 {
+		err = n.storage.append_all(records)
+	}
+	if err != nil {
+		fmt.Printf("INT_ERR: Writing raft log: %s\n", err)
+		os.Exit(1)
+	}
+	n.rewrite = false
+	n.saved_term, n.saved_vote, n.saved = n.term, n.voted_for, n.last_index()
+}
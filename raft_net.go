@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The raft nodes of a cluster talk over the text protocol port. A message to another node is sent as
+
+	raftmsg <numbytes>\r\n<message bytes>\r\n
+
+on a connection the sending node keeps open to it, and is never replied to on that connection; the answer comes back
+as a message of its own. Nodes are named by the address of their text protocol listener, so the leader a node names
+in ERR_NOTLEADER is where clients should go.
+*/
+
+/*
+raft_cluster is the raft node of the server, nil unless it runs in cluster mode
+*/
+var raft_cluster *raft_node
+
+/*
+Messages waiting to be sent to a node. Raft copes with lost messages, so more are dropped.
+*/
+const raft_send_queue = 1024
+
+/*
+start_raft() makes the server the node id of a raft cluster with the given initial members, replicating kv. The node
+keeps its state in the raft log file at path, and comes back with the members and the store it had there.
+*/
+func start_raft(id string, members []string, path string) error {
+
+	n := new_raft_node(id, members, kv, &tcp_transport{peers: make(map[string]chan raft_message)})
+	if err := n.open_log(path); err != nil {
+		return err
+	}
+	raft_cluster = n
+	go func() {
+		for range time.Tick(raft_tick) {
+			raft_cluster.tick()
+		}
+	}()
+	return nil
+}
+
+type tcp_transport struct {
+	mutex sync.Mutex
+	peers map[string]chan raft_message
+}
+
+func (t *tcp_transport) send(msg raft_message) {
+
+	t.mutex.Lock()
+	queue, ok := t.peers[msg.to]
+	if ok == false {
+		queue = make(chan raft_message, raft_send_queue)
+		t.peers[msg.to] = queue
+		go send_loop(msg.to, queue)
+	}
+	t.mutex.Unlock()
+
+	select {
+	case queue <- msg:
+	default:
+	}
+}
+
+/*
+send_loop() writes the messages of queue to the node addr, connecting again whenever the connection fails
+*/
+func send_loop(addr string, queue chan raft_message) {
+
+	var con net.Conn
+	var writer *bufio.Writer
+	for msg := range queue {
+		if con == nil {
+			var err error
+			if con, err = net.DialTimeout("tcp", addr, raft_tick); err != nil {
+				con = nil
+				continue
+			}
+			writer = bufio.NewWriter(con)
+		}
+		payload := encode_raft_message(msg)
+		writer.WriteString("raftmsg " + strconv.Itoa(len(payload)) + "\r\n")
+		writer.Write(payload)
+		writer.WriteString("\r\n")
+		if len(queue) > 0 {
+			continue
+		}
+		if err := writer.Flush(); err != nil {
+			con.Close()
+			con = nil
+		}
+	}
+}
+
+/*
+encode_raft_message() encodes msg as kind(byte) from to term index log_term commit read ok(byte), the entries, and the
+snapshot if there is one. Numbers are uint64, strings and byte slices are prefixed with their length as a uvarint.
+*/
+func encode_raft_message(msg raft_message) []byte {
+
+	buf := []byte{msg.kind}
+	buf = append_bytes(buf, []byte(msg.from))
+	buf = append_bytes(buf, []byte(msg.to))
+	for _, u := range []uint64{msg.term, msg.index, msg.log_term, msg.commit, msg.read} {
+		buf = binary.BigEndian.AppendUint64(buf, u)
+	}
+	if msg.ok {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(msg.entries)))
+	for _, e := range msg.entries {
+		buf = binary.BigEndian.AppendUint64(buf, e.term)
+		buf = append(buf, e.kind)
+		buf = append_bytes(buf, e.data)
+	}
+
+	if msg.snapshot == nil {
+		return append(buf, 0)
+	}
+	return append_snapshot(append(buf, 1), msg.snapshot)
+}
+
+/*
+append_snapshot() appends snap as index term members and the aof set records of its entries
+*/
+func append_snapshot(buf []byte, snap *raft_snapshot) []byte {
+
+	buf = binary.BigEndian.AppendUint64(buf, snap.index)
+	buf = binary.BigEndian.AppendUint64(buf, snap.term)
+	buf = append_bytes(buf, []byte(strings.Join(snap.members, ",")))
+	buf = binary.AppendUvarint(buf, uint64(len(snap.entries)))
+	for _, entry := range snap.entries {
+		buf = append_bytes(buf, encode_set_record(entry.key, entry.val))
+	}
+	return buf
+}
+
+func append_bytes(buf []byte, b []byte) []byte {
+
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func read_bytes(r *bytes.Reader) ([]byte, error) {
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, errBadRecord
+	}
+	b := make([]byte, n)
+	io.ReadFull(r, b)
+	return b, nil
+}
+
+func read_uint64(r *bytes.Reader) (uint64, error) {
+
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, errBadRecord
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+func decode_raft_message(payload []byte) (raft_message, error) {
+
+	var msg raft_message
+	r := bytes.NewReader(payload)
+
+	var err error
+	if msg.kind, err = r.ReadByte(); err != nil {
+		return msg, errBadRecord
+	}
+	from, err := read_bytes(r)
+	if err != nil {
+		return msg, err
+	}
+	to, err := read_bytes(r)
+	if err != nil {
+		return msg, err
+	}
+	msg.from, msg.to = string(from), string(to)
+	for _, u := range []*uint64{&msg.term, &msg.index, &msg.log_term, &msg.commit, &msg.read} {
+		if *u, err = read_uint64(r); err != nil {
+			return msg, err
+		}
+	}
+	ok, err := r.ReadByte()
+	if err != nil {
+		return msg, errBadRecord
+	}
+	msg.ok = ok == 1
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(r.Len()) {
+		return msg, errBadRecord
+	}
+	for i := uint64(0); i < count; i++ {
+		var e raft_entry
+		if e.term, err = read_uint64(r); err != nil {
+			return msg, err
+		}
+		if e.kind, err = r.ReadByte(); err != nil {
+			return msg, errBadRecord
+		}
+		if e.data, err = read_bytes(r); err != nil {
+			return msg, err
+		}
+		msg.entries = append(msg.entries, e)
+	}
+
+	has_snapshot, err := r.ReadByte()
+	if err != nil {
+		return msg, errBadRecord
+	}
+	if has_snapshot == 1 {
+		if msg.snapshot, err = decode_snapshot(r); err != nil {
+			return msg, err
+		}
+	}
+
+	if r.Len() != 0 {
+		return msg, errBadRecord
+	}
+	return msg, nil
+}
+
+func decode_snapshot(r *bytes.Reader) (*raft_snapshot, error) {
+
+	var err error
+	snap := &raft_snapshot{}
+	if snap.index, err = read_uint64(r); err != nil {
+		return nil, err
+	}
+	if snap.term, err = read_uint64(r); err != nil {
+		return nil, err
+	}
+	members, err := read_bytes(r)
+	if err != nil {
+		return nil, err
+	}
+	snap.members = decode_members(members)
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(r.Len()) {
+		return nil, errBadRecord
+	}
+	for i := uint64(0); i < count; i++ {
+		record, err := read_bytes(r)
+		if err != nil {
+			return nil, err
+		}
+		op, key, val, err := decode_record(record)
+		if err != nil || op != aof_op_set {
+			return nil, errBadRecord
+		}
+		snap.entries = append(snap.entries, snapshot_entry{key, val})
+	}
+	return snap, nil
+}
+
+/*
+client_ops() returns the operations the commands of clients run against: the store, or the raft node in cluster mode
+*/
+func client_ops() store_ops {
+
+	if raft_cluster != nil {
+		return raft_ops{raft_cluster}
+	}
+	return kv
+}
+
+/*
+read_ops() is client_ops() for commands which only read. In cluster mode it first waits until the store can be read
+linearizably.
+*/
+func read_ops() (store_ops, error) {
+
+	if raft_cluster == nil {
+		return kv, nil
+	}
+	r, err := raft_cluster.read_index()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case err := <-r.done:
+		if err != nil {
+			return nil, err
+		}
+	case <-time.After(raft_timeout):
+		return nil, errTimeout
+	}
+	return raft_ops{raft_cluster}, nil
+}
+
+/*
+raft_ops runs the commands of clients on a cluster node. set, add, replace, cas and delete are proposed to the log,
+which only the leader accepts. Reads go to the store, after read_ops() made sure it is up to date. The other writes
+are not replicated and fail with errNotReplicated, as do writes of the store which don't go through raft_ops.
+*/
+type raft_ops struct {
+	n *raft_node
+}
+
+/*
+write() proposes cmd and waits for its result
+*/
+func (o raft_ops) write(cmd raft_command) (int64, error) {
+
+	p, err := o.n.propose(cmd)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case result := <-p.done:
+		return result.version, result.err
+	case <-time.After(raft_timeout):
+		return 0, errTimeout
+	}
+}
+
+func (o raft_ops) get(key string) (mapval, bool) {
+	return o.n.s.get(key)
+}
+
+func (o raft_ops) get_many(keys []string) ([]mapval, []bool) {
+	return o.n.s.get_many(keys)
+}
+
+func (o raft_ops) set_if(key string, ttl time.Duration, value []byte, cond int) (int64, error) {
+
+	now := time.Now()
+	return o.write(raft_command{op: raft_op_set, cond: byte(cond), now: now.UnixNano(), key: key, val: new_mapval(ttl, value, now)})
+}
+
+func (o raft_ops) set(key string, ttl time.Duration, value []byte) (int64, error) {
+	return o.set_if(key, ttl, value, cond_always)
+}
+
+func (o raft_ops) add(key string, ttl time.Duration, value []byte) (int64, error) {
+	return o.set_if(key, ttl, value, cond_absent)
+}
+
+func (o raft_ops) replace(key string, ttl time.Duration, value []byte) (int64, error) {
+	return o.set_if(key, ttl, value, cond_present)
+}
+
+func (o raft_ops) cas(key string, ttl time.Duration, version int64, value []byte) (int64, error) {
+
+	now := time.Now()
+	return o.write(raft_command{op: raft_op_cas, now: now.UnixNano(), version: version, key: key, val: new_mapval(ttl, value, now)})
+}
+
+func (o raft_ops) delete(key string) error {
+
+	_, err := o.write(raft_command{op: raft_op_delete, now: time.Now().UnixNano(), key: key})
+	return err
+}
+
+func (o raft_ops) append_value(key string, value []byte, prepend bool) (int64, error) {
+	return 0, errNotReplicated
+}
+
+func (o raft_ops) incr(key string, delta int64, create bool, initial int64, ttl time.Duration) (int64, error) {
+	return 0, errNotReplicated
+}
+
+func (o raft_ops) touch(key string, ttl time.Duration) (mapval, error) {
+	return mapval{}, errNotReplicated
+}
+
+/*
+raft_admin_command() runs the raft administration commands of the text protocol:
+
+	raft status                 replies RAFT <state> <term> <leader or -> <member1,...,membern>
+	raft add <addr>             adds the node listening on addr to the cluster, replies MEMBERS <member1,...,membern>
+	raft remove <addr>          removes a node, replies MEMBERS <member1,...,membern>
+*/
+func raft_admin_command(writer *bufio.Writer, args []string) {
+
+	if raft_cluster == nil || len(args) == 0 {
+		writer.WriteString("ERRCMDERR\r\n")
+		return
+	}
+
+	switch {
+	case len(args) == 1 && args[0] == "status":
+		state, term, leader, members := raft_cluster.status()
+		if leader == "" {
+			leader = "-"
+		}
+		writer.WriteString(fmt.Sprintf("RAFT %s %d %s %s\r\n", state, term, leader, strings.Join(members, ",")))
+
+	case len(args) == 2 && (args[0] == "add" || args[0] == "remove"):
+		p, err := raft_cluster.change_members(args[1], args[0] == "add")
+		if err == nil {
+			select {
+			case result := <-p.done:
+				err = result.err
+			case <-time.After(raft_timeout):
+				err = errTimeout
+			}
+		}
+		if err != nil {
+			writer.WriteString(error_message(err))
+			return
+		}
+		_, _, _, members := raft_cluster.status()
+		writer.WriteString("MEMBERS " + strings.Join(members, ",") + "\r\n")
+
+	default:
+		writer.WriteString("ERRCMDERR\r\n")
+	}
+}
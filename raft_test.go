@@ -0,0 +1,545 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+sim_network connects raft nodes in the test process. Messages are queued by send() and delivered by run(), which also
+ticks the nodes, so a test decides exactly when time passes. Messages from or to an isolated node are lost.
+*/
+type sim_network struct {
+	mutex    sync.Mutex
+	nodes    map[string]*raft_node
+	queue    []raft_message
+	isolated map[string]bool
+}
+
+func (sn *sim_network) send(msg raft_message) {
+
+	sn.mutex.Lock()
+	defer sn.mutex.Unlock()
+	sn.queue = append(sn.queue, msg)
+}
+
+/*
+new_sim_cluster() starts a cluster of size nodes named n1, n2, ...
+*/
+func new_sim_cluster(size int) *sim_network {
+
+	sn := &sim_network{nodes: make(map[string]*raft_node), isolated: make(map[string]bool)}
+	var members []string
+	for i := 1; i <= size; i++ {
+		members = append(members, "n"+strconv.Itoa(i))
+	}
+	for _, id := range members {
+		sn.nodes[id] = new_raft_node(id, members, new_store(4), sn)
+	}
+	return sn
+}
+
+func (sn *sim_network) add_node(id string) *raft_node {
+
+	n := new_raft_node(id, nil, new_store(4), sn)
+	sn.mutex.Lock()
+	sn.nodes[id] = n
+	sn.mutex.Unlock()
+	return n
+}
+
+/*
+run() ticks every node ticks times, delivering all messages after every tick
+*/
+func (sn *sim_network) run(ticks int) {
+
+	for i := 0; i < ticks; i++ {
+		for _, n := range sn.nodes {
+			n.tick()
+		}
+		for {
+			sn.mutex.Lock()
+			queue := sn.queue
+			sn.queue = nil
+			sn.mutex.Unlock()
+			if len(queue) == 0 {
+				break
+			}
+			for _, msg := range queue {
+				if n := sn.nodes[msg.to]; n != nil && !sn.isolated[msg.from] && !sn.isolated[msg.to] {
+					n.step(msg)
+				}
+			}
+		}
+	}
+}
+
+/*
+leader() returns the leader of the nodes which aren't isolated, running the cluster until there is one
+*/
+func (sn *sim_network) leader(t *testing.T) *raft_node {
+
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		for id, n := range sn.nodes {
+			if state, _, _, _ := n.status(); state == "leader" && !sn.isolated[id] {
+				return n
+			}
+		}
+		sn.run(1)
+	}
+	t.Fatal("no leader was elected")
+	return nil
+}
+
+/*
+wait() runs the cluster until p has its result
+*/
+func (sn *sim_network) wait(t *testing.T, p *raft_proposal) raft_result {
+
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		select {
+		case result := <-p.done:
+			return result
+		default:
+		}
+		sn.run(1)
+	}
+	t.Fatal("proposal was not applied")
+	return raft_result{}
+}
+
+func (sn *sim_network) write(t *testing.T, cmd raft_command) raft_result {
+
+	t.Helper()
+	p, err := sn.leader(t).propose(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sn.wait(t, p)
+}
+
+func set_command(key string, value string) raft_command {
+
+	now := time.Now()
+	return raft_command{op: raft_op_set, now: now.UnixNano(), key: key, val: new_mapval(0, []byte(value), now)}
+}
+
+/*
+check_stores() checks that every node which isn't isolated has key at version with value, or doesn't have it when
+value is empty
+*/
+func (sn *sim_network) check_stores(t *testing.T, key string, value string, version int64) {
+
+	t.Helper()
+	sn.run(3)
+	for id, n := range sn.nodes {
+		if sn.isolated[id] || n.is_member(id) == false {
+			continue
+		}
+		val, ok := n.s.get(key)
+		if value == "" && ok {
+			t.Errorf("%s has %s", id, key)
+		}
+		if value != "" && (ok == false || string(val.value) != value || val.version != version) {
+			t.Errorf("%s has %s = %q version %d, want %q version %d", id, key, val.value, val.version, value, version)
+		}
+	}
+}
+
+/*
+TestRaftElection() checks that a cluster elects one leader, and elects another one when the leader is cut off
+*/
+func TestRaftElection(t *testing.T) {
+
+	sn := new_sim_cluster(3)
+	leader := sn.leader(t)
+	sn.run(20)
+	leaders := 0
+	for _, n := range sn.nodes {
+		if state, _, _, _ := n.status(); state == "leader" {
+			leaders++
+		}
+	}
+	if leaders != 1 {
+		t.Fatalf("%d leaders", leaders)
+	}
+
+	_, term, _, _ := leader.status()
+	sn.isolated[leader.id] = true
+	next := sn.leader(t)
+	if _, next_term, _, _ := next.status(); next == leader || next_term <= term {
+		t.Fatalf("leader %s of term %d after %s of term %d", next.id, next_term, leader.id, term)
+	}
+
+	/*
+		The old leader can't reach a majority, so it steps down on its own
+	*/
+	sn.run(2 * raft_election_ticks)
+	if state, _, _, _ := leader.status(); state == "leader" {
+		t.Error("isolated leader is still leader")
+	}
+	delete(sn.isolated, leader.id)
+	sn.run(5)
+	if _, _, known, _ := leader.status(); known != next.id {
+		t.Errorf("old leader follows %q, want %s", known, next.id)
+	}
+}
+
+/*
+TestRaftReplication() writes through the leader and checks that every node applies the same results
+*/
+func TestRaftReplication(t *testing.T) {
+
+	sn := new_sim_cluster(3)
+	if r := sn.write(t, set_command("a", "1")); r.err != nil || r.version != 0 {
+		t.Fatalf("set = %+v", r)
+	}
+	if r := sn.write(t, set_command("a", "2")); r.err != nil || r.version != 1 {
+		t.Fatalf("set = %+v", r)
+	}
+	sn.check_stores(t, "a", "2", 1)
+
+	now := time.Now()
+	cas := raft_command{op: raft_op_cas, now: now.UnixNano(), version: 0, key: "a", val: new_mapval(0, []byte("3"), now)}
+	if r := sn.write(t, cas); r.err != errVersion {
+		t.Errorf("cas of an old version = %+v", r)
+	}
+	cas.version = 1
+	if r := sn.write(t, cas); r.err != nil || r.version != 2 {
+		t.Errorf("cas = %+v", r)
+	}
+	add := set_command("a", "4")
+	add.cond = cond_absent
+	if r := sn.write(t, add); r.err != errExists {
+		t.Errorf("add of an existing key = %+v", r)
+	}
+	sn.check_stores(t, "a", "3", 2)
+
+	if r := sn.write(t, raft_command{op: raft_op_delete, now: time.Now().UnixNano(), key: "a"}); r.err != nil {
+		t.Errorf("delete = %+v", r)
+	}
+	if r := sn.write(t, raft_command{op: raft_op_delete, now: time.Now().UnixNano(), key: "a"}); r.err != errNotFound {
+		t.Errorf("delete of a missing key = %+v", r)
+	}
+	sn.check_stores(t, "a", "", 0)
+
+	for _, n := range sn.nodes {
+		if state, _, _, _ := n.status(); state != "leader" {
+			if _, err := n.propose(set_command("a", "5")); err != errNotLeader {
+				t.Errorf("follower accepted a proposal: %v", err)
+			}
+		}
+	}
+}
+
+/*
+TestRaftPartition() cuts the leader off with a write it can't commit, and checks that the write is replaced by the
+log of the new leader when the partition heals
+*/
+func TestRaftPartition(t *testing.T) {
+
+	sn := new_sim_cluster(5)
+	sn.write(t, set_command("k", "before"))
+	old := sn.leader(t)
+	sn.isolated[old.id] = true
+
+	lost, err := old.propose(set_command("k", "lost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := sn.write(t, set_command("k", "after")); r.err != nil || r.version != 1 {
+		t.Fatalf("write to the majority = %+v", r)
+	}
+	select {
+	case r := <-lost.done:
+		t.Fatalf("write to the minority completed with %+v", r)
+	default:
+	}
+
+	delete(sn.isolated, old.id)
+	if r := sn.wait(t, lost); r.err != errNotLeader {
+		t.Errorf("write to the minority = %+v, want errNotLeader", r)
+	}
+	sn.check_stores(t, "k", "after", 1)
+}
+
+/*
+TestRaftSnapshot() compacts the log while a follower is cut off, and checks that the follower catches up from the
+snapshot
+*/
+func TestRaftSnapshot(t *testing.T) {
+
+	entries := raft_snapshot_entries
+	raft_snapshot_entries = 20
+	defer func() { raft_snapshot_entries = entries }()
+
+	sn := new_sim_cluster(3)
+	leader := sn.leader(t)
+	var lagging *raft_node
+	for _, n := range sn.nodes {
+		if n != leader {
+			lagging = n
+		}
+	}
+	sn.isolated[lagging.id] = true
+	for i := 0; i < 50; i++ {
+		sn.write(t, set_command("key"+strconv.Itoa(i), strconv.Itoa(i)))
+	}
+	if leader.snap.index == 0 || len(leader.log) >= 50 {
+		t.Fatalf("log of %d entries after a snapshot at %d", len(leader.log), leader.snap.index)
+	}
+
+	/*
+		The follower campaigned while it was cut off, and its term makes the leader step down when it is back
+	*/
+	delete(sn.isolated, lagging.id)
+	sn.run(3 * raft_election_ticks)
+	if r := sn.write(t, set_command("last", "x")); r.err != nil {
+		t.Fatal(r.err)
+	}
+	sn.check_stores(t, "key0", "0", 0)
+	sn.check_stores(t, "key49", "49", 0)
+	sn.check_stores(t, "last", "x", 0)
+	if lagging.snap.index == 0 {
+		t.Error("lagging follower caught up without the snapshot")
+	}
+}
+
+/*
+TestRaftMembership() adds a node, which catches up, and removes nodes including the leader
+*/
+func TestRaftMembership(t *testing.T) {
+
+	sn := new_sim_cluster(3)
+	sn.write(t, set_command("a", "1"))
+
+	n4 := sn.add_node("n4")
+	sn.run(3 * raft_election_ticks)
+	if state, _, _, _ := n4.status(); state != "follower" {
+		t.Fatalf("node waiting to be added is a %s", state)
+	}
+	p, err := sn.leader(t).change_members("n4", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := sn.wait(t, p); r.err != nil {
+		t.Fatal(r.err)
+	}
+	sn.check_stores(t, "a", "1", 0)
+	if _, _, _, members := n4.status(); len(members) != 4 {
+		t.Errorf("new node has members %v", members)
+	}
+	if _, err := sn.leader(t).change_members("n4", true); err != errExists {
+		t.Errorf("adding a member again = %v", err)
+	}
+
+	/*
+		A removed leader steps down, and the remaining members elect one of them
+	*/
+	leader := sn.leader(t)
+	p, err = leader.change_members(leader.id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := sn.wait(t, p); r.err != nil {
+		t.Fatal(r.err)
+	}
+	sn.run(1)
+	if state, _, _, _ := leader.status(); state == "leader" {
+		t.Fatal("removed leader is still leader")
+	}
+	next := sn.leader(t)
+	if next == leader {
+		t.Fatal("removed node was elected")
+	}
+	if _, _, _, members := next.status(); len(members) != 3 || next.is_member(leader.id) {
+		t.Errorf("members after the removal = %v", members)
+	}
+	if r := sn.write(t, set_command("a", "2")); r.err != nil {
+		t.Fatal(r.err)
+	}
+	sn.check_stores(t, "a", "2", 1)
+}
+
+/*
+TestRaftRestart() restarts nodes from their raft log files, and checks that they come back with their term, vote, log
+and store, including a node added to the cluster and a whole cluster restarted at once
+*/
+func TestRaftRestart(t *testing.T) {
+
+	entries := raft_snapshot_entries
+	raft_snapshot_entries = 20
+	defer func() { raft_snapshot_entries = entries }()
+
+	dir := t.TempDir()
+	sn := new_sim_cluster(3)
+	for id, n := range sn.nodes {
+		if err := n.open_log(filepath.Join(dir, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n4 := sn.add_node("n4")
+	if err := n4.open_log(filepath.Join(dir, "n4")); err != nil {
+		t.Fatal(err)
+	}
+	p, err := sn.leader(t).change_members("n4", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := sn.wait(t, p); r.err != nil {
+		t.Fatal(r.err)
+	}
+	for i := 0; i < 30; i++ {
+		sn.write(t, set_command("key"+strconv.Itoa(i), strconv.Itoa(i)))
+	}
+	sn.run(3)
+
+	restart := func(id string) *raft_node {
+		old := sn.nodes[id]
+		n := new_raft_node(id, nil, new_store(4), sn)
+		if err := n.open_log(filepath.Join(dir, id)); err != nil {
+			t.Fatal(err)
+		}
+		if n.term != old.term || n.voted_for != old.voted_for || n.last_index() != old.last_index() || n.snap.index != old.snap.index {
+			t.Errorf("%s restarted at term %d vote %q log %d snapshot %d, want %d %q %d %d", id, n.term, n.voted_for,
+				n.last_index(), n.snap.index, old.term, old.voted_for, old.last_index(), old.snap.index)
+		}
+		if len(n.members) != 4 {
+			t.Errorf("%s restarted with members %v", id, n.members)
+		}
+		if val, ok := n.s.get("key0"); ok == false || string(val.value) != "0" {
+			t.Errorf("%s restarted without the keys of its snapshot", id)
+		}
+		sn.mutex.Lock()
+		sn.nodes[id] = n
+		sn.mutex.Unlock()
+		return n
+	}
+
+	restart("n4")
+	sn.check_stores(t, "key29", "29", 0)
+	for id := range sn.nodes {
+		restart(id)
+	}
+	if r := sn.write(t, set_command("last", "x")); r.err != nil {
+		t.Fatal(r.err)
+	}
+	sn.check_stores(t, "key29", "29", 0)
+	sn.check_stores(t, "last", "x", 0)
+}
+
+/*
+TestRaftReadIndex() checks that only a leader which can reach a majority serves reads
+*/
+func TestRaftReadIndex(t *testing.T) {
+
+	sn := new_sim_cluster(3)
+	sn.write(t, set_command("a", "1"))
+	leader := sn.leader(t)
+
+	r, err := leader.read_index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn.run(1)
+	select {
+	case err := <-r.done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("read was not confirmed by a heartbeat round")
+	}
+
+	for _, n := range sn.nodes {
+		if n != leader {
+			if _, err := n.read_index(); err != errNotLeader {
+				t.Errorf("follower served a read: %v", err)
+			}
+		}
+	}
+
+	sn.isolated[leader.id] = true
+	r, err = leader.read_index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn.run(1)
+	select {
+	case <-r.done:
+		t.Fatal("isolated leader confirmed a read")
+	default:
+	}
+	sn.run(2 * raft_election_ticks)
+	select {
+	case err := <-r.done:
+		if err != errNotLeader {
+			t.Errorf("read of an isolated leader = %v", err)
+		}
+	default:
+		t.Error("read of an isolated leader is still waiting")
+	}
+}
+
+/*
+TestRaftExpiry() checks that expired keys are deleted through the log on every node
+*/
+func TestRaftExpiry(t *testing.T) {
+
+	sn := new_sim_cluster(3)
+	now := time.Now()
+	cmd := raft_command{op: raft_op_set, now: now.UnixNano(), key: "short", val: new_mapval(time.Millisecond, []byte("x"), now)}
+	sn.write(t, cmd)
+	time.Sleep(5 * time.Millisecond)
+
+	for _, n := range sn.nodes {
+		if _, ok := n.s.get("short"); ok {
+			t.Errorf("%s returns an expired key", n.id)
+		}
+	}
+	sn.run(5)
+	for _, n := range sn.nodes {
+		if _, ok := n.s.shard_for("short").memmap["short"]; ok {
+			t.Errorf("expired key is still stored on %s", n.id)
+		}
+	}
+}
+
+/*
+TestRaftMessageEncoding() checks that messages survive encode_raft_message() and decode_raft_message()
+*/
+func TestRaftMessageEncoding(t *testing.T) {
+
+	val := new_mapval(time.Hour, []byte("value"), time.Now())
+	msg := raft_message{
+		kind: msg_append, from: "127.0.0.1:9000", to: "127.0.0.1:9001", term: 3, index: 10, log_term: 2, commit: 9,
+		ok: true, read: 7,
+		entries:  []raft_entry{{term: 3, kind: entry_command, data: encode_command(set_command("k", "v"))}, {term: 3, kind: entry_noop}},
+		snapshot: &raft_snapshot{index: 8, term: 2, members: []string{"a", "b"}, entries: []snapshot_entry{{"k", val}}},
+	}
+	got, err := decode_raft_message(encode_raft_message(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.kind != msg.kind || got.from != msg.from || got.to != msg.to || got.term != 3 || got.index != 10 || got.log_term != 2 || got.commit != 9 || got.ok != true || got.read != 7 {
+		t.Errorf("decoded %+v", got)
+	}
+	if len(got.entries) != 2 || got.entries[1].kind != entry_noop || len(got.entries[1].data) != 0 {
+		t.Fatalf("decoded entries %+v", got.entries)
+	}
+	if cmd, err := decode_command(got.entries[0].data); err != nil || cmd.key != "k" || string(cmd.val.value) != "v" {
+		t.Errorf("decoded command %+v, %v", cmd, err)
+	}
+	snap := got.snapshot
+	if snap == nil || snap.index != 8 || len(snap.members) != 2 || len(snap.entries) != 1 || snap.entries[0].val.timestamp != val.timestamp {
+		t.Errorf("decoded snapshot %+v", snap)
+	}
+	if _, err := decode_raft_message(encode_raft_message(msg)[:20]); err == nil {
+		t.Error("truncated message was decoded")
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Asynchronous leader-follower replication, built on the change log. A server started with -replicaof <addr> is a
+follower of the leader listening on addr. It connects and sends
+
+	sync [<seq> <log id>]
+
+and the leader replies either
+
+	CONTINUE <seq> <log id>\r\n            when the changes after seq, the last one the follower applied, are still kept
+	FULLSYNC <seq> <count> <log id>\r\n    followed by count set changes, one for every key, with sequence number seq
+
+after which the leader streams every change after seq as the changes command does. A full sync is a consistent copy of
+the store at change seq, with the versions and absolute expiry times of the keys, which the follower loads aside and
+puts in place of its store at once. A follower which loses its connection reconnects and resumes after the last change
+it applied, and only needs another full sync if the leader no longer keeps that change, or its change log has another
+id than the one the follower synced from, as after a restart without -cdc-file.
+
+A follower serves reads from its copy, which lags the leader by the changes in flight, and rejects every write with
+ERR_REDIRECT <leader addr>. Keys are deleted on the follower by the changes of the leader, and by expiry.
+*/
+
+/*
+Address of the leader, set with -replicaof. Empty on a leader.
+*/
+var replica_of string
+
+/*
+Time a follower waits before connecting again after losing the leader
+*/
+const replica_retry = time.Second
+
+/*
+errReadOnly is returned by the writes of a follower
+*/
+var errReadOnly = errors.New("ERR_REDIRECT")
+
+/*
+read_only() returns errReadOnly on a follower, and errNotReplicated on a raft cluster node, whose store is only
+written by the raft log. It is checked by every write of the store before anything is changed.
+*/
+func read_only() error {
+
+	if replica_of != "" {
+		return errReadOnly
+	}
+	if raft_cluster != nil {
+		return errNotReplicated
+	}
+	return nil
+}
+
+/*
+sync_command() runs sync for a follower, which sent the last sequence number it applied and the id of the log it is
+from, empty for a follower which has none
+*/
+func sync_command(reader *bufio.Reader, writer *bufio.Writer, since uint64, log_id string) bool {
+
+	if log_id != "" && log_id == changelog.id {
+		if _, _, behind, _ := changelog.read(since, 0); behind == false {
+			writer.WriteString("CONTINUE " + strconv.FormatUint(since, 10) + " " + changelog.id + "\r\n")
+			return stream_changes(reader, writer, since)
+		}
+	}
+
+	since, changes := kv.sync_state()
+	writer.WriteString("FULLSYNC " + strconv.FormatUint(since, 10) + " " + strconv.Itoa(len(changes)) + " " + changelog.id + "\r\n")
+	for _, c := range changes {
+		write_change(writer, c)
+	}
+	return stream_changes(reader, writer, since)
+}
+
+/*
+sync_state() returns every live key of the store as a set change, and the sequence number of the last change they
+include. The read locks of all shards are held meanwhile, and changes are only recorded under the write lock of their
+shard, so no change is half in the copy.
+*/
+func (s *store) sync_state() (uint64, []change) {
+
+	s.rlock_all()
+	defer s.runlock_all()
+
+	changelog.mutex.Lock()
+	since := changelog.next - 1
+	changelog.mutex.Unlock()
+
+	now := time.Now().UnixNano()
+	var changes []change
+	for _, sh := range s.shards {
+		for key, val := range sh.memmap {
+			if is_expired(val, now) == false {
+				changes = append(changes, change{seq: since, event: "set", key: key, val: val})
+			}
+		}
+	}
+	return since, changes
+}
+
+/*
+follower is the replication state of a follower. offset is the sequence number of the last change of the leader it
+applied in the change log log_id, and synced tells whether it has one.
+*/
+type follower struct {
+	leader     string
+	s          *store
+	offset     uint64
+	log_id     string
+	synced     bool
+	full_syncs int64 // number of full syncs done, read atomically
+}
+
+/*
+follow() replicates the leader into kv for as long as the server runs
+*/
+func follow(leader string) {
+
+	f := &follower{leader: leader, s: kv}
+	for {
+		con, err := net.Dial("tcp", leader)
+		if err != nil {
+			fmt.Printf("INT_ERR: Connecting to leader %s: %s\n", leader, err)
+		} else {
+			err = f.replicate(con)
+			con.Close()
+			fmt.Printf("INT_ERR: Replication from %s stopped: %s\n", leader, err)
+		}
+		time.Sleep(replica_retry)
+	}
+}
+
+/*
+replicate() syncs with the leader over con and applies its changes until the connection fails
+*/
+func (f *follower) replicate(con net.Conn) error {
+
+	reader := bufio.NewReader(con)
+	command := "sync\r\n"
+	if f.synced {
+		command = "sync " + strconv.FormatUint(f.offset, 10) + " " + f.log_id + "\r\n"
+	}
+	if _, err := io.WriteString(con, command); err != nil {
+		return err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "CONTINUE" && fields[2] == f.log_id:
+
+	case len(fields) == 4 && fields[0] == "FULLSYNC":
+		seq, err := strconv.ParseUint(fields[1], 10, 64)
+		count, cerr := strconv.Atoi(fields[2])
+		if err != nil || cerr != nil {
+			return fmt.Errorf("bad reply %q", line)
+		}
+		fresh := new_store(len(f.s.shards))
+		for i := 0; i < count; i++ {
+			c, err := read_change(reader)
+			if err != nil {
+				return err
+			}
+			fresh.apply_change(c)
+		}
+		f.s.replace_contents(fresh)
+		f.offset, f.log_id, f.synced = seq, fields[3], true
+		atomic.AddInt64(&f.full_syncs, 1)
+
+	default:
+		return fmt.Errorf("bad reply %q", line)
+	}
+
+	for {
+		c, err := read_change(reader)
+		if err != nil {
+			if err == errBehind {
+				f.synced = false
+			}
+			return err
+		}
+		if c.seq != f.offset+1 {
+			f.synced = false
+			return fmt.Errorf("change %d after %d", c.seq, f.offset)
+		}
+		f.s.apply_change(c)
+		f.offset = c.seq
+	}
+}
+
+/*
+errBehind is returned by read_change() when the leader no longer keeps the changes the follower needs
+*/
+var errBehind = errors.New("behind the change log of the leader")
+
+/*
+read_change() reads a change in the format written by write_change()
+*/
+func read_change(reader *bufio.Reader) (change, error) {
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return change{}, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "BEHIND" {
+		return change{}, errBehind
+	}
+	if (len(fields) != 5 && len(fields) != 7) || fields[0] != "CHANGE" {
+		return change{}, fmt.Errorf("bad change %q", line)
+	}
+
+	c := change{event: fields[2], key: fields[3]}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	version, verr := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil || verr != nil {
+		return change{}, fmt.Errorf("bad change %q", line)
+	}
+	c.seq, c.val.version = seq, version
+	if len(fields) == 5 {
+		return c, nil
+	}
+
+	expiry, err := strconv.ParseInt(fields[5], 10, 64)
+	numbytes, nerr := strconv.Atoi(fields[6])
+	if err != nil || nerr != nil || numbytes < 0 {
+		return change{}, fmt.Errorf("bad change %q", line)
+	}
+	block := make([]byte, numbytes+2)
+	if _, err := io.ReadFull(reader, block); err != nil {
+		return change{}, err
+	}
+	c.val.value = block[:numbytes]
+	c.val.numbytes = numbytes
+	if expiry != 0 {
+		ttl := time.Until(time.UnixMilli(expiry))
+		if ttl <= 0 {
+			ttl = -1
+		}
+		c.val.set_expiry(ttl, time.Now())
+	}
+	return c, nil
+}
+
+/*
+apply_change() applies a change of the leader to the store of a follower
+*/
+func (s *store) apply_change(c change) {
+
+	if c.event == "set" || c.event == "cas" {
+		s.apply_record(aof_op_set, c.key, c.val)
+		return
+	}
+	s.apply_record(aof_op_delete, c.key, c.val)
+}
+
+/*
+replace_contents() makes the keys of fresh, a store with as many shards which nobody else uses, the keys of s
+*/
+func (s *store) replace_contents(fresh *store) {
+
+	s.lock_all()
+	defer s.unlock_all()
+
+	for i, sh := range s.shards {
+		new_sh := fresh.shards[i]
+		sh.memmap = new_sh.memmap
+		sh.exp_heap = new_sh.exp_heap
+		sh.exp_nodes = new_sh.exp_nodes
+		sh.index = new_sh.index
+		atomic.StoreInt64(&sh.used, atomic.LoadInt64(&new_sh.used))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+TestReadChange() reads back the changes written by write_change() and applies them to a store
+*/
+func TestReadChange(t *testing.T) {
+
+	val := new_mapval(time.Hour, []byte("a\r\nb"), time.Now())
+	val.version = 4
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	write_change(writer, change{seq: 7, event: "set", key: "k1", val: val})
+	write_change(writer, change{seq: 8, event: "cas", key: "k2", val: mapval{version: 2, value: []byte{}}})
+	write_change(writer, change{seq: 9, event: "delete", key: "k1", val: mapval{version: 4}})
+	writer.WriteString("BEHIND 3\r\n")
+	writer.Flush()
+
+	s := new_store(4)
+	reader := bufio.NewReader(&buf)
+	c, err := read_change(reader)
+	if err != nil || c.seq != 7 || c.key != "k1" || string(c.val.value) != "a\r\nb" || c.val.version != 4 {
+		t.Fatalf("read %+v, %v", c, err)
+	}
+	if left := time.Duration(c.val.timestamp - val.timestamp); left < -time.Millisecond || left > time.Millisecond {
+		t.Errorf("expiry moved by %s", left)
+	}
+	s.apply_change(c)
+	if got, ok := s.get("k1"); ok == false || got.version != 4 || remaining_expiry(got) < 59*time.Minute {
+		t.Errorf("applied set = %+v, %v", got, ok)
+	}
+
+	c, err = read_change(reader)
+	if err != nil || c.event != "cas" || len(c.val.value) != 0 || c.val.expirytime != 0 {
+		t.Fatalf("read %+v, %v", c, err)
+	}
+	c, err = read_change(reader)
+	if err != nil || c.event != "delete" || c.seq != 9 {
+		t.Fatalf("read %+v, %v", c, err)
+	}
+	s.apply_change(c)
+	if _, ok := s.get("k1"); ok {
+		t.Error("applied delete left the key")
+	}
+	if _, err := read_change(reader); err != errBehind {
+		t.Errorf("BEHIND read as %v", err)
+	}
+	if _, err := read_change(bufio.NewReader(strings.NewReader("CHANGE x set k 1\r\n"))); err == nil {
+		t.Error("bad sequence number was accepted")
+	}
+}
+
+/*
+TestReplaceContents() checks that a full sync replaces every key of the store, including its expiry schedule and
+memory accounting
+*/
+func TestReplaceContents(t *testing.T) {
+
+	s := new_store(4)
+	s.set("old", time.Hour, []byte("x"))
+	fresh := new_store(4)
+	fresh.set("new", time.Hour, []byte("y"))
+	used := fresh.memory_used()
+
+	s.replace_contents(fresh)
+	if _, ok := s.get("old"); ok {
+		t.Error("key of the old contents is left")
+	}
+	if _, ok := s.get("new"); ok == false {
+		t.Error("key of the new contents is missing")
+	}
+	if s.memory_used() != used {
+		t.Errorf("memory used = %d, want %d", s.memory_used(), used)
+	}
+	if n := s.active_expire(time.Now().Add(2*time.Hour).UnixNano(), time.Second); n != 1 {
+		t.Errorf("active expiry deleted %d keys, want 1", n)
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The RESP listener serves the same store as handleconnection using the Redis serialization protocol, so redis-cli and
+Redis client libraries can be used against this server. Connections speak RESP2 until the client switches to RESP3
+with HELLO 3. Both request arrays and inline commands (for telnet) are accepted.
+
+Supported commands:
+
+	GET key
+	SET key value [EX seconds | PX milliseconds] [NX | XX]
+	DEL key [key ...]
+	EXISTS key [key ...]
+	TTL key, PTTL key
+	GETM key                                              replies [value, version, ttl]
+	CAS key version value [EX seconds | PX milliseconds]  replies the new version
+	PING, ECHO, HELLO, SELECT 0, COMMAND, CLIENT, QUIT
+*/
+
+const (
+	resp_max_bulk  = 512 * 1024 * 1024
+	resp_max_array = 1024 * 1024
+)
+
+var errRespProtocol = errors.New("Protocol error")
+
+type resp_conn struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+	proto  int
+}
+
+/*
+serve_resp() handles every connection accepted on lis with the RESP protocol
+*/
+func serve_resp(lis net.Listener) {
+
+	for {
+		con, error := lis.Accept()
+		if errors.Is(error, net.ErrClosed) {
+			return
+		}
+		if error != nil {
+			fmt.Printf("INT_ERR: Accepting resp data: %s\n", error)
+			continue
+		}
+		go handle_resp_connection(con)
+	}
+}
+
+/*
+handle_resp_connection() executes commands in the order they arrive and only flushes replies once every command
+already received has been answered, so pipelining clients get their replies in as few writes as possible
+*/
+func handle_resp_connection(con net.Conn) {
+
+	defer con.Close()
+	c := &resp_conn{
+		reader: bufio.NewReader(con),
+		writer: bufio.NewWriter(con),
+		proto:  2,
+	}
+
+	for {
+		args, err := c.read_command()
+		if err != nil {
+			if err == errRespProtocol {
+				c.write_error("ERR Protocol error")
+				c.writer.Flush()
+			}
+			return
+		}
+
+		quit := false
+		if len(args) > 0 {
+			quit = c.execute(args)
+		}
+
+		if quit || c.reader.Buffered() == 0 {
+			if err := c.writer.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+/*
+read_line() returns the next line without its \r\n. The slice is only valid until the next read. Lines longer than
+the reader's buffer are a protocol error.
+*/
+func (c *resp_conn) read_line() ([]byte, error) {
+
+	line, err := c.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errRespProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+/*
+read_command() reads one request, either a RESP array of bulk strings or an inline command line
+*/
+func (c *resp_conn) read_command() ([][]byte, error) {
+
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] != '*' {
+		line, err := c.read_line()
+		if err != nil {
+			return nil, err
+		}
+		fields := bytes.Fields(line)
+		args := make([][]byte, len(fields))
+		for i, field := range fields {
+			args[i] = append([]byte(nil), field...)
+		}
+		return args, nil
+	}
+
+	line, err := c.read_line()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > resp_max_array {
+		return nil, errRespProtocol
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	args := make([][]byte, n)
+	for i := range args {
+		line, err := c.read_line()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRespProtocol
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > resp_max_bulk {
+			return nil, errRespProtocol
+		}
+
+		block := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, block); err != nil {
+			return nil, err
+		}
+		if block[size] != '\r' || block[size+1] != '\n' {
+			return nil, errRespProtocol
+		}
+		args[i] = block[:size]
+	}
+	return args, nil
+}
+
+func (c *resp_conn) write_simple(s string) {
+	c.writer.WriteString("+" + s + "\r\n")
+}
+
+func (c *resp_conn) write_error(s string) {
+	c.writer.WriteString("-" + s + "\r\n")
+}
+
+func (c *resp_conn) write_int(n int64) {
+	c.writer.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *resp_conn) write_bulk(b []byte) {
+	c.writer.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	c.writer.Write(b)
+	c.writer.WriteString("\r\n")
+}
+
+func (c *resp_conn) write_null() {
+	if c.proto == 3 {
+		c.writer.WriteString("_\r\n")
+	} else {
+		c.writer.WriteString("$-1\r\n")
+	}
+}
+
+func (c *resp_conn) write_array(n int) {
+	c.writer.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (c *resp_conn) write_map(n int) {
+	if c.proto == 3 {
+		c.writer.WriteString("%" + strconv.Itoa(n) + "\r\n")
+	} else {
+		c.write_array(2 * n)
+	}
+}
+
+/*
+write_store_error() replies with the RESP error for an error returned by a store operation
+*/
+func (c *resp_conn) write_store_error(err error) {
+
+	switch err {
+	case errNotFound:
+		c.write_error("NOTFOUND no such key")
+	case errVersion:
+		c.write_error("VERSION version mismatch")
+	case errExists:
+		c.write_error("EXISTS key already exists")
+	case errOutOfMemory:
+		c.write_error("OOM command not allowed when used memory > 'maxmemory'")
+	case errReadOnly:
+		c.write_error("READONLY writes go to the leader at " + replica_of)
+	case errNotReplicated:
+		c.write_error("NOTREPLICATED writes of a raft cluster go through the text protocol")
+	default:
+		fmt.Printf("INT_ERR: %s\n", err)
+		c.write_error("ERR internal error")
+	}
+}
+
+/*
+resp_ttl() returns the remaining time to live of val in milliseconds, or -1 if it never expires
+*/
+func resp_ttl(val mapval) int64 {
+
+	if val.expirytime == 0 {
+		return -1
+	}
+	return int64((remaining_expiry(val) + time.Millisecond - 1) / time.Millisecond)
+}
+
+/*
+parse_resp_expiry() parses an EX or PX option into a time to live
+*/
+func parse_resp_expiry(option string, arg []byte) (time.Duration, bool) {
+
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/int64(time.Second) {
+		return 0, false
+	}
+	if option == "PX" {
+		return time.Duration(n) * time.Millisecond, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+/*
+execute() runs one command and writes its reply. It returns true when the connection should be closed.
+*/
+func (c *resp_conn) execute(args [][]byte) bool {
+
+	name := strings.ToUpper(string(args[0]))
+
+	arity_error := func() {
+		c.write_error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+	}
+
+	switch name {
+
+	case "PING":
+		if len(args) > 2 {
+			arity_error()
+		} else if len(args) == 2 {
+			c.write_bulk(args[1])
+		} else {
+			c.write_simple("PONG")
+		}
+
+	case "ECHO":
+		if len(args) != 2 {
+			arity_error()
+			break
+		}
+		c.write_bulk(args[1])
+
+	case "QUIT":
+		c.write_simple("OK")
+		return true
+
+	case "HELLO":
+		proto := c.proto
+		if len(args) > 1 {
+			n, err := strconv.Atoi(string(args[1]))
+			if err != nil || (n != 2 && n != 3) {
+				c.write_error("NOPROTO unsupported protocol version")
+				break
+			}
+			proto = n
+		}
+		c.proto = proto
+		c.write_map(4)
+		c.write_bulk([]byte("server"))
+		c.write_bulk([]byte("kvstore"))
+		c.write_bulk([]byte("proto"))
+		c.write_int(int64(proto))
+		c.write_bulk([]byte("mode"))
+		c.write_bulk([]byte("standalone"))
+		c.write_bulk([]byte("role"))
+		if replica_of != "" {
+			c.write_bulk([]byte("replica"))
+		} else {
+			c.write_bulk([]byte("master"))
+		}
+
+	case "SELECT":
+		if len(args) != 2 {
+			arity_error()
+		} else if string(args[1]) != "0" {
+			c.write_error("ERR DB index is out of range")
+		} else {
+			c.write_simple("OK")
+		}
+
+	case "COMMAND":
+		c.write_array(0)
+
+	case "CLIENT":
+		c.write_simple("OK")
+
+	case "GET":
+		if len(args) != 2 {
+			arity_error()
+			break
+		}
+		if val, ok := kv.get(string(args[1])); ok {
+			c.write_bulk(val.value)
+		} else {
+			c.write_null()
+		}
+
+	case "GETM":
+		if len(args) != 2 {
+			arity_error()
+			break
+		}
+		val, ok := kv.get(string(args[1]))
+		if !ok {
+			c.write_null()
+			break
+		}
+		ttl := resp_ttl(val)
+		if ttl > 0 {
+			ttl = (ttl + 999) / 1000
+		}
+		c.write_array(3)
+		c.write_bulk(val.value)
+		c.write_int(val.version)
+		c.write_int(ttl)
+
+	case "SET":
+		if len(args) < 3 {
+			arity_error()
+			break
+		}
+		var expirytime time.Duration
+		cond := cond_always
+		syntax_ok := true
+		for i := 3; i < len(args) && syntax_ok; i++ {
+			option := strings.ToUpper(string(args[i]))
+			switch {
+			case (option == "EX" || option == "PX") && i+1 < len(args) && expirytime == 0:
+				expirytime, syntax_ok = parse_resp_expiry(option, args[i+1])
+				i++
+			case option == "NX" && cond == cond_always:
+				cond = cond_absent
+			case option == "XX" && cond == cond_always:
+				cond = cond_present
+			default:
+				syntax_ok = false
+			}
+		}
+		if !syntax_ok {
+			c.write_error("ERR syntax error")
+			break
+		}
+
+		if valid_key(string(args[1])) == false {
+			c.write_error("ERR invalid key")
+			break
+		}
+		_, err := kv.set_if(string(args[1]), expirytime, args[2], cond)
+		if err == nil {
+			c.write_simple("OK")
+		} else if (err == errExists && cond == cond_absent) || (err == errNotFound && cond == cond_present) {
+			c.write_null()
+		} else {
+			c.write_store_error(err)
+		}
+
+	case "CAS":
+		if len(args) != 4 && len(args) != 6 {
+			arity_error()
+			break
+		}
+		version, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil || version < 0 {
+			c.write_error("ERR version is not an integer or out of range")
+			break
+		}
+		var expirytime time.Duration
+		if len(args) == 6 {
+			option := strings.ToUpper(string(args[4]))
+			ok := option == "EX" || option == "PX"
+			if ok {
+				expirytime, ok = parse_resp_expiry(option, args[5])
+			}
+			if !ok {
+				c.write_error("ERR syntax error")
+				break
+			}
+		}
+		if valid_key(string(args[1])) == false {
+			c.write_error("ERR invalid key")
+			break
+		}
+		new_version, err := kv.cas(string(args[1]), expirytime, version, args[3])
+		if err != nil {
+			c.write_store_error(err)
+			break
+		}
+		c.write_int(new_version)
+
+	case "DEL":
+		if len(args) < 2 {
+			arity_error()
+			break
+		}
+		var deleted int64
+		for _, key := range args[1:] {
+			err := kv.delete(string(key))
+			if err == nil {
+				deleted++
+			} else if err != errNotFound {
+				c.write_store_error(err)
+				return false
+			}
+		}
+		c.write_int(deleted)
+
+	case "EXISTS":
+		if len(args) < 2 {
+			arity_error()
+			break
+		}
+		var found int64
+		for _, key := range args[1:] {
+			if _, ok := kv.get(string(key)); ok {
+				found++
+			}
+		}
+		c.write_int(found)
+
+	case "TTL", "PTTL":
+		if len(args) != 2 {
+			arity_error()
+			break
+		}
+		val, ok := kv.get(string(args[1]))
+		if !ok {
+			c.write_int(-2)
+			break
+		}
+		ttl := resp_ttl(val)
+		if ttl > 0 && name == "TTL" {
+			ttl = (ttl + 999) / 1000
+		}
+		c.write_int(ttl)
+
+	default:
+		c.write_error("ERR unknown command '" + string(args[0]) + "'")
+	}
+
+	return false
+}
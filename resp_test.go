@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+/*
+resp_command() encodes args as a RESP array
+*/
+func resp_command(args ...string) string {
+
+	cmd := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		cmd += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	return cmd
+}
+
+func dial_resp(t *testing.T) (net.Conn, *bufio.Reader) {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go serve_resp(lis)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+/*
+TestRespCommands() runs every supported command once, pipelined in a single write, and compares the raw replies
+*/
+func TestRespCommands(t *testing.T) {
+
+	conn, reader := dial_resp(t)
+
+	requests := []string{
+		resp_command("PING"),
+		resp_command("SET", "respkey", "mayur\r\nkale"),
+		resp_command("GET", "respkey"),
+		resp_command("SET", "respkey", "x", "NX"),
+		resp_command("SET", "respmissing", "x", "XX"),
+		resp_command("SET", "respkey", "kale", "EX", "100", "XX"),
+		resp_command("TTL", "respkey"),
+		resp_command("GETM", "respkey"),
+		resp_command("CAS", "respkey", "5", "new"),
+		resp_command("CAS", "respkey", "1", "new"),
+		resp_command("TTL", "respkey"),
+		resp_command("EXISTS", "respkey", "respmissing", "respkey"),
+		resp_command("DEL", "respkey", "respmissing"),
+		resp_command("GET", "respkey"),
+		resp_command("TTL", "respkey"),
+		resp_command("SET", "respkey", "x", "EX", "0"),
+		resp_command("SET", "resp key", "x"),
+		resp_command("CAS", "resp\r\nkey", "0", "x"),
+		resp_command("SET", "", "x"),
+		resp_command("NOSUCH"),
+		"PING inline\r\n",
+	}
+	replies := []string{
+		"+PONG\r\n",
+		"+OK\r\n",
+		"$11\r\nmayur\r\nkale\r\n",
+		"$-1\r\n",
+		"$-1\r\n",
+		"+OK\r\n",
+		":100\r\n",
+		"*3\r\n$4\r\nkale\r\n:1\r\n:100\r\n",
+		"-VERSION version mismatch\r\n",
+		":2\r\n",
+		":-1\r\n",
+		":2\r\n",
+		":1\r\n",
+		"$-1\r\n",
+		":-2\r\n",
+		"-ERR syntax error\r\n",
+		"-ERR invalid key\r\n",
+		"-ERR invalid key\r\n",
+		"-ERR invalid key\r\n",
+		"-ERR unknown command 'NOSUCH'\r\n",
+		"$6\r\ninline\r\n",
+	}
+
+	all := ""
+	for _, request := range requests {
+		all += request
+	}
+	io.WriteString(conn, all)
+
+	for i, want := range replies {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(reader, got); err != nil {
+			t.Fatalf("reply %d: %s", i, err)
+		}
+		if string(got) != want {
+			t.Fatalf("reply %d to %q = %q, want %q", i, requests[i], got, want)
+		}
+	}
+}
+
+/*
+TestRespHello() switches a connection to RESP3 and checks that null replies change encoding, and that the role is the
+one of the server
+*/
+func TestRespHello(t *testing.T) {
+
+	conn, reader := dial_resp(t)
+
+	io.WriteString(conn, resp_command("HELLO", "3"))
+	line, _ := reader.ReadString('\n')
+	if line != "%4\r\n" {
+		t.Fatalf("HELLO 3 replied %q", line)
+	}
+	/*
+		Seven bulk strings of two lines each and the proto number, the role last
+	*/
+	for i := 0; i < 15; i++ {
+		line, _ = reader.ReadString('\n')
+	}
+	if line != "master\r\n" {
+		t.Errorf("role of a leader = %q", line)
+	}
+
+	io.WriteString(conn, resp_command("GET", "respmissing"))
+	line, _ = reader.ReadString('\n')
+	if line != "_\r\n" {
+		t.Errorf("RESP3 null = %q", line)
+	}
+
+	io.WriteString(conn, resp_command("HELLO", "4"))
+	line, _ = reader.ReadString('\n')
+	if line != "-NOPROTO unsupported protocol version\r\n" {
+		t.Errorf("HELLO 4 replied %q", line)
+	}
+
+	replica_of = "127.0.0.1:9001"
+	defer func() { replica_of = "" }()
+	io.WriteString(conn, resp_command("HELLO"))
+	for i := 0; i < 16; i++ {
+		line, _ = reader.ReadString('\n')
+	}
+	if line != "replica\r\n" {
+		t.Errorf("role of a follower = %q", line)
+	}
+}
@@ -0,0 +1,867 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Scripts run by eval are written in a small lisp. A script is a sequence of expressions and its result is the value of
+the last one. Values are nil, integers (64 bit), strings, booleans and lists.
+
+	42  "text\n"  true  false  nil        literals, ; starts a comment
+	KEYS  ARGV                            the keys and arguments of eval, as lists of strings
+	(def name expr)  (set! name expr)     defines a variable, changes an existing one
+	(do expr...)  (if cond then [else])  (while cond expr...)  (and expr...)  (or expr...)
+	(+ a b...)  (- a b...)  (* a b...)  (/ a b)  (% a b)
+	(= a b)  (!= a b)  (< a b)  (<= a b)  (> a b)  (>= a b)  (not a)
+	(str a...)  (num s)  (len s)  (list a...)  (nth l i)  (error msg)
+	(get key)              the value of key, or nil
+	(getm key)             (value version ttl) with ttl in milliseconds, -1 for no expiry, or nil
+	(set key value [ttl])  stores value, expiring after ttl milliseconds, and returns the new version
+	(delete key)           deletes key and returns whether it existed
+
+Only nil and false are false. A script runs with every shard locked, like exec, so it sees no other client's writes
+and no client sees its writes before it ends. Writes are not undone when a script fails half way. Every script runs
+within a budget of evaluation steps, time and bytes of the strings and lists it makes, after which it fails, and no
+string or list it makes, or its result, may be larger than the result limit.
+*/
+
+/*
+Budget of a script, set with -script-max-steps, -script-timeout (milliseconds), -script-max-memory and
+-script-max-result (bytes)
+*/
+var (
+	script_max_steps  = 1000000
+	script_timeout    = 500
+	script_max_memory = 64 * 1024 * 1024
+	script_max_result = 16 * 1024 * 1024
+)
+
+const script_max_depth = 200
+
+var errNoScript = errors.New("ERR_NOSCRIPT")
+
+type script_symbol string
+
+/*
+script_error is a script failing to parse or run. Its reply carries the reason, unlike the other errors.
+*/
+type script_error struct {
+	msg string
+}
+
+func (e *script_error) Error() string {
+	return "ERR_SCRIPT " + e.msg
+}
+
+func script_fail(format string, args ...interface{}) error {
+	return &script_error{fmt.Sprintf(format, args...)}
+}
+
+/*
+script is a parsed script. Its expressions are int64, string, bool and nil literals, script_symbol and []interface{}
+for a call.
+*/
+type script struct {
+	sha   string
+	exprs []interface{}
+}
+
+/*
+Scripts which were loaded or evaluated, by the hex SHA1 of their source, for evalsha
+*/
+var (
+	scripts       = make(map[string]*script)
+	scripts_mutex sync.RWMutex
+)
+
+/*
+load_script() parses src and caches it for evalsha
+*/
+func load_script(src []byte) (*script, error) {
+
+	sum := sha1.Sum(src)
+	sha := hex.EncodeToString(sum[:])
+
+	scripts_mutex.RLock()
+	sc, ok := scripts[sha]
+	scripts_mutex.RUnlock()
+	if ok {
+		return sc, nil
+	}
+
+	p := &script_parser{src: src}
+	sc = &script{sha: sha}
+	for {
+		p.skip_space()
+		if p.pos == len(p.src) {
+			break
+		}
+		expr, err := p.parse(0)
+		if err != nil {
+			return nil, err
+		}
+		sc.exprs = append(sc.exprs, expr)
+	}
+
+	scripts_mutex.Lock()
+	scripts[sha] = sc
+	scripts_mutex.Unlock()
+	return sc, nil
+}
+
+/*
+cached_script() returns the script with the hex SHA1 sha, or errNoScript
+*/
+func cached_script(sha string) (*script, error) {
+
+	scripts_mutex.RLock()
+	defer scripts_mutex.RUnlock()
+	sc, ok := scripts[strings.ToLower(sha)]
+	if ok == false {
+		return nil, errNoScript
+	}
+	return sc, nil
+}
+
+func flush_scripts() {
+
+	scripts_mutex.Lock()
+	scripts = make(map[string]*script)
+	scripts_mutex.Unlock()
+}
+
+type script_parser struct {
+	src []byte
+	pos int
+}
+
+func (p *script_parser) skip_space() {
+
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ';' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			p.pos++
+		} else {
+			return
+		}
+	}
+}
+
+/*
+parse() reads one expression at pos
+*/
+func (p *script_parser) parse(depth int) (interface{}, error) {
+
+	if depth > script_max_depth {
+		return nil, script_fail("nested too deeply")
+	}
+	p.skip_space()
+	if p.pos == len(p.src) {
+		return nil, script_fail("unexpected end of script")
+	}
+
+	switch c := p.src[p.pos]; {
+	case c == '(':
+		p.pos++
+		call := []interface{}{}
+		for {
+			p.skip_space()
+			if p.pos == len(p.src) {
+				return nil, script_fail("missing )")
+			}
+			if p.src[p.pos] == ')' {
+				p.pos++
+				if len(call) == 0 {
+					return nil, script_fail("empty call")
+				}
+				return call, nil
+			}
+			expr, err := p.parse(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			call = append(call, expr)
+		}
+
+	case c == ')':
+		return nil, script_fail("unexpected )")
+
+	case c == '"':
+		return p.parse_string()
+	}
+
+	start := p.pos
+	for p.pos < len(p.src) && !strings.ContainsRune(" \t\r\n();\"", rune(p.src[p.pos])) {
+		p.pos++
+	}
+	atom := string(p.src[start:p.pos])
+	if n, err := strconv.ParseInt(atom, 10, 64); err == nil {
+		return n, nil
+	}
+	switch atom {
+	case "nil":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return script_symbol(atom), nil
+}
+
+func (p *script_parser) parse_string() (interface{}, error) {
+
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.src); p.pos++ {
+		c := p.src[p.pos]
+		if c == '"' {
+			p.pos++
+			return b.String(), nil
+		}
+		if c == '\\' && p.pos+1 < len(p.src) {
+			p.pos++
+			switch c = p.src[p.pos]; c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			}
+		}
+		b.WriteByte(c)
+	}
+	return nil, script_fail("missing \"")
+}
+
+/*
+script_run is one run of a script: its variables, the store it works on and what is left of its budget
+*/
+type script_run struct {
+	ops      store_ops
+	vars     []map[string]interface{}
+	steps    int
+	deadline time.Time
+	bytes    int // size of the strings and lists made so far
+}
+
+/*
+run_script() evaluates sc against ops with the given keys and arguments and returns its result
+*/
+func run_script(sc *script, ops store_ops, keys []string, args []string) (interface{}, error) {
+
+	r := &script_run{
+		ops:      ops,
+		vars:     []map[string]interface{}{{"KEYS": string_list(keys), "ARGV": string_list(args)}},
+		deadline: time.Now().Add(time.Duration(script_timeout) * time.Millisecond),
+	}
+	var result interface{}
+	for _, expr := range sc.exprs {
+		var err error
+		if result, err = r.eval(expr); err != nil {
+			return nil, err
+		}
+	}
+
+	/*
+		Lists can hold the same list many times, so a small script can make a result far too large to reply
+	*/
+	if script_size(result, script_max_result) > script_max_result {
+		return nil, script_fail("result too large")
+	}
+	return result, nil
+}
+
+/*
+alloc() charges size bytes made by the script to its budget
+*/
+func (r *script_run) alloc(size int) error {
+
+	if size > script_max_result {
+		return script_fail("result too large")
+	}
+	r.bytes += size
+	if r.bytes > script_max_memory {
+		return script_fail("memory budget exceeded")
+	}
+	return nil
+}
+
+/*
+string_of() is script_string() for a value which may be a list, whose string is made, and charged, only if it fits
+*/
+func (r *script_run) string_of(v interface{}) (string, error) {
+
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	if err := r.alloc(script_size(v, script_max_result)); err != nil {
+		return "", err
+	}
+	return script_string(v), nil
+}
+
+func string_list(strs []string) []interface{} {
+
+	list := make([]interface{}, len(strs))
+	for i, s := range strs {
+		list[i] = s
+	}
+	return list
+}
+
+func truthy(v interface{}) bool {
+	return v != nil && v != false
+}
+
+func (r *script_run) lookup(name string) (map[string]interface{}, bool) {
+
+	for i := len(r.vars) - 1; i >= 0; i-- {
+		if _, ok := r.vars[i][name]; ok {
+			return r.vars[i], true
+		}
+	}
+	return nil, false
+}
+
+/*
+eval() evaluates one expression. Every call counts as a step of the budget and the clock is checked every 1024 steps.
+*/
+func (r *script_run) eval(expr interface{}) (interface{}, error) {
+
+	r.steps++
+	if r.steps > script_max_steps || (r.steps%1024 == 0 && time.Now().After(r.deadline)) {
+		return nil, script_fail("budget exceeded")
+	}
+
+	switch e := expr.(type) {
+	case script_symbol:
+		if scope, ok := r.lookup(string(e)); ok {
+			return scope[string(e)], nil
+		}
+		return nil, script_fail("unknown variable %s", e)
+	case []interface{}:
+		return r.call(e)
+	}
+	return expr, nil
+}
+
+func (r *script_run) eval_all(exprs []interface{}) ([]interface{}, error) {
+
+	vals := make([]interface{}, len(exprs))
+	for i, expr := range exprs {
+		val, err := r.eval(expr)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
+
+/*
+body() evaluates exprs in a new scope and returns the value of the last one
+*/
+func (r *script_run) body(exprs []interface{}) (interface{}, error) {
+
+	r.vars = append(r.vars, map[string]interface{}{})
+	defer func() { r.vars = r.vars[:len(r.vars)-1] }()
+
+	var result interface{}
+	for _, expr := range exprs {
+		var err error
+		if result, err = r.eval(expr); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (r *script_run) call(call []interface{}) (interface{}, error) {
+
+	name, ok := call[0].(script_symbol)
+	if ok == false {
+		return nil, script_fail("call of something which is not a function")
+	}
+	args := call[1:]
+
+	/*
+		Special forms, which don't evaluate all their arguments
+	*/
+	switch name {
+	case "def", "set!":
+		target, ok := script_symbol(""), len(args) == 2
+		if ok {
+			target, ok = args[0].(script_symbol)
+		}
+		if ok == false {
+			return nil, script_fail("%s takes a name and a value", name)
+		}
+		val, err := r.eval(args[1])
+		if err != nil {
+			return nil, err
+		}
+		scope := r.vars[len(r.vars)-1]
+		if name == "set!" {
+			if scope, ok = r.lookup(string(target)); ok == false {
+				return nil, script_fail("unknown variable %s", target)
+			}
+		}
+		scope[string(target)] = val
+		return val, nil
+
+	case "do":
+		return r.body(args)
+
+	case "if":
+		if len(args) != 2 && len(args) != 3 {
+			return nil, script_fail("if takes a condition and one or two branches")
+		}
+		cond, err := r.eval(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return r.eval(args[1])
+		}
+		if len(args) == 3 {
+			return r.eval(args[2])
+		}
+		return nil, nil
+
+	case "while":
+		if len(args) == 0 {
+			return nil, script_fail("while takes a condition")
+		}
+		for {
+			cond, err := r.eval(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if !truthy(cond) {
+				return nil, nil
+			}
+			if _, err := r.body(args[1:]); err != nil {
+				return nil, err
+			}
+		}
+
+	case "and", "or":
+		var val interface{} = name == "and"
+		for _, arg := range args {
+			var err error
+			if val, err = r.eval(arg); err != nil {
+				return nil, err
+			}
+			if truthy(val) != (name == "and") {
+				return val, nil
+			}
+		}
+		return val, nil
+	}
+
+	vals, err := r.eval_all(args)
+	if err != nil {
+		return nil, err
+	}
+	return r.builtin(string(name), vals)
+}
+
+/*
+builtin() calls the function name with the evaluated arguments
+*/
+func (r *script_run) builtin(name string, args []interface{}) (interface{}, error) {
+
+	argc := func(min int, max int) error {
+		if len(args) < min || (max >= 0 && len(args) > max) {
+			return script_fail("wrong number of arguments for %s", name)
+		}
+		return nil
+	}
+	ints := func() ([]int64, error) {
+		nums := make([]int64, len(args))
+		for i, arg := range args {
+			n, ok := arg.(int64)
+			if ok == false {
+				return nil, script_fail("%s takes integers", name)
+			}
+			nums[i] = n
+		}
+		return nums, nil
+	}
+
+	switch name {
+	case "+", "-", "*", "/", "%":
+		if err := argc(1, -1); err != nil {
+			return nil, err
+		}
+		nums, err := ints()
+		if err != nil {
+			return nil, err
+		}
+		if name == "-" && len(nums) == 1 {
+			return -nums[0], nil
+		}
+		result := nums[0]
+		for _, n := range nums[1:] {
+			switch name {
+			case "+":
+				result += n
+			case "-":
+				result -= n
+			case "*":
+				result *= n
+			default:
+				if n == 0 {
+					return nil, script_fail("division by zero")
+				}
+				if name == "/" {
+					result /= n
+				} else {
+					result %= n
+				}
+			}
+		}
+		return result, nil
+
+	case "=", "!=":
+		if err := argc(2, 2); err != nil {
+			return nil, err
+		}
+		equal, err := script_equal(args[0], args[1])
+		return equal == (name == "="), err
+
+	case "<", "<=", ">", ">=":
+		if err := argc(2, 2); err != nil {
+			return nil, err
+		}
+		cmp, err := script_compare(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		}
+		return cmp >= 0, nil
+
+	case "not":
+		if err := argc(1, 1); err != nil {
+			return nil, err
+		}
+		return !truthy(args[0]), nil
+
+	case "str":
+		parts := make([]string, len(args))
+		size := 0
+		for i, arg := range args {
+			var err error
+			if parts[i], err = r.string_of(arg); err != nil {
+				return nil, err
+			}
+			size += len(parts[i])
+		}
+		if err := r.alloc(size); err != nil {
+			return nil, err
+		}
+		return strings.Join(parts, ""), nil
+
+	case "num":
+		if err := argc(1, 1); err != nil {
+			return nil, err
+		}
+		if n, ok := args[0].(int64); ok {
+			return n, nil
+		}
+		s, _ := args[0].(string)
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, nil
+		}
+		return n, nil
+
+	case "len":
+		if err := argc(1, 1); err != nil {
+			return nil, err
+		}
+		switch v := args[0].(type) {
+		case string:
+			return int64(len(v)), nil
+		case []interface{}:
+			return int64(len(v)), nil
+		}
+		return nil, script_fail("len takes a string or a list")
+
+	case "list":
+		if err := r.alloc(16 * len(args)); err != nil {
+			return nil, err
+		}
+		return args, nil
+
+	case "nth":
+		if err := argc(2, 2); err != nil {
+			return nil, err
+		}
+		list, ok := args[0].([]interface{})
+		i, ok_i := args[1].(int64)
+		if ok == false || ok_i == false {
+			return nil, script_fail("nth takes a list and an integer")
+		}
+		if i < 0 || i >= int64(len(list)) {
+			return nil, nil
+		}
+		return list[i], nil
+
+	case "error":
+		if err := argc(1, 1); err != nil {
+			return nil, err
+		}
+		msg, err := r.string_of(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return nil, &script_error{msg}
+
+	case "get", "getm":
+		if err := argc(1, 1); err != nil {
+			return nil, err
+		}
+		key, err := r.string_of(args[0])
+		if err != nil {
+			return nil, err
+		}
+		val, ok := r.ops.get(key)
+		if ok == false {
+			return nil, nil
+		}
+		if err := r.alloc(len(val.value)); err != nil {
+			return nil, err
+		}
+		if name == "get" {
+			return string(val.value), nil
+		}
+		ttl := int64(-1)
+		if val.expirytime != 0 {
+			ttl = int64((remaining_expiry(val) + time.Millisecond - 1) / time.Millisecond)
+		}
+		return []interface{}{string(val.value), val.version, ttl}, nil
+
+	case "set":
+		if err := argc(2, 3); err != nil {
+			return nil, err
+		}
+		key, err := r.string_of(args[0])
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.string_of(args[1])
+		if err != nil {
+			return nil, err
+		}
+		var ttl time.Duration
+		if len(args) == 3 {
+			ms, ok := args[2].(int64)
+			if ok == false || ms < 0 {
+				return nil, script_fail("the ttl of set is a number of milliseconds")
+			}
+			ttl = time.Duration(ms) * time.Millisecond
+		}
+		if valid_key(key) == false || value == "" {
+			return nil, script_fail("set of a key or value which is not valid")
+		}
+		version, err := r.ops.set(key, ttl, []byte(value))
+		if err != nil {
+			return nil, script_fail("set failed: %s", err)
+		}
+		return version, nil
+
+	case "delete":
+		if err := argc(1, 1); err != nil {
+			return nil, err
+		}
+		key, err := r.string_of(args[0])
+		if err != nil {
+			return nil, err
+		}
+		err = r.ops.delete(key)
+		if err == errNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return nil, script_fail("delete failed: %s", err)
+		}
+		return true, nil
+	}
+	return nil, script_fail("unknown function %s", name)
+}
+
+/*
+script_string() converts a value to a string for str and for the keys and values of the store functions
+*/
+func script_string(v interface{}) string {
+
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = script_string(item)
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	}
+	return "nil"
+}
+
+/*
+script_size() returns the length of script_string(v), or a length over limit as soon as it is clear to be over, so
+that lists holding the same list many times are not walked in full
+*/
+func script_size(v interface{}, limit int) int {
+
+	switch v := v.(type) {
+	case string:
+		return len(v)
+	case []interface{}:
+		size := 1 + len(v)
+		for _, item := range v {
+			if size > limit {
+				break
+			}
+			size += script_size(item, limit-size)
+		}
+		return size
+	}
+	return len(script_string(v))
+}
+
+func script_equal(a interface{}, b interface{}) (bool, error) {
+
+	if _, ok := a.([]interface{}); ok {
+		return false, script_fail("lists can't be compared")
+	}
+	if _, ok := b.([]interface{}); ok {
+		return false, script_fail("lists can't be compared")
+	}
+	return a == b, nil
+}
+
+func script_compare(a interface{}, b interface{}) (int, error) {
+
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			if a < b {
+				return -1, nil
+			} else if a > b {
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	}
+	return 0, script_fail("only two integers or two strings can be compared")
+}
+
+/*
+format_script_result() converts the result of a script to the reply of eval: nil and false are NIL, true is INT 1
+*/
+func format_script_result(v interface{}) []byte {
+
+	switch v := v.(type) {
+	case int64:
+		return []byte("INT " + strconv.FormatInt(v, 10) + "\r\n")
+	case bool:
+		if v {
+			return []byte("INT 1\r\n")
+		}
+	case string:
+		reply := []byte("VALUE " + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+		return reply
+	case []interface{}:
+		reply := []byte("LIST " + strconv.Itoa(len(v)) + "\r\n")
+		for _, item := range v {
+			reply = append(reply, format_script_result(item)...)
+		}
+		return reply
+	}
+	return []byte("NIL\r\n")
+}
+
+/*
+parse_eval_args() splits the fields of eval and evalsha after the script into keys and arguments. The first field is
+the number of keys.
+*/
+func parse_eval_args(fields []string) (keys []string, args []string, ok bool) {
+
+	if len(fields) == 0 {
+		return nil, nil, false
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	nkeys, err := strconv.Atoi(fields[0])
+	if err != nil || nkeys < 0 || nkeys > len(fields)-1 {
+		return nil, nil, false
+	}
+	if keys, ok = parse_keys(fields[1 : 1+nkeys]); ok == false {
+		return nil, nil, false
+	}
+	return keys, fields[1+nkeys:], true
+}
+
+/*
+eval_script() runs sc for eval and evalsha and writes its result to writer, or queues it when a transaction was
+started with multi. Outside a transaction the script runs with every shard locked, like exec. In a cluster the keys
+are routed like the keys of any other command, so a script must declare the keys it uses.
+*/
+func eval_script(tx *transaction, writer *bufio.Writer, sc *script, keys []string, args []string, asking bool) {
+
+	run := func(ops store_ops, out *bufio.Writer) {
+		result, err := run_script(sc, ops, keys, args)
+		if err != nil {
+			out.WriteString(error_message(err))
+			return
+		}
+		out.Write(format_script_result(result))
+	}
+	run = cluster.serve(keys, asking, true, run)
+	if tx.add(run, 0) {
+		writer.WriteString("QUEUED\r\n")
+		return
+	}
+
+	var reply bytes.Buffer
+	out := bufio.NewWriter(&reply)
+	if err := kv.exec(nil, 0, func(ops store_ops) { run(ops, out) }); err != nil {
+		writer.WriteString(error_message(err))
+		return
+	}
+	out.Flush()
+	writer.Write(reply.Bytes())
+}
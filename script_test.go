@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+TestScript() runs scripts against a store and checks their results and errors
+*/
+func TestScript(t *testing.T) {
+
+	s := new_store(4)
+	s.set("quota:a", 0, []byte("100"))
+	s.set("quota:b", 0, []byte("5"))
+
+	run := func(src string, keys []string, args []string) (interface{}, error) {
+		sc, err := load_script([]byte(src))
+		if err != nil {
+			return nil, err
+		}
+		var result interface{}
+		s.exec(nil, 0, func(ops store_ops) {
+			result, err = run_script(sc, ops, keys, args)
+		})
+		return result, err
+	}
+
+	move := `
+		; moves ARGV[0] units from KEYS[0] to KEYS[1] if there are enough
+		(def amount (num (nth ARGV 0)))
+		(def from (num (get (nth KEYS 0))))
+		(if (< from amount)
+			(error "not enough quota")
+			(do
+				(set (nth KEYS 0) (- from amount))
+				(set (nth KEYS 1) (+ (num (get (nth KEYS 1))) amount))))`
+	if result, err := run(move, []string{"quota:a", "quota:b"}, []string{"30"}); err != nil || result != int64(1) {
+		t.Errorf("move returned %v, %v", result, err)
+	}
+	a, _ := s.get("quota:a")
+	b, _ := s.get("quota:b")
+	if string(a.value) != "70" || string(b.value) != "35" {
+		t.Errorf("quota:a = %s, quota:b = %s after the move", a.value, b.value)
+	}
+	if _, err := run(move, []string{"quota:a", "quota:b"}, []string{"500"}); err == nil || err.Error() != "ERR_SCRIPT not enough quota" {
+		t.Errorf("move of too much returned %v", err)
+	}
+
+	sum := `(def i 0) (def total 0)
+		(while (< i 10) (set! total (+ total i)) (set! i (+ i 1)))
+		(list total (str "n" i) (getm "quota:b") (get "missing") (delete "quota:b") (delete "quota:b"))`
+	result, err := run(sum, nil, nil)
+	want := "LIST 6\r\nINT 45\r\nVALUE 3\r\nn10\r\nLIST 3\r\nVALUE 2\r\n35\r\nINT 1\r\nINT -1\r\nNIL\r\nINT 1\r\nNIL\r\n"
+	if got := string(format_script_result(result)); err != nil || got != want {
+		t.Errorf("script returned %q, %v", got, err)
+	}
+
+	for _, src := range []string{"(+ 1", "(1 2)", "(undefined)", "(/ 1 0)", "x", "(< 1 \"a\")"} {
+		if _, err := run(src, nil, nil); err == nil || !strings.HasPrefix(err.Error(), "ERR_SCRIPT ") {
+			t.Errorf("%s returned %v", src, err)
+		}
+	}
+
+	steps := script_max_steps
+	script_max_steps = 1000
+	_, err = run("(while true)", nil, nil)
+	script_max_steps = steps
+	if err == nil || err.Error() != "ERR_SCRIPT budget exceeded" {
+		t.Errorf("endless loop returned %v", err)
+	}
+
+	/*
+		Strings doubling in a loop, many small strings and a list holding itself twice at every level all fail long
+		before the step budget
+	*/
+	max_memory, max_result := script_max_memory, script_max_result
+	script_max_memory, script_max_result = 100000, 1000
+	tree := `(def l (list 1)) (def i 0) (while (< i 60) (set! l (list l l)) (set! i (+ i 1)))`
+	for _, c := range []struct{ src, want string }{
+		{`(def s "x") (while true (set! s (str s s)))`, "ERR_SCRIPT result too large"},
+		{`(while true (str "0123456789"))`, "ERR_SCRIPT memory budget exceeded"},
+		{tree + " l", "ERR_SCRIPT result too large"},
+		{tree + " (len (str l))", "ERR_SCRIPT result too large"},
+	} {
+		if _, err := run(c.src, nil, nil); err == nil || err.Error() != c.want {
+			t.Errorf("%s returned %v, want %s", c.src, err, c.want)
+		}
+	}
+	script_max_memory, script_max_result = max_memory, max_result
+
+	timeout := script_timeout
+	script_timeout = 10
+	start := time.Now()
+	_, err = run("(while true)", nil, nil)
+	script_timeout = timeout
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("endless loop returned %v after %s", err, time.Since(start))
+	}
+
+	sc, _ := load_script([]byte(move))
+	if cached, err := cached_script(strings.ToUpper(sc.sha)); err != nil || cached != sc {
+		t.Errorf("loaded script is not cached: %v", err)
+	}
+	flush_scripts()
+	if _, err := cached_script(sc.sha); err != errNoScript {
+		t.Errorf("flushed script returned %v", err)
+	}
+}
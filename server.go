@@ -4,23 +4,51 @@ import (
 	"bufio"
 	"bytes"
 	"container/heap"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
+/*
+Expiry times larger than 30 days are absolute unix times, as in memcached
+*/
+const relative_expiry_max = 30 * 24 * time.Hour
+
+/*
+Number of keys scan returns when no limit is given, the number of keys a step of a cursor scan looks at when no count
+is given, and the largest limit or count accepted
+*/
+const (
+	scan_default_limit = 100
+	scan_default_count = 10
+	scan_max_limit     = 10000
+)
+
+/*
+Largest data block of set, cas, eval and publish, as for the bulk strings of RESP. Raft messages carry snapshots of
+the whole store and may be larger.
+*/
+const (
+	max_value_size   = 512 * 1024 * 1024
+	raft_max_message = 1<<31 - 1
+)
+
 //Below struct acts as value in the key-value pair of store
 type mapval struct {
-	expirytime int
+	expirytime int // time to live in milliseconds the key was given, 0 for no expiry
 	version    int64
 	numbytes   int
-	value      string
-	timestamp  int64
+	value      []byte
+	timestamp  int64 // expiry deadline in unix nanoseconds
+	stats      *entry_stats
+	flags      uint32 // opaque to the server, kept for memcached clients
 }
 
 //Below struct is used as node in heap which is maintained to perform delete operations on expired keys
@@ -28,23 +56,14 @@ type mapval struct {
 type exp_struct struct {
 	value    string
 	priority int64
-	init_ts  int64
 	index    int
 }
 
 type PriorityQueue []*exp_struct
 
 /*
-memmap is the key value store
-*/
-var memmap = make(map[string]mapval)
-
-var mutex = &sync.RWMutex{}
-
-/*
-Below heap is used to store key and there corresponding expiry time as a MIN-HEAP
+Below heap is used by every shard of the store to keep its keys and their corresponding expiry time as a MIN-HEAP
 */
-var exp_heap = make(PriorityQueue, 0)
 
 func (pq PriorityQueue) Len() int { return len(pq) }
 
@@ -85,48 +104,186 @@ func (pq *PriorityQueue) update_node(item *exp_struct, value string, priority in
 }
 
 /*
-periodic_expiry_check() is invoked after every 5sec to determine if any of the key-val pair is expired. This function actually pops value from heap to check the most likely expired key-val pair
+periodic_expiry_check() runs an active expiry cycle expire_hz times a second. Like Redis it only spends a bounded part
+of every tick on it, and every shard is only locked for one batch at a time, so a large number of keys expiring
+together never stalls clients. Keys the cycle hasn't reached yet are still never returned, and are deleted as soon as
+a client reads them.
 */
 func periodic_expiry_check() {
 
-	ticker := time.NewTicker(time.Millisecond * 5000)
+	interval := time.Second / expire_hz
+	ticker := time.NewTicker(interval)
 	go func() {
 		for range ticker.C {
-			if exp_heap.Len() > 0 {
+			kv.active_expire(time.Now().UnixNano(), interval*expire_budget_percent/100)
+		}
+	}()
 
-				mutex.Lock()
-				item := exp_heap[0]
-				val, ok := memmap[item.value]
+	select {}
 
-				for item.priority < time.Now().Unix() {
+}
 
-					if ok == true && item.init_ts == (val.timestamp-int64(val.expirytime)) {
+/*
+is_expired() reports whether val is past its expiry time at now, in unix nanoseconds. An expirytime of 0 means the key
+never expires.
+*/
+func is_expired(val mapval, now int64) bool {
+	return val.expirytime != 0 && val.timestamp < now
+}
 
-						delete(memmap, item.value)
-					}
+/*
+read_value() reads the data block of set and cas, which is exactly numbytes raw bytes followed by \r\n. The bytes
+are not interpreted in any way, so values may contain \r, \n or any other byte. If numbytes is not a valid size
+the block can't be framed and the next line is consumed instead so that the connection stays in sync with the
+client. ok is false when the block is not followed by \r\n, or is larger than max_value_size, in which case it is
+discarded without being kept in memory.
+*/
+func read_value(reader *bufio.Reader, numbytes int) (value []byte, ok bool, err error) {
+	return read_block(reader, numbytes, max_value_size)
+}
 
-					item = heap.Pop(&exp_heap).(*exp_struct)
+func read_block(reader *bufio.Reader, numbytes int, max int) (value []byte, ok bool, err error) {
 
-					if exp_heap.Len() > 0 {
-						item = exp_heap[0]
-					} else {
-						break
+	if numbytes <= 0 {
+		_, err = reader.ReadBytes('\n')
+		return nil, false, err
+	}
+	if numbytes > max {
+		if _, err = io.CopyN(io.Discard, reader, int64(numbytes)); err == nil {
+			_, err = io.CopyN(io.Discard, reader, 2)
+		}
+		return nil, false, err
+	}
 
-					}
-				}
+	block := make([]byte, numbytes+2)
+	if _, err = io.ReadFull(reader, block); err != nil {
+		return nil, false, err
+	}
+	if block[numbytes] != '\r' || block[numbytes+1] != '\n' {
+		return nil, false, nil
+	}
+	return block[:numbytes], true, nil
+}
 
-				mutex.Unlock()
-			}
+/*
+store_command() runs one of the storage commands which share the arguments of set. append and prepend keep the
+expiry time the key already has.
+*/
+func store_command(ops store_ops, command string, key string, expirytime time.Duration, value []byte) (int64, error) {
+
+	switch command {
+	case "add":
+		return ops.add(key, expirytime, value)
+	case "replace":
+		return ops.replace(key, expirytime, value)
+	case "append":
+		return ops.append_value(key, value, false)
+	case "prepend":
+		return ops.append_value(key, value, true)
+	}
+	return ops.set(key, expirytime, value)
+}
+
+/*
+remaining_expiry() returns the time left before val expires, or 0 if it never expires
+*/
+func remaining_expiry(val mapval) time.Duration {
+
+	if val.expirytime == 0 {
+		return 0
+	}
+	left := time.Duration(val.timestamp - time.Now().UnixNano())
+	if left < 0 {
+		left = 0
+	}
+	return left
+}
+
+/*
+format_expiry() formats the time left before val expires for getm and ttl. Keys given a time to live of whole seconds
+report whole seconds, rounded up. Other keys, which includes keys given an absolute expiry time, report milliseconds
+with an ms suffix.
+*/
+func format_expiry(val mapval) string {
+
+	left := remaining_expiry(val)
+	if val.expirytime%1000 != 0 {
+		return strconv.FormatInt(int64((left+time.Millisecond-1)/time.Millisecond), 10) + "ms"
+	}
+	return strconv.FormatInt(int64((left+time.Second-1)/time.Second), 10)
+}
+
+/*
+parse_expiry() parses the exptime argument of the text protocol: a number of seconds, or of milliseconds with an ms
+suffix. Values above 30 days are absolute unix times in the same unit, as in memcached. 0 means no expiry.
+*/
+func parse_expiry(field string) (time.Duration, bool) {
+
+	field = strings.TrimSpace(field)
+	unit := time.Second
+	if strings.HasSuffix(field, "ms") {
+		unit = time.Millisecond
+		field = strings.TrimSuffix(field, "ms")
+	}
+	n, err := strconv.ParseInt(field, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/int64(unit) {
+		return 0, false
+	}
+	if n == 0 {
+		return 0, true
+	}
+	if time.Duration(n)*unit <= relative_expiry_max {
+		return time.Duration(n) * unit, true
+	}
+
+	/*
+		An absolute time which has already passed gives a negative ttl, so the key is expired right away
+	*/
+	ttl := time.Until(time.Unix(0, n*int64(unit)))
+	if ttl == 0 {
+		ttl = -1
+	}
+	return ttl, true
+}
+
+/*
+valid_key() tells whether key can be stored: keys are written unquoted in the lines of changes, sync and watchkeys,
+so like in memcached they are 1 to 250 bytes without spaces or control characters. Every protocol checks the keys of
+its writes with it.
+*/
+func valid_key(key string) bool {
+
+	if key == "" || len(key) > 250 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
 		}
-	}()
+	}
+	return true
+}
 
-	select {}
+/*
+parse_keys() returns the keys of a multi-key command from the fields after the command name. ok is false if a key is
+not valid_key().
+*/
+func parse_keys(fields []string) (keys []string, ok bool) {
 
+	keys = make([]string, len(fields))
+	for i, field := range fields {
+		keys[i] = strings.TrimSpace(field)
+		if valid_key(keys[i]) == false {
+			return nil, false
+		}
+	}
+	return keys, true
 }
 
 /*
 
-handleconnection(): for each TCP connection this function parses command from client and sends appropriate reply
+handleconnection(): for each TCP connection this function parses command from client and sends appropriate reply.
+Commands are executed in the order they arrive and replies go through a buffered writer.
 */
 
 func handleconnection(con net.Conn) {
@@ -135,6 +292,10 @@ func handleconnection(con net.Conn) {
 	var read = true
 
 	reader := bufio.NewReader(con)
+	writer := bufio.NewWriter(con)
+	var tx transaction
+	var sub *subscriber // not nil while the connection is in push mode
+	var asking bool     // the client sent asking, for the next command
 
 	for read {
 
@@ -142,13 +303,13 @@ func handleconnection(con net.Conn) {
 
 		if error == io.EOF {
 			message := "ERR_INTERNAL\r\n"
-			io.Copy(con, bytes.NewBufferString(message))
+			writer.WriteString(message)
 			break
 		}
 
 		if error != nil {
 			message := "ERR_INTERNAL\r\n"
-			io.Copy(con, bytes.NewBufferString(message))
+			writer.WriteString(message)
 			break
 		}
 
@@ -158,24 +319,41 @@ func handleconnection(con net.Conn) {
 		var res []string
 		res = strings.Split((response), " ")
 
-		switch res[0] {
+		if sub != nil {
+			switch command := strings.TrimSpace(res[0]); command {
+			case "subscribe", "psubscribe", "watchkeys", "unsubscribe", "punsubscribe", "unwatchkeys":
+				names, ok := parse_keys(res[1:])
+				if ok == false || (len(names) == 0 && strings.HasPrefix(command, "un") == false && strings.HasPrefix(command, "pun") == false) {
+					sub.push([]byte("ERRCMDERR\r\n"))
+					break
+				}
+				sub = pubsub_command(con, sub, command, names)
+			default:
+				sub.push([]byte("ERRCMDERR\r\n"))
+			}
+			continue
+		}
 
-		case "set":
+		asked := asking
+		asking = false
+
+		switch strings.TrimSpace(res[0]) {
+
+		case "set", "add", "replace", "append", "prepend":
 			var key string
 			var numbytes int
-			var expirytime int
-			var value string
+			var expirytime time.Duration
 			var cmd_err bool
 			cmd_err = false
 			if len(res) != 5 && len(res) != 4 {
 				message := "ERRCMDERR\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
+				writer.WriteString(message)
 				break
 			}
 
 			if res[1] == "" {
 				message := "ERRCMDERR\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
+				writer.WriteString(message)
 			} else {
 				key = strings.TrimSpace(res[1])
 
@@ -184,28 +362,20 @@ func handleconnection(con net.Conn) {
 				if len(res) == 5 {
 					if res[4] != "noreply\r\n" {
 						message := "ERRCMDERR\r\n"
-						io.Copy(con, bytes.NewBufferString(message))
+						writer.WriteString(message)
 						break
 					} else {
 						reply_flag = false
 					}
 				}
 
-				if len(key) > 250 {
+				if valid_key(key) == false {
 
 					cmd_err = true
 				}
 
-				if _, err := strconv.Atoi(res[2]); err == nil {
-
-					temp_expirytime, _ := strconv.Atoi(res[2])
-
-					if temp_expirytime >= 0 {
-						expirytime = temp_expirytime
-					} else {
-						cmd_err = true
-					}
-
+				if temp_expirytime, ok := parse_expiry(res[2]); ok == true {
+					expirytime = temp_expirytime
 				} else {
 					cmd_err = true
 				}
@@ -224,71 +394,53 @@ func handleconnection(con net.Conn) {
 					cmd_err = true
 				}
 
-				data, error := reader.ReadBytes('\n')
+				value, value_ok, error := read_value(reader, numbytes)
 				if error != nil {
 					message := "ERR_INTERNAL\r\n"
-					io.Copy(con, bytes.NewBufferString(message))
+					writer.WriteString(message)
 					break
 				}
-				value = string(data)
-
-				if len(value) == (numbytes + 2) {
 
-					value = strings.TrimSpace(value)
+				if value_ok == true {
 
 					if cmd_err == true {
 						if reply_flag == true {
 							message := "ERRCMDERR\r\n"
-							io.Copy(con, bytes.NewBufferString(message))
+							writer.WriteString(message)
 
 						}
 						break
 
 					}
 
-					mutex.Lock()
-
-					_, ok := memmap[key]
-					cur_ts := time.Now().Unix()
-					new_exp := cur_ts + int64(expirytime)
-					if ok == true {
-						new_version := memmap[key].version
-						new_version = new_version + 1
-
-						memmap[key] = mapval{expirytime, new_version, numbytes, value, new_exp}
-
-					} else {
-
-						memmap[key] = mapval{expirytime, 0, numbytes, value, new_exp}
-
-					}
-
-					//Below if will add key to expiry heap
-
-					if expirytime != 0 {
-
-						item := &exp_struct{
-							value:    key,
-							priority: new_exp,
-							init_ts:  cur_ts,
+					command := strings.TrimSpace(res[0])
+					run := func(ops store_ops, out *bufio.Writer) {
+						version, err := store_command(ops, command, key, expirytime, value)
+						if err != nil {
+							if reply_flag == true {
+								message := error_message(err)
+								out.WriteString(message)
+							}
+							return
 						}
 
-						heap.Push(&exp_heap, item)
+						if reply_flag == true {
+							message := "OK "
+							message = message + strconv.FormatInt(version, 10) + "\r\n"
 
+							out.WriteString(message)
+						}
 					}
-
-					if reply_flag == true {
-						message := "OK "
-						message = message + strconv.FormatInt(memmap[key].version, 10) + "\r\n"
-
-						io.Copy(con, bytes.NewBufferString(message))
+					run = cluster.serve([]string{key}, asked, reply_flag, run)
+					if tx.add(run, len(key)+len(value)+entry_overhead) {
+						writer.WriteString("QUEUED\r\n")
+						break
 					}
-
-					mutex.Unlock()
+					run(client_ops(), writer)
 				} else {
 					if reply_flag == true {
 						message := "ERRCMDERR\r\n"
-						io.Copy(con, bytes.NewBufferString(message))
+						writer.WriteString(message)
 					}
 					break
 
@@ -297,56 +449,130 @@ func handleconnection(con net.Conn) {
 			}
 		case "get":
 
-			if len(res) != 2 {
+			if len(res) < 2 {
 				message := "ERRCMDERR\r\n"
-				con.Write([]byte(message))
+				writer.WriteString(message)
+				break
+			}
+
+			if len(res) > 2 {
+				keys, ok := parse_keys(res[1:])
+				if ok == false {
+					message := "ERRCMDERR\r\n"
+					writer.WriteString(message)
+					break
+				}
+				run := func(ops store_ops, out *bufio.Writer) {
+					values, found := ops.get_many(keys)
+					for i, key := range keys {
+						if found[i] {
+							message := "VALUE " + key + " " + strconv.Itoa(values[i].numbytes) + "\r\n"
+							out.Write(append(append([]byte(message), values[i].value...), "\r\n"...))
+						}
+					}
+					out.WriteString("END\r\n")
+				}
+				run = cluster.serve(keys, asked, true, run)
+				if tx.add(run, 0) {
+					writer.WriteString("QUEUED\r\n")
+					break
+				}
+				if ops, err := read_ops(); err != nil {
+					writer.WriteString(error_message(err))
+				} else {
+					run(ops, writer)
+				}
 				break
 			}
 
 			req_key := strings.TrimSpace(res[1])
 
-			mutex.RLock()
-			value, ok := memmap[req_key]
-			mutex.RUnlock()
+			run := func(ops store_ops, out *bufio.Writer) {
+				value, ok := ops.get(req_key)
 
-			if ok == false || value.timestamp < time.Now().Unix() {
-				message := "ERRNOTFOUND\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
+				if ok == false {
+					message := "ERRNOTFOUND\r\n"
+					out.WriteString(message)
+				} else {
+					message := "VALUE "
+					message = message + strconv.Itoa(value.numbytes)
+					message = message + "\r\n"
+					out.Write(append(append([]byte(message), value.value...), "\r\n"...))
+				}
+			}
+			run = cluster.serve([]string{req_key}, asked, true, run)
+			if tx.add(run, 0) {
+				writer.WriteString("QUEUED\r\n")
 				break
+			}
+			if ops, err := read_ops(); err != nil {
+				writer.WriteString(error_message(err))
 			} else {
-				message := "VALUE "
-				message = message + strconv.Itoa(value.numbytes)
-				message = message + "\r\n"
-				message = message + value.value + "\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
+				run(ops, writer)
 			}
 
 		case "getm":
 
-			if len(res) != 2 {
+			if len(res) < 2 {
 				message := "ERRCMDERR\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
+				writer.WriteString(message)
+				break
+			}
+
+			if len(res) > 2 {
+				keys, ok := parse_keys(res[1:])
+				if ok == false {
+					message := "ERRCMDERR\r\n"
+					writer.WriteString(message)
+					break
+				}
+				run := func(ops store_ops, out *bufio.Writer) {
+					values, found := ops.get_many(keys)
+					for i, key := range keys {
+						if found[i] {
+							message := "VALUE " + key + " " + strconv.FormatInt(values[i].version, 10) + " " + format_expiry(values[i]) + " " + strconv.Itoa(values[i].numbytes) + "\r\n"
+							out.Write(append(append([]byte(message), values[i].value...), "\r\n"...))
+						}
+					}
+					out.WriteString("END\r\n")
+				}
+				run = cluster.serve(keys, asked, true, run)
+				if tx.add(run, 0) {
+					writer.WriteString("QUEUED\r\n")
+					break
+				}
+				if ops, err := read_ops(); err != nil {
+					writer.WriteString(error_message(err))
+				} else {
+					run(ops, writer)
+				}
 				break
 			}
 
 			req_key := strings.TrimSpace(res[1])
 
-			mutex.RLock()
-			value, ok := memmap[req_key]
-			mutex.RUnlock()
+			run := func(ops store_ops, out *bufio.Writer) {
+				value, ok := ops.get(req_key)
 
-			if ok == false || value.timestamp < time.Now().Unix() {
-				message := "ERRNOTFOUND\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
-				break
-			} else {
+				if ok == false {
+					message := "ERRNOTFOUND\r\n"
+					out.WriteString(message)
+				} else {
 
-				var diff_expiry int64
-				diff_expiry = (value.timestamp - time.Now().Unix())
-				message := "VALUE" + " " + strconv.FormatInt(value.version, 10) + " " + strconv.FormatInt(diff_expiry, 10) + " " + strconv.Itoa(value.numbytes) + "\r\n"
+					message := "VALUE" + " " + strconv.FormatInt(value.version, 10) + " " + format_expiry(value) + " " + strconv.Itoa(value.numbytes) + "\r\n"
 
-				message = message + value.value + "\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
+					out.Write(append(append([]byte(message), value.value...), "\r\n"...))
+				}
+			}
+			run = cluster.serve([]string{req_key}, asked, true, run)
+			if tx.add(run, 0) {
+				writer.WriteString("QUEUED\r\n")
+				break
+			}
+			if ops, err := read_ops(); err != nil {
+				writer.WriteString(error_message(err))
+			} else {
+				run(ops, writer)
 			}
 
 		case "cas":
@@ -354,14 +580,13 @@ func handleconnection(con net.Conn) {
 			var key string
 			var numbytes int
 			var version int64
-			var expirytime int
-			var value string
+			var expirytime time.Duration
 			var err_cmd bool
 			err_cmd = false
 
 			if len(res) != 5 && len(res) != 6 {
 				message := "ERRCMDERR\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
+				writer.WriteString(message)
 				break
 			}
 
@@ -370,7 +595,7 @@ func handleconnection(con net.Conn) {
 			if len(res) == 6 {
 				if res[5] != "noreply\r\n" {
 					message := "ERRCMDERR\r\n"
-					io.Copy(con, bytes.NewBufferString(message))
+					writer.WriteString(message)
 					break
 				} else {
 					reply_flag = false
@@ -379,22 +604,15 @@ func handleconnection(con net.Conn) {
 
 			if res[1] == "" {
 				message := "ERRCMDERR\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
+				writer.WriteString(message)
 			} else {
 				key = strings.TrimSpace(res[1])
 
-				if len(key) > 250 {
+				if valid_key(key) == false {
 					err_cmd = true
 				}
-				if _, err := strconv.Atoi(res[2]); err == nil {
-
-					temp_expirytime, _ := strconv.Atoi(res[2])
-
-					if temp_expirytime >= 0 {
-						expirytime = temp_expirytime
-					} else {
-						err_cmd = true
-					}
+				if temp_expirytime, ok := parse_expiry(res[2]); ok == true {
+					expirytime = temp_expirytime
 				} else {
 					err_cmd = true
 				}
@@ -426,94 +644,52 @@ func handleconnection(con net.Conn) {
 					err_cmd = true
 				}
 
-				data, error := reader.ReadBytes('\n')
+				value, value_ok, error := read_value(reader, numbytes)
 
 				if error != nil {
 					message := "ERR_INTERNAL\r\n"
-					io.Copy(con, bytes.NewBufferString(message))
+					writer.WriteString(message)
 					break
 				}
-				value = string(data)
 
 				if err_cmd == true {
 					message := "ERRCMDERR\r\n"
-					io.Copy(con, bytes.NewBufferString(message))
+					writer.WriteString(message)
 					break
 
 				}
 
-				if len(value) == (numbytes + 2) {
-
-					value = strings.TrimSpace(value)
-					mutex.Lock()
-					_, ok := memmap[key]
-
-					if ok == true {
-						if memmap[key].version == version {
-
-							if memmap[key].timestamp < time.Now().Unix() {
-								if reply_flag == true {
-									message := "ERRNOTFOUND\r\n"
-									io.Copy(con, bytes.NewBufferString(message))
-								}
-
-								mutex.Unlock()
-								break
-
-							}
-							cur_ts := time.Now().Unix()
-							new_exp := time.Now().Unix() + int64(expirytime)
-							memmap[key] = mapval{expirytime, memmap[key].version + 1, numbytes, value, new_exp}
-
-							//Below if will add key to expiry heap
-
-							if expirytime != 0 {
-
-								item := &exp_struct{
-									value:    key,
-									priority: new_exp,
-									init_ts:  cur_ts,
-								}
+				if value_ok == true {
 
-								heap.Push(&exp_heap, item)
-
-							}
-						} else {
+					run := func(ops store_ops, out *bufio.Writer) {
+						new_version, err := ops.cas(key, expirytime, version, value)
+						if err != nil {
 							if reply_flag == true {
-								message := "ERR_VERSION\r\n"
-								io.Copy(con, bytes.NewBufferString(message))
+								message := error_message(err)
+								out.WriteString(message)
 							}
-
-							mutex.Unlock()
-							break
-
+							return
 						}
 
-					} else {
 						if reply_flag == true {
-							message := "ERRNOTFOUND\r\n"
-							io.Copy(con, bytes.NewBufferString(message))
-						}
+							message := "OK "
+							message = message + strconv.FormatInt(new_version, 10) + "\r\n"
 
-						mutex.Unlock()
-						break
+							out.WriteString(message)
 
+						}
 					}
-
-					if reply_flag == true {
-						message := "OK "
-						message = message + strconv.FormatInt(memmap[key].version, 10) + "\r\n"
-
-						io.Copy(con, bytes.NewBufferString(message))
-						mutex.Unlock()
+					run = cluster.serve([]string{key}, asked, reply_flag, run)
+					if tx.add(run, len(key)+len(value)+entry_overhead) {
+						writer.WriteString("QUEUED\r\n")
 						break
-
 					}
+					run(client_ops(), writer)
 				} else {
 
 					if reply_flag == true {
 						message := "ERRCMDERR\r\n"
-						io.Copy(con, bytes.NewBufferString(message))
+						writer.WriteString(message)
 					}
 				}
 
@@ -522,55 +698,775 @@ func handleconnection(con net.Conn) {
 
 			if len(res) != 2 {
 				message := "ERRCMDERR\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
+				writer.WriteString(message)
+				break
+			}
+
+			req_key := strings.TrimSpace(res[1])
+
+			run := func(ops store_ops, out *bufio.Writer) {
+				if err := ops.delete(req_key); err != nil {
+					message := error_message(err)
+					out.WriteString(message)
+					return
+				}
+				message := "DELETED\r\n"
+				out.WriteString(message)
+			}
+			run = cluster.serve([]string{req_key}, asked, true, run)
+			if tx.add(run, 0) {
+				writer.WriteString("QUEUED\r\n")
+				break
+			}
+			run(client_ops(), writer)
+
+		case "incr", "decr":
+
+			reply_flag := true
+			args, ok := parse_keys(res[1:])
+			if ok == true && len(args) > 0 && args[len(args)-1] == "noreply" {
+				reply_flag = false
+				args = args[:len(args)-1]
+			}
+			if ok == false || (len(args) != 2 && len(args) != 4) {
+				if reply_flag == true {
+					writer.WriteString("ERRCMDERR\r\n")
+				}
+				break
+			}
+
+			delta, err := strconv.ParseInt(args[1], 10, 64)
+			cmd_err := err != nil
+			create := len(args) == 4
+			var initial int64
+			var expirytime time.Duration
+			if create {
+				initial, err = strconv.ParseInt(args[2], 10, 64)
+				cmd_err = cmd_err || err != nil
+				var expiry_ok bool
+				expirytime, expiry_ok = parse_expiry(args[3])
+				cmd_err = cmd_err || expiry_ok == false
+			}
+			if cmd_err == true {
+				if reply_flag == true {
+					writer.WriteString("ERRCMDERR\r\n")
+				}
+				break
+			}
+
+			command := strings.TrimSpace(res[0])
+			run := func(ops store_ops, out *bufio.Writer) {
+				var value int64
+				err := errOverflow
+				if command == "incr" {
+					value, err = ops.incr(args[0], delta, create, initial, expirytime)
+				} else if delta != math.MinInt64 {
+					value, err = ops.incr(args[0], -delta, create, initial, expirytime)
+				}
+				if reply_flag == false {
+					return
+				}
+				if err != nil {
+					out.WriteString(error_message(err))
+					return
+				}
+				out.WriteString(strconv.FormatInt(value, 10) + "\r\n")
+			}
+			run = cluster.serve(args[:1], asked, reply_flag, run)
+			if tx.add(run, len(args[0])+20+entry_overhead) {
+				writer.WriteString("QUEUED\r\n")
 				break
 			}
+			run(client_ops(), writer)
 
+		case "touch", "expire", "persist":
+
+			reply_flag := true
+			args, ok := parse_keys(res[1:])
+			if ok == true && len(args) > 0 && args[len(args)-1] == "noreply" {
+				reply_flag = false
+				args = args[:len(args)-1]
+			}
+			var expirytime time.Duration
+			if strings.TrimSpace(res[0]) == "persist" {
+				ok = ok && len(args) == 1
+			} else if ok = ok && len(args) == 2; ok == true {
+				expirytime, ok = parse_expiry(args[1])
+			}
+			if ok == false {
+				if reply_flag == true {
+					writer.WriteString("ERRCMDERR\r\n")
+				}
+				break
+			}
+
+			run := func(ops store_ops, out *bufio.Writer) {
+				value, err := ops.touch(args[0], expirytime)
+				if reply_flag == false {
+					return
+				}
+				if err != nil {
+					out.WriteString(error_message(err))
+					return
+				}
+				out.WriteString("OK " + strconv.FormatInt(value.version, 10) + "\r\n")
+			}
+			run = cluster.serve(args[:1], asked, reply_flag, run)
+			if tx.add(run, 0) {
+				writer.WriteString("QUEUED\r\n")
+				break
+			}
+			run(client_ops(), writer)
+
+		case "ttl":
+
+			if len(res) != 2 {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
 			req_key := strings.TrimSpace(res[1])
+			run := func(ops store_ops, out *bufio.Writer) {
+				value, ok := ops.get(req_key)
+				if ok == false {
+					out.WriteString("ERRNOTFOUND\r\n")
+					return
+				}
+				ttl := "-1"
+				if value.expirytime != 0 {
+					ttl = format_expiry(value)
+				}
+				out.WriteString("TTL " + ttl + "\r\n")
+			}
+			run = cluster.serve([]string{req_key}, asked, true, run)
+			if tx.add(run, 0) {
+				writer.WriteString("QUEUED\r\n")
+				break
+			}
+			if ops, err := read_ops(); err != nil {
+				writer.WriteString(error_message(err))
+			} else {
+				run(ops, writer)
+			}
+
+		case "scan":
+
+			args, ok := parse_keys(res[1:])
+			if tx.active == true {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+
+			/*
+				A single cursor, optionally followed by match, count or type, is an incremental scan of the whole key
+				space, otherwise the first two arguments are a range of keys
+			*/
+			if ok && len(args) >= 1 && (len(args) == 1 || args[1] == "match" || args[1] == "count" || args[1] == "type") {
+				match, type_name := "", ""
+				count := scan_default_count
+				for i := 1; ok && i < len(args); i += 2 {
+					switch {
+					case i+1 == len(args):
+						ok = false
+					case args[i] == "match":
+						match = args[i+1]
+					case args[i] == "type":
+						type_name = args[i+1]
+					case args[i] == "count":
+						n, err := strconv.Atoi(args[i+1])
+						count = n
+						ok = err == nil && n > 0 && n <= scan_max_limit
+					default:
+						ok = false
+					}
+				}
+				var keys []string
+				var cursor string
+				if ok {
+					keys, cursor, ok = kv.scan_cursor(args[0], match, count, type_name)
+				}
+				if ok == false {
+					writer.WriteString("ERRCMDERR\r\n")
+					break
+				}
+				for _, key := range keys {
+					writer.WriteString("KEY " + key + "\r\n")
+				}
+				writer.WriteString("END " + cursor + "\r\n")
+				break
+			}
 
-			mutex.Lock()
-			_, ok := memmap[req_key]
-			if ok == false || memmap[req_key].timestamp < time.Now().Unix() {
-				message := "ERRNOTFOUND\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
-				mutex.Unlock()
+			ok = ok && len(args) >= 2
+			limit := scan_default_limit
+			prefix := ""
+			with_values := false
+			for i := 2; ok && i < len(args); i++ {
+				switch {
+				case args[i] == "values":
+					with_values = true
+				case args[i] == "prefix" && i+1 < len(args):
+					prefix = args[i+1]
+					i++
+				case args[i] == "limit" && i+1 < len(args):
+					n, err := strconv.Atoi(args[i+1])
+					limit = n
+					ok = err == nil && n > 0 && n <= scan_max_limit
+					i++
+				default:
+					ok = false
+				}
+			}
+			if ok == false {
+				writer.WriteString("ERRCMDERR\r\n")
 				break
+			}
+
+			start, end := args[0], args[1]
+			if start == "-" {
+				start = ""
+			}
+			if end == "+" {
+				end = ""
+			}
+			entries, cursor := kv.scan(start, end, prefix, limit)
+			for _, entry := range entries {
+				if with_values {
+					message := "VALUE " + entry.key + " " + strconv.FormatInt(entry.val.version, 10) + " " + strconv.Itoa(entry.val.numbytes) + "\r\n"
+					writer.Write(append(append([]byte(message), entry.val.value...), "\r\n"...))
+				} else {
+					writer.WriteString("KEY " + entry.key + "\r\n")
+				}
+			}
+			if cursor != "" {
+				writer.WriteString("END " + cursor + "\r\n")
 			} else {
+				writer.WriteString("END\r\n")
+			}
 
-				delete(memmap, req_key)
-				message := "DELETED\r\n"
-				io.Copy(con, bytes.NewBufferString(message))
-				mutex.Unlock()
+		case "multi":
+
+			if len(res) != 1 || tx.active == true {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			tx.active = true
+			writer.WriteString("OK\r\n")
+
+		case "exec":
+
+			if len(res) != 1 || tx.active == false {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+
+			/*
+				The replies are collected in a buffer while the store is locked, so a slow client can't keep the
+				locks held
+			*/
+			var replies bytes.Buffer
+			out := bufio.NewWriter(&replies)
+			queued := tx.queued
+			err := kv.exec(tx.watched, tx.grow, func(ops store_ops) {
+				for _, run := range queued {
+					run(ops, out)
+				}
+			})
+			tx.reset()
+			if err != nil {
+				writer.WriteString(error_message(err))
+				break
+			}
+			out.Flush()
+			writer.WriteString("EXEC " + strconv.Itoa(len(queued)) + "\r\n")
+			writer.Write(replies.Bytes())
+
+		case "discard":
+
+			if len(res) != 1 || tx.active == false {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			tx.reset()
+			writer.WriteString("OK\r\n")
+
+		case "watch":
+
+			keys, ok := parse_keys(res[1:])
+			if ok == false || len(keys) == 0 || tx.active == true {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			if tx.watched == nil {
+				tx.watched = make(map[string]watched_key)
+			}
+			for _, key := range keys {
+				if _, ok := tx.watched[key]; ok == false {
+					tx.watched[key] = kv.watch_state(key)
+				}
+			}
+			writer.WriteString("OK\r\n")
+
+		case "unwatch":
+
+			if len(res) != 1 || tx.active == true {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			tx.watched = nil
+			writer.WriteString("OK\r\n")
+
+		case "eval":
+
+			if len(res) < 3 {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			numbytes, err := strconv.Atoi(strings.TrimSpace(res[1]))
+			if err != nil {
+				numbytes = 0
+			}
+			src, src_ok, err := read_value(reader, numbytes)
+			if err != nil {
+				writer.WriteString("ERR_INTERNAL\r\n")
+				break
+			}
+			keys, args, ok := parse_eval_args(res[2:])
+			if src_ok == false || ok == false {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			sc, err := load_script(src)
+			if err != nil {
+				writer.WriteString(error_message(err))
+				break
+			}
+			eval_script(&tx, writer, sc, keys, args, asked)
+
+		case "evalsha":
+
+			if len(res) < 3 {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			keys, args, ok := parse_eval_args(res[2:])
+			if ok == false {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			sc, err := cached_script(strings.TrimSpace(res[1]))
+			if err != nil {
+				writer.WriteString(error_message(err))
+				break
 			}
+			eval_script(&tx, writer, sc, keys, args, asked)
+
+		case "script":
+
+			args, ok := parse_keys(res[1:])
+			if ok == true && len(args) == 2 && args[0] == "load" {
+				numbytes, err := strconv.Atoi(args[1])
+				if err != nil {
+					numbytes = 0
+				}
+				src, src_ok, err := read_value(reader, numbytes)
+				if err != nil {
+					writer.WriteString("ERR_INTERNAL\r\n")
+					break
+				}
+				if src_ok == false {
+					writer.WriteString("ERRCMDERR\r\n")
+					break
+				}
+				sc, err := load_script(src)
+				if err != nil {
+					writer.WriteString(error_message(err))
+					break
+				}
+				writer.WriteString("SHA " + sc.sha + "\r\n")
+				break
+			}
+			if ok == true && len(args) == 1 && args[0] == "flush" {
+				flush_scripts()
+				writer.WriteString("OK\r\n")
+				break
+			}
+			writer.WriteString("ERRCMDERR\r\n")
+
+		case "subscribe", "psubscribe", "watchkeys":
+
+			names, ok := parse_keys(res[1:])
+			if ok == false || len(names) == 0 || tx.active == true {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+
+			/*
+				From here on the subscriber writes to the connection, after everything replied so far
+			*/
+			if writer.Flush() != nil {
+				read = false
+				break
+			}
+			sub = pubsub_command(con, nil, strings.TrimSpace(res[0]), names)
+
+		case "publish":
+
+			if len(res) != 3 {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			numbytes, err := strconv.Atoi(strings.TrimSpace(res[2]))
+			if err != nil {
+				numbytes = 0
+			}
+			payload, payload_ok, err := read_value(reader, numbytes)
+			if err != nil {
+				writer.WriteString("ERR_INTERNAL\r\n")
+				break
+			}
+			channel := strings.TrimSpace(res[1])
+			if payload_ok == false || channel == "" || tx.active == true {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			writer.WriteString("RECEIVERS " + strconv.Itoa(hub.publish(channel, payload)) + "\r\n")
+
+		case "changes":
+
+			if (len(res) != 3 && len(res) != 5) || res[1] != "since" || changelog == nil || tx.active == true {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			since, err := strconv.ParseUint(strings.TrimSpace(res[2]), 10, 64)
+			limit := 0
+			if err == nil && len(res) == 5 {
+				if res[3] != "limit" {
+					writer.WriteString("ERRCMDERR\r\n")
+					break
+				}
+				limit, err = strconv.Atoi(strings.TrimSpace(res[4]))
+			}
+			if err != nil || (len(res) == 5 && limit < 1) {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			read = changes_command(reader, writer, since, limit)
+
+		case "raftmsg":
+
+			if len(res) != 2 || raft_cluster == nil {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			numbytes, err := strconv.Atoi(strings.TrimSpace(res[1]))
+			if err != nil {
+				numbytes = 0
+			}
+			payload, payload_ok, err := read_block(reader, numbytes, raft_max_message)
+			if err != nil {
+				read = false
+				break
+			}
+			msg, err := decode_raft_message(payload)
+			if payload_ok == false || err != nil {
+				fmt.Printf("INT_ERR: Bad raft message from %s\n", con.RemoteAddr())
+				read = false
+				break
+			}
+			raft_cluster.step(msg)
+
+		case "raft":
+
+			if tx.active == true {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			args, ok := parse_keys(res[1:])
+			if ok == false {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			raft_admin_command(writer, args)
+
+		case "asking":
+
+			if len(res) != 1 || cluster == nil {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			asking = true
+			writer.WriteString("OK\r\n")
+
+		case "cluster":
+
+			args, ok := parse_keys(res[1:])
+			if ok == false || tx.active == true {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			read = cluster_command(cluster, kv, reader, writer, args)
+
+		case "sync":
+
+			if (len(res) != 1 && len(res) != 3) || changelog == nil || tx.active == true {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			field, log_id := "0", ""
+			if len(res) == 3 {
+				field, log_id = res[1], strings.TrimSpace(res[2])
+			}
+			since, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				writer.WriteString("ERRCMDERR\r\n")
+				break
+			}
+			read = sync_command(reader, writer, since, log_id)
+
+		case "save":
+
+			if len(res) != 1 || tx.active == true {
+				message := "ERRCMDERR\r\n"
+				writer.WriteString(message)
+				break
+			}
+
+			if _, err := save_snapshot(); err != nil {
+				fmt.Printf("INT_ERR: Saving snapshot: %s\n", err)
+				message := "ERR_INTERNAL\r\n"
+				writer.WriteString(message)
+				break
+			}
+			message := "SAVED\r\n"
+			writer.WriteString(message)
 
 		default:
 			message := "ERRCMDERR\r\n"
-			io.Copy(con, bytes.NewBufferString(message))
+			writer.WriteString(message)
 
 		}
 
+		/*
+			Replies are only flushed once every command already received has been answered, so a pipelining client
+			gets the replies to a whole batch in one write
+		*/
+		if reader.Buffered() == 0 {
+			if writer.Flush() != nil {
+				break
+			}
+		}
+
 	}
 
+	if sub != nil {
+		leave_pubsub(sub)
+	}
+	writer.Flush()
 	con.Close()
 }
 
+/*
+Command line configuration of the server
+*/
+var (
+	aof_path          string
+	aof_policy        string
+	snapshot_interval int
+	shards            int
+	max_memory        int64
+	max_memory_policy string
+	resp_addr         string
+	memcache_addr     string
+	http_addr         string
+	raft_members      string
+	raft_join         bool
+	raft_log_path     string
+	cluster_nodes     string
+	cluster_seed      string
+)
+
 func main() {
 	var (
 		host   = "127.0.0.1"
 		port   = "9000"
 		remote = host + ":" + port
 	)
+
+	flag.StringVar(&remote, "addr", remote, "address of the text protocol listener")
+	flag.StringVar(&aof_path, "aof", "", "path of the append only file, persistence is disabled when empty")
+	flag.StringVar(&aof_policy, "appendfsync", fsync_everysec, "when to fsync the append only file: always, everysec or no")
+	flag.StringVar(&snapshot_dir, "snapshot-dir", "", "directory for snapshot files, snapshots are disabled when empty")
+	flag.IntVar(&snapshot_interval, "snapshot-interval", 300, "seconds between background snapshots, 0 to only save on demand")
+	flag.IntVar(&shards, "shards", default_shards, "number of shards the key space is split into")
+	flag.Int64Var(&max_memory, "maxmemory", 0, "memory limit for keys and values in bytes, 0 for no limit")
+	flag.StringVar(&max_memory_policy, "maxmemory-policy", policy_noeviction, "what to do when the memory limit is reached: noeviction, allkeys-lru, allkeys-lfu or volatile-ttl")
+	flag.StringVar(&resp_addr, "resp-addr", "", "address for the RESP (Redis protocol) listener, disabled when empty")
+	flag.StringVar(&memcache_addr, "memcache-addr", "", "address for the memcached binary protocol listener, disabled when empty")
+	flag.StringVar(&http_addr, "http-addr", "", "address for the HTTP/JSON gateway, disabled when empty")
+	flag.IntVar(&script_max_steps, "script-max-steps", script_max_steps, "evaluation steps an eval script may take")
+	flag.IntVar(&script_timeout, "script-timeout", script_timeout, "milliseconds an eval script may run")
+	flag.IntVar(&script_max_memory, "script-max-memory", script_max_memory, "bytes of strings and lists an eval script may make")
+	flag.IntVar(&script_max_result, "script-max-result", script_max_result, "bytes of the largest string or list an eval script may make, and of its result")
+	flag.IntVar(&pubsub_buffer_limit, "pubsub-buffer-limit", pubsub_buffer_limit, "bytes of messages a subscriber may fall behind before it is disconnected")
+	flag.IntVar(&cdc_retention, "cdc-retention", cdc_retention, "changes kept for the changes command, 0 to disable the change log")
+	flag.IntVar(&cdc_retention_bytes, "cdc-retention-bytes", cdc_retention_bytes, "bytes of keys and values of the changes kept for the changes command")
+	flag.StringVar(&cdc_file, "cdc-file", "", "path of the file the change log is kept in across restarts, in memory only when empty")
+	flag.StringVar(&replica_of, "replicaof", "", "address of the leader to replicate as a read-only follower, empty for a leader")
+	flag.StringVar(&raft_members, "raft", "", "comma separated addresses of the members of a raft cluster this server starts, including its own -addr")
+	flag.BoolVar(&raft_join, "raft-join", false, "run as a raft node waiting to be added to a running cluster with raft add")
+	flag.StringVar(&raft_log_path, "raft-log", "", "path of the file a raft node keeps its term, vote, log and snapshot in, required with -raft and -raft-join")
+	flag.StringVar(&cluster_nodes, "cluster", "", "comma separated addresses of the servers of a partitioned cluster this server starts, splitting the hash slots between them in order")
+	flag.StringVar(&cluster_seed, "cluster-join", "", "address of a server of a running partitioned cluster to join, owning no slots until some are migrated here")
+	flag.Parse()
+
+	if !valid_policy(max_memory_policy) {
+		fmt.Printf("INT_ERR: Unknown maxmemory policy %s\n", max_memory_policy)
+		os.Exit(1)
+	}
+
+	/*
+		The store of a raft node is only written by applying the raft log, which doesn't go through the aof, so an
+		aof would silently miss every write. The raft log file is what keeps it instead.
+	*/
+	if aof_path != "" && (raft_members != "" || raft_join) {
+		fmt.Printf("INT_ERR: -aof can't be used with -raft, whose store is kept by the -raft-log\n")
+		os.Exit(1)
+	}
+	if raft_log_path == "" && (raft_members != "" || raft_join) {
+		fmt.Printf("INT_ERR: -raft and -raft-join need a -raft-log\n")
+		os.Exit(1)
+	}
+	kv = new_store(shards)
+	kv.max_memory = max_memory
+	kv.policy = max_memory_policy
+	changelog = new_change_log(cdc_retention, cdc_retention_bytes)
+
+	if changelog != nil && cdc_file != "" {
+		if error := changelog.open_file(cdc_file); error != nil {
+			fmt.Printf("INT_ERR: Opening change log: %s\n", error)
+			os.Exit(1)
+		}
+	}
+
+	if snapshot_dir != "" {
+		path, error := load_snapshot()
+		if error != nil {
+			fmt.Printf("INT_ERR: Loading snapshot: %s\n", error)
+			os.Exit(1)
+		}
+		if path != "" {
+			fmt.Printf("Loaded snapshot %s\n", path)
+		}
+	}
+
+	if aof_path != "" {
+		applied, error := replay_aof(aof_path)
+		if error != nil {
+			fmt.Printf("INT_ERR: Replaying aof: %s\n", error)
+			os.Exit(1)
+		}
+		fmt.Printf("Replayed %d records from %s\n", applied, aof_path)
+
+		aof, error = open_aof(aof_path, aof_policy)
+		if error != nil {
+			fmt.Printf("INT_ERR: Opening aof: %s\n", error)
+			os.Exit(1)
+		}
+	}
+
+	if replica_of != "" {
+		go follow(replica_of)
+	}
+
+	if raft_members != "" || raft_join {
+		if replica_of != "" {
+			fmt.Printf("INT_ERR: -replicaof can't be used with -raft\n")
+			os.Exit(1)
+		}
+		/*
+			Reads of the other protocols go to the store directly, without the read index of read_ops(), so they
+			could be stale
+		*/
+		if resp_addr != "" || memcache_addr != "" || http_addr != "" {
+			fmt.Printf("INT_ERR: A raft cluster is only served over the text protocol, without -resp-addr, -memcache-addr or -http-addr\n")
+			os.Exit(1)
+		}
+		var members []string
+		if raft_members != "" {
+			members = strings.Split(raft_members, ",")
+		}
+		if error := start_raft(remote, members, raft_log_path); error != nil {
+			fmt.Printf("INT_ERR: Opening raft log: %s\n", error)
+			os.Exit(1)
+		}
+	}
+
+	if cluster_nodes != "" || cluster_seed != "" {
+		if replica_of != "" || raft_members != "" || raft_join || resp_addr != "" || memcache_addr != "" || http_addr != "" {
+			fmt.Printf("INT_ERR: A partitioned cluster is only served over the text protocol, without -replicaof or -raft\n")
+			os.Exit(1)
+		}
+		if cluster_seed != "" {
+			if error := join_cluster(remote, cluster_seed); error != nil {
+				fmt.Printf("INT_ERR: Joining the cluster of %s: %s\n", cluster_seed, error)
+				os.Exit(1)
+			}
+		} else {
+			cluster = new_cluster_state(remote, strings.Split(cluster_nodes, ","))
+		}
+	}
+
+	if snapshot_dir != "" && snapshot_interval > 0 {
+		go periodic_snapshot(time.Duration(snapshot_interval) * time.Second)
+	}
+
+	if resp_addr != "" {
+		resp_lis, error := net.Listen("tcp", resp_addr)
+		if error != nil {
+			fmt.Printf("INT_ERR: Listening on %s: %s\n", resp_addr, error)
+			os.Exit(1)
+		}
+		go serve_resp(resp_lis)
+	}
+
+	if memcache_addr != "" {
+		memcache_lis, error := net.Listen("tcp", memcache_addr)
+		if error != nil {
+			fmt.Printf("INT_ERR: Listening on %s: %s\n", memcache_addr, error)
+			os.Exit(1)
+		}
+		go serve_memcache(memcache_lis)
+	}
+
+	if http_addr != "" {
+		http_lis, error := net.Listen("tcp", http_addr)
+		if error != nil {
+			fmt.Printf("INT_ERR: Listening on %s: %s\n", http_addr, error)
+			os.Exit(1)
+		}
+		go serve_http(http_lis)
+	}
+
 	lis, error := net.Listen("tcp", remote)
-	defer lis.Close()
 	if error != nil {
 		os.Exit(1)
 	}
+	defer lis.Close()
+
+	serve(lis)
+}
+
+/*
+serve() starts the expiry check and handles every connection accepted on lis
+*/
+func serve(lis net.Listener) {
 
-	heap.Init(&exp_heap)
 	go periodic_expiry_check()
 	for {
 
 		con, error := lis.Accept()
+		if errors.Is(error, net.ErrClosed) {
+			return
+		}
 		if error != nil {
 			fmt.Printf("INT_ERR: Accepting data: %s\n", error)
 			continue
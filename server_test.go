@@ -3,11 +3,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"io"
 	"net"
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -17,7 +20,11 @@ var noOfRequestsPerThread int = 50
 var commands []string
 
 func init() {
-	go main()
+	lis, err := net.Listen("tcp", "127.0.0.1:9000")
+	if err != nil {
+		panic(err)
+	}
+	go serve(lis)
 }
 
 /*
@@ -497,3 +504,911 @@ func CheckConcurrentMulti(t *testing.T, done chan bool) {
 	
 	}
 
+
+/*
+TestBinaryValues() stores a value containing \r\n, spaces and NUL bytes with set and cas and checks that get and getm
+return it byte for byte
+*/
+func TestBinaryValues(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	value := " line1\r\nline2\n\x00\xff "
+	io.Copy(conn, bytes.NewBufferString("set binkey 0 "+strconv.Itoa(len(value))+"\r\n"+value+"\r\n"))
+	data, _ := reader.ReadBytes('\n')
+	if string(data) != "OK 0\r\n" {
+		t.Fatalf("set replied %q", data)
+	}
+
+	io.Copy(conn, bytes.NewBufferString("get binkey\r\n"))
+	data, _ = reader.ReadBytes('\n')
+	if string(data) != "VALUE "+strconv.Itoa(len(value))+"\r\n" {
+		t.Fatalf("get replied %q", data)
+	}
+	block := make([]byte, len(value)+2)
+	io.ReadFull(reader, block)
+	if string(block) != value+"\r\n" {
+		t.Errorf("get returned %q", block)
+	}
+
+	value = "\r\n\r\n"
+	io.Copy(conn, bytes.NewBufferString("cas binkey 0 0 4\r\n"+value+"\r\n"))
+	data, _ = reader.ReadBytes('\n')
+	if string(data) != "OK 1\r\n" {
+		t.Fatalf("cas replied %q", data)
+	}
+
+	io.Copy(conn, bytes.NewBufferString("getm binkey\r\n"))
+	data, _ = reader.ReadBytes('\n')
+	if string(data) != "VALUE 1 0 4\r\n" {
+		t.Fatalf("getm replied %q", data)
+	}
+	block = make([]byte, 6)
+	io.ReadFull(reader, block)
+	if string(block) != value+"\r\n" {
+		t.Errorf("getm returned %q", block)
+	}
+
+	/*
+		A block which is not followed by \r\n is rejected
+	*/
+	io.Copy(conn, bytes.NewBufferString("set binkey 0 2\r\nabc\r\n"))
+	data, _ = reader.ReadBytes('\n')
+	if string(data) != "ERRCMDERR\r\n" {
+		t.Errorf("short numbytes replied %q", data)
+	}
+}
+
+/*
+TestOversizedValue() sends lengths far too large for a value, which must neither be allocated nor take the server down,
+and checks that a block over the limit is discarded so the next command is read
+*/
+func TestOversizedValue(t *testing.T) {
+	huge, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer huge.Close()
+	io.Copy(huge, bytes.NewBufferString("set bigkey 0 9223372036854775807\r\n"))
+	big, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer big.Close()
+	io.Copy(big, bytes.NewBufferString("cas bigkey 0 0 1000000000000\r\n"))
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	io.Copy(conn, bytes.NewBufferString("set bigkey 0 1\r\nx\r\nget bigkey\r\n"))
+	for _, want := range []string{"OK ", "VALUE 1\r\n", "x\r\n"} {
+		if data, _ := reader.ReadBytes('\n'); strings.HasPrefix(string(data), want) == false {
+			t.Fatalf("server replied %q, want %q", data, want)
+		}
+	}
+
+	block := bufio.NewReader(bytes.NewBufferString("abcdef\r\nget bigkey\r\n"))
+	if _, ok, err := read_block(block, 6, 4); ok || err != nil {
+		t.Errorf("block over the limit read, ok %v, %v", ok, err)
+	}
+	if line, _ := block.ReadString('\n'); line != "get bigkey\r\n" {
+		t.Errorf("next line after the discarded block = %q", line)
+	}
+}
+
+/*
+TestPipelining() sends a batch of commands in a single write and checks that every reply comes back in order
+*/
+func TestPipelining(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	batch := "delete pipekey\r\n"
+	want := []string{}
+	for i := 0; i < 100; i++ {
+		batch += "set pipekey 0 5\r\nmayur\r\nget pipekey\r\n"
+		want = append(want, "OK "+strconv.Itoa(i)+"\r\n", "VALUE 5\r\n", "mayur\r\n")
+	}
+	batch += "bogus\r\ndelete pipekey\r\n"
+	want = append(want, "ERRCMDERR\r\n", "DELETED\r\n")
+	io.Copy(conn, bytes.NewBufferString(batch))
+
+	reader.ReadBytes('\n')
+	for i, line := range want {
+		data, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != line {
+			t.Fatalf("reply %d = %q, want %q", i, data, line)
+		}
+	}
+}
+
+/*
+BenchmarkPipelined() measures set+get round trips over one connection with depth set+get pairs written per batch
+*/
+func BenchmarkPipelined(b *testing.B) {
+	for _, depth := range []int{1, 16, 128} {
+		b.Run("depth"+strconv.Itoa(depth), func(b *testing.B) {
+			conn, err := net.Dial("tcp", "127.0.0.1:9000")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			batch := []byte(strings.Repeat("set benchpipe 0 5\r\nmayur\r\nget benchpipe\r\n", depth))
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n += depth {
+				conn.Write(batch)
+				for i := 0; i < depth; i++ {
+					reader.ReadBytes('\n')
+					reader.ReadBytes('\n')
+					reader.ReadBytes('\n')
+				}
+			}
+		})
+	}
+}
+
+/*
+TestMultiGet() reads several keys, some missing, with one get and one getm and checks the tagged VALUE blocks
+*/
+func TestMultiGet(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	io.Copy(conn, bytes.NewBufferString("set multikey1 0 5\r\nmayur\r\nset multikey2 0 4\r\nkale\r\ndelete multikey3\r\n"))
+	for i := 0; i < 3; i++ {
+		reader.ReadBytes('\n')
+	}
+
+	io.Copy(conn, bytes.NewBufferString("get multikey1 multikey3 multikey2\r\ngetm multikey2 multikey1\r\nget multikey3 multikey3\r\n"))
+	want := []string{
+		"VALUE multikey1 5\r\n", "mayur\r\n",
+		"VALUE multikey2 4\r\n", "kale\r\n",
+		"END\r\n",
+		"VALUE multikey2 0 0 4\r\n", "kale\r\n",
+		"VALUE multikey1 0 0 5\r\n", "mayur\r\n",
+		"END\r\n",
+		"END\r\n",
+	}
+	for i, line := range want {
+		data, _ := reader.ReadBytes('\n')
+		if string(data) != line {
+			t.Fatalf("line %d = %q, want %q", i, data, line)
+		}
+	}
+}
+
+/*
+TestCounters() checks incr and decr on existing, missing, non numeric and expiring keys
+*/
+func TestCounters(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	io.Copy(conn, bytes.NewBufferString("delete ctrkey\r\ndelete ctrnew\r\nset ctrtext 0 5\r\nmayur\r\nset ctrkey 100 2\r\n10\r\n"))
+	for i := 0; i < 4; i++ {
+		reader.ReadBytes('\n')
+	}
+
+	requests := []string{
+		"incr ctrkey 5\r\n",
+		"decr ctrkey 20\r\n",
+		"incr ctrkey 1 noreply\r\n",
+		"getm ctrkey\r\n",
+		"incr ctrmissing 1\r\n",
+		"incr ctrnew 3 7 0\r\n",
+		"incr ctrnew 3 7 0\r\n",
+		"incr ctrtext 1\r\n",
+		"incr ctrkey 9223372036854775807\r\n",
+		"incr ctrkey abc\r\n",
+		"decr ctrkey\r\n",
+	}
+	want := []string{
+		"15\r\n",
+		"-5\r\n",
+		"VALUE 3 100 2\r\n", "-4\r\n",
+		"ERRNOTFOUND\r\n",
+		"7\r\n",
+		"10\r\n",
+		"ERR_NOTINT\r\n",
+		"9223372036854775803\r\n",
+		"ERRCMDERR\r\n",
+		"ERRCMDERR\r\n",
+	}
+	io.Copy(conn, bytes.NewBufferString("delete ctrmissing\r\n"))
+	reader.ReadBytes('\n')
+	io.Copy(conn, bytes.NewBufferString(strings.Join(requests, "")))
+	for i, line := range want {
+		data, _ := reader.ReadBytes('\n')
+		if string(data) != line && !(i == 2 && string(data) == "VALUE 3 99 2\r\n") {
+			t.Fatalf("line %d = %q, want %q", i, data, line)
+		}
+	}
+}
+
+/*
+TestConditionalWrites() checks add, replace, append and prepend including the errors for existing and missing keys
+*/
+func TestConditionalWrites(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	io.Copy(conn, bytes.NewBufferString("delete condkey\r\ndelete condmissing\r\n"))
+	reader.ReadBytes('\n')
+	reader.ReadBytes('\n')
+
+	requests := []string{
+		"replace condkey 0 5\r\nmayur\r\n",
+		"add condkey 100 5\r\nmayur\r\n",
+		"add condkey 0 4\r\nkale\r\n",
+		"append condkey 0 5\r\n kale\r\n",
+		"prepend condkey 0 1\r\n>\r\n",
+		"getm condkey\r\n",
+		"replace condkey 0 4\r\nkale\r\n",
+		"get condkey\r\n",
+		"append condmissing 0 1\r\nx\r\n",
+		"prepend condmissing 0 1 noreply\r\nx\r\n",
+		"append condkey 0 x\r\nx\r\n",
+	}
+	want := []string{
+		"ERRNOTFOUND\r\n",
+		"OK 0\r\n",
+		"ERR_EXISTS\r\n",
+		"OK 1\r\n",
+		"OK 2\r\n",
+		"VALUE 2 100 11\r\n", ">mayur kale\r\n",
+		"OK 3\r\n",
+		"VALUE 4\r\n", "kale\r\n",
+		"ERRNOTFOUND\r\n",
+		"ERRCMDERR\r\n",
+	}
+	io.Copy(conn, bytes.NewBufferString(strings.Join(requests, "")))
+	for i, line := range want {
+		data, _ := reader.ReadBytes('\n')
+		if string(data) != line && !(i == 5 && string(data) == "VALUE 2 99 11\r\n") {
+			t.Fatalf("line %d = %q, want %q", i, data, line)
+		}
+	}
+}
+
+/*
+TestTtlCommands() changes the expiry time of a key with touch, expire and persist and reads it back with ttl
+*/
+func TestTtlCommands(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	io.Copy(conn, bytes.NewBufferString("delete ttlmissing\r\nset ttlkey 0 5\r\nmayur\r\n"))
+	reader.ReadBytes('\n')
+	reader.ReadBytes('\n')
+
+	requests := []string{
+		"ttl ttlkey\r\n",
+		"touch ttlkey 1000\r\n",
+		"ttl ttlkey\r\n",
+		"expire ttlkey 2000 noreply\r\n",
+		"ttl ttlkey\r\n",
+		"persist ttlkey\r\n",
+		"ttl ttlkey\r\n",
+		"get ttlkey\r\n",
+		"touch ttlmissing 10\r\n",
+		"ttl ttlmissing\r\n",
+		"touch ttlkey -1\r\n",
+		"persist\r\n",
+	}
+	want := []string{
+		"TTL -1\r\n",
+		"OK 1\r\n",
+		"TTL 1000\r\n",
+		"TTL 2000\r\n",
+		"OK 3\r\n",
+		"TTL -1\r\n",
+		"VALUE 5\r\n", "mayur\r\n",
+		"ERRNOTFOUND\r\n",
+		"ERRNOTFOUND\r\n",
+		"ERRCMDERR\r\n",
+		"ERRCMDERR\r\n",
+	}
+	io.Copy(conn, bytes.NewBufferString(strings.Join(requests, "")))
+	for i, line := range want {
+		data, _ := reader.ReadBytes('\n')
+		/*
+			A second may pass between touch and ttl
+		*/
+		if line == "TTL 1000\r\n" && string(data) == "TTL 999\r\n" || line == "TTL 2000\r\n" && string(data) == "TTL 1999\r\n" {
+			continue
+		}
+		if string(data) != line {
+			t.Fatalf("line %d = %q, want %q", i, data, line)
+		}
+	}
+}
+
+/*
+TestMillisecondExpiry() sets keys with millisecond and absolute expiry times and checks what getm reports and that
+they expire on time
+*/
+func TestMillisecondExpiry(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	in_100s := strconv.FormatInt(time.Now().Unix()+100, 10)
+	past_ms := strconv.FormatInt(time.Now().UnixMilli()-1000, 10)
+	io.Copy(conn, bytes.NewBufferString("set mskey 300ms 5\r\nmayur\r\nset abskey "+in_100s+" 4\r\nkale\r\nset pastkey "+past_ms+"ms 4\r\nkale\r\n"))
+	for i := 0; i < 3; i++ {
+		reader.ReadBytes('\n')
+	}
+
+	io.Copy(conn, bytes.NewBufferString("getm mskey\r\n"))
+	data, _ := reader.ReadBytes('\n')
+	reader.ReadBytes('\n')
+	fields := strings.Fields(string(data))
+	left, err := strconv.Atoi(strings.TrimSuffix(fields[2], "ms"))
+	if len(fields) != 4 || !strings.HasSuffix(fields[2], "ms") || err != nil || left <= 0 || left > 300 {
+		t.Errorf("getm of a millisecond key replied %q", data)
+	}
+
+	io.Copy(conn, bytes.NewBufferString("ttl abskey\r\nget pastkey\r\n"))
+	data, _ = reader.ReadBytes('\n')
+	left, err = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(string(data), "TTL "), "ms\r\n"))
+	if err != nil || left <= 98000 || left > 100000 {
+		t.Errorf("ttl of an absolute expiry replied %q", data)
+	}
+	data, _ = reader.ReadBytes('\n')
+	if string(data) != "ERRNOTFOUND\r\n" {
+		t.Errorf("key with an absolute expiry in the past replied %q", data)
+	}
+
+	time.Sleep(350 * time.Millisecond)
+	io.Copy(conn, bytes.NewBufferString("get mskey\r\n"))
+	data, _ = reader.ReadBytes('\n')
+	if string(data) != "ERRNOTFOUND\r\n" {
+		t.Errorf("millisecond key was still there after it expired: %q", data)
+	}
+}
+
+/*
+TestScan() lists keys with the scan command, with and without values, and follows its cursor
+*/
+func TestScan(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	io.Copy(conn, bytes.NewBufferString("set scan:a 0 1\r\na\r\nset scan:b 0 1\r\nb\r\nset scan:c 0 1\r\nc\r\nset scanz 0 1\r\nz\r\n"))
+	for i := 0; i < 4; i++ {
+		reader.ReadBytes('\n')
+	}
+
+	requests := []string{
+		"scan - + prefix scan: limit 2\r\n",
+		"scan scan:c + prefix scan: limit 2\r\n",
+		"scan scan:b scanz values\r\n",
+		"scan a\r\n",
+		"scan - + limit 0\r\n",
+	}
+	want := []string{
+		"KEY scan:a\r\n", "KEY scan:b\r\n", "END scan:c\r\n",
+		"KEY scan:c\r\n", "END\r\n",
+		"VALUE scan:b 0 1\r\n", "b\r\n", "VALUE scan:c 0 1\r\n", "c\r\n", "END\r\n",
+		"ERRCMDERR\r\n",
+		"ERRCMDERR\r\n",
+	}
+	io.Copy(conn, bytes.NewBufferString(strings.Join(requests, "")))
+	for i, line := range want {
+		data, _ := reader.ReadBytes('\n')
+		if string(data) != line {
+			t.Fatalf("line %d = %q, want %q", i, data, line)
+		}
+	}
+}
+
+/*
+TestCursorScan() walks the key space with cursor scans and a match pattern, and checks that a scan with a range is
+still a range scan
+*/
+func TestCursorScan(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for i := 0; i < 30; i++ {
+		io.Copy(conn, bytes.NewBufferString("set cursorscan:"+strconv.Itoa(i)+" 0 1\r\nx\r\n"))
+		reader.ReadBytes('\n')
+	}
+
+	seen := make(map[string]bool)
+	cursor := "0"
+	for steps := 0; steps == 0 || cursor != "0"; steps++ {
+		if steps > 10000 {
+			t.Fatal("scan did not finish")
+		}
+		io.Copy(conn, bytes.NewBufferString("scan "+cursor+" match cursorscan:* count 50\r\n"))
+		for {
+			data, _ := reader.ReadBytes('\n')
+			line := strings.TrimSuffix(string(data), "\r\n")
+			if strings.HasPrefix(line, "KEY cursorscan:") {
+				seen[line[4:]] = true
+				continue
+			}
+			if !strings.HasPrefix(line, "END ") {
+				t.Fatalf("unexpected reply %q", data)
+			}
+			cursor = line[4:]
+			break
+		}
+	}
+	if len(seen) != 30 {
+		t.Errorf("scan returned %d of 30 keys", len(seen))
+	}
+
+	io.Copy(conn, bytes.NewBufferString("scan 0 count 0\r\nscan 0 match\r\nscan 0 type hash count 10000\r\nscan\r\n"))
+	io.Copy(conn, bytes.NewBufferString("scan cursorscan:1 cursorscan:10\r\n"))
+	for i, line := range []string{"ERRCMDERR\r\n", "ERRCMDERR\r\n", "END 0\r\n", "ERRCMDERR\r\n", "KEY cursorscan:1\r\n", "END\r\n"} {
+		data, _ := reader.ReadBytes('\n')
+		if string(data) != line {
+			t.Fatalf("line %d = %q, want %q", i, data, line)
+		}
+	}
+}
+
+/*
+TestTransactions() runs multi/exec, discard and a watch which aborts exec because another client wrote the key
+*/
+func TestTransactions(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	other, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other_reader := bufio.NewReader(other)
+
+	check := func(r *bufio.Reader, want ...string) {
+		t.Helper()
+		for i, line := range want {
+			data, _ := r.ReadBytes('\n')
+			if string(data) != line {
+				t.Fatalf("line %d = %q, want %q", i, data, line)
+			}
+		}
+	}
+
+	io.Copy(conn, bytes.NewBufferString("set txa 0 3\r\n100\r\nset txb 0 1\r\n0\r\n"))
+	check(reader, "OK 0\r\n", "OK 0\r\n")
+
+	io.Copy(conn, bytes.NewBufferString("multi\r\ndecr txa 30\r\nincr txb 30\r\nget txa\r\nscan 0\r\nexec\r\n"))
+	check(reader, "OK\r\n", "QUEUED\r\n", "QUEUED\r\n", "QUEUED\r\n", "ERRCMDERR\r\n", "EXEC 3\r\n", "70\r\n", "30\r\n", "VALUE 2\r\n", "70\r\n")
+
+	io.Copy(conn, bytes.NewBufferString("multi\r\nset txa 0 1\r\n0\r\ndiscard\r\nget txa\r\nexec\r\n"))
+	check(reader, "OK\r\n", "QUEUED\r\n", "OK\r\n", "VALUE 2\r\n", "70\r\n", "ERRCMDERR\r\n")
+
+	io.Copy(conn, bytes.NewBufferString("watch txa txb\r\nmulti\r\ndecr txa 10\r\nincr txb 10\r\n"))
+	check(reader, "OK\r\n", "OK\r\n", "QUEUED\r\n", "QUEUED\r\n")
+	io.Copy(other, bytes.NewBufferString("incr txb 1\r\n"))
+	check(other_reader, "31\r\n")
+	io.Copy(conn, bytes.NewBufferString("exec\r\nget txa\r\n"))
+	check(reader, "ERR_VERSION\r\n", "VALUE 2\r\n", "70\r\n")
+
+	io.Copy(conn, bytes.NewBufferString("watch txa\r\nmulti\r\nmulti\r\ncas txa 0 5 2\r\n50\r\nexec\r\n"))
+	check(reader, "OK\r\n", "OK\r\n", "ERRCMDERR\r\n", "QUEUED\r\n", "EXEC 1\r\n", "ERR_VERSION\r\n")
+}
+
+/*
+TestEval() runs a script with eval, loads it and runs it again with evalsha
+*/
+func TestEval(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	src := `(set (nth KEYS 0) (str (nth ARGV 0) (nth ARGV 1))) (get (nth KEYS 0))`
+	sum := sha1.Sum([]byte(src))
+	sha := hex.EncodeToString(sum[:])
+	requests := []string{
+		"eval " + strconv.Itoa(len(src)) + " 1 evalkey mayur kale\r\n" + src + "\r\n",
+		"script load " + strconv.Itoa(len(src)) + "\r\n" + src + "\r\n",
+		"evalsha " + sha + " 1 evalkey2 a b\r\n",
+		"getm evalkey2\r\n",
+		"eval 7 0\r\n(error)\r\n",
+		"eval 7 2 onlyonekey\r\n(get 1)\r\n",
+		"script flush\r\n",
+		"evalsha " + sha + " 0\r\n",
+	}
+	want := []string{
+		"VALUE 9\r\n", "mayurkale\r\n",
+		"SHA " + sha + "\r\n",
+		"VALUE 2\r\n", "ab\r\n",
+		"VALUE 0 0 2\r\n", "ab\r\n",
+		"ERR_SCRIPT wrong number of arguments for error\r\n",
+		"ERRCMDERR\r\n",
+		"OK\r\n",
+		"ERR_NOSCRIPT\r\n",
+	}
+	io.Copy(conn, bytes.NewBufferString(strings.Join(requests, "")))
+	for i, line := range want {
+		data, _ := reader.ReadBytes('\n')
+		if string(data) != line {
+			t.Fatalf("line %d = %q, want %q", i, data, line)
+		}
+	}
+}
+
+/*
+TestPubSub() subscribes to a channel and a pattern, publishes from another connection and leaves push mode again
+*/
+func TestPubSub(t *testing.T) {
+	sub, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	sub_reader := bufio.NewReader(sub)
+
+	pub, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	pub_reader := bufio.NewReader(pub)
+
+	check := func(r *bufio.Reader, want ...string) {
+		t.Helper()
+		for i, line := range want {
+			data, _ := r.ReadBytes('\n')
+			if string(data) != line {
+				t.Fatalf("line %d = %q, want %q", i, data, line)
+			}
+		}
+	}
+
+	io.Copy(sub, bytes.NewBufferString("subscribe news sport\r\npsubscribe new*\r\nget x\r\n"))
+	check(sub_reader, "SUBSCRIBED news 1\r\n", "SUBSCRIBED sport 2\r\n", "PSUBSCRIBED new* 3\r\n", "ERRCMDERR\r\n")
+
+	io.Copy(pub, bytes.NewBufferString("publish news 5\r\nhello\r\npublish newer 3\r\nabc\r\npublish weather 1\r\nx\r\n"))
+	check(pub_reader, "RECEIVERS 2\r\n", "RECEIVERS 1\r\n", "RECEIVERS 0\r\n")
+
+	messages := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		header, _ := sub_reader.ReadBytes('\n')
+		payload, _ := sub_reader.ReadBytes('\n')
+		messages[string(header)+string(payload)] = true
+	}
+	for _, msg := range []string{"MESSAGE news 5\r\nhello\r\n", "PMESSAGE new* news 5\r\nhello\r\n", "PMESSAGE new* newer 3\r\nabc\r\n"} {
+		if messages[msg] == false {
+			t.Errorf("%q was not received, got %v", msg, messages)
+		}
+	}
+
+	io.Copy(sub, bytes.NewBufferString("unsubscribe\r\npunsubscribe\r\nset pubsubkey 0 1\r\nx\r\n"))
+	check(sub_reader, "UNSUBSCRIBED news 2\r\n", "UNSUBSCRIBED sport 1\r\n", "PUNSUBSCRIBED new* 0\r\n", "OK 0\r\n")
+}
+
+/*
+TestWatchKeys() watches a key and a prefix from one connection while another writes them, including an expiry
+*/
+func TestWatchKeys(t *testing.T) {
+	watcher, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	watch_reader := bufio.NewReader(watcher)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	check := func(r *bufio.Reader, want ...string) {
+		t.Helper()
+		for i, line := range want {
+			data, _ := r.ReadBytes('\n')
+			if string(data) != line {
+				t.Fatalf("line %d = %q, want %q", i, data, line)
+			}
+		}
+	}
+
+	io.Copy(watcher, bytes.NewBufferString("watchkeys watched watchedprefix:*\r\n"))
+	check(watch_reader, "WATCHING watched 1\r\n", "WATCHING watchedprefix:* 2\r\n")
+
+	io.Copy(conn, bytes.NewBufferString("set watched 0 1\r\na\r\ncas watched 0 0 1\r\nb\r\nset unwatched 0 1\r\na\r\ndelete watched\r\nset watchedprefix:1 100ms 1\r\na\r\n"))
+	check(reader, "OK 0\r\n", "OK 1\r\n", "OK 0\r\n", "DELETED\r\n", "OK 0\r\n")
+	check(watch_reader, "EVENT set watched 0\r\n", "EVENT cas watched 1\r\n", "EVENT delete watched 1\r\n", "EVENT set watchedprefix:1 0\r\n")
+
+	/*
+		A key which would break the EVENT line is never stored, so the next event is the expiry
+	*/
+	io.Copy(conn, bytes.NewBufferString("set watchedprefix:a\rb 0 1\r\na\r\nset watchedprefix:a\tb 0 1\r\na\r\n"))
+	check(reader, "ERRCMDERR\r\n", "ERRCMDERR\r\n")
+
+	watcher.SetReadDeadline(time.Now().Add(2 * time.Second))
+	check(watch_reader, "EVENT expired watchedprefix:1 0\r\n")
+
+	io.Copy(watcher, bytes.NewBufferString("unwatchkeys\r\nget watched\r\n"))
+	check(watch_reader, "UNWATCHING watched 1\r\n", "UNWATCHING watchedprefix:* 0\r\n", "ERRNOTFOUND\r\n")
+}
+
+/*
+TestChanges() reads the changes of a few writes with a limit, resumes from the position it was given, follows a stream
+of new changes and checks that a position which is no longer retained is reported as behind
+*/
+func TestChanges(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	/*
+		Only changes of this test's keys are checked, as keys of the other tests may expire meanwhile
+	*/
+	next := func(r *bufio.Reader) string {
+		t.Helper()
+		for {
+			data, err := r.ReadBytes('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line := string(data)
+			if strings.HasPrefix(line, "CHANGE ") == false || strings.Contains(line, " changes:") {
+				return line
+			}
+		}
+	}
+	fields := func(line string) []string {
+		return strings.Fields(line)
+	}
+
+	changelog.mutex.Lock()
+	since := changelog.next - 1
+	changelog.mutex.Unlock()
+	pos := strconv.FormatUint(since, 10)
+
+	io.Copy(conn, bytes.NewBufferString("set changes:a 0 2\r\nv1\r\ncas changes:a 0 0 2\r\nv2\r\ndelete changes:a\r\n"))
+	for _, want := range []string{"OK 0\r\n", "OK 1\r\n", "DELETED\r\n"} {
+		if data, _ := reader.ReadBytes('\n'); string(data) != want {
+			t.Fatalf("got %q, want %q", data, want)
+		}
+	}
+
+	io.Copy(conn, bytes.NewBufferString("changes since "+pos+" limit 100000\r\n"))
+	set := fields(next(reader))
+	if len(set) != 7 || set[2] != "set" || set[3] != "changes:a" || set[4] != "0" || set[5] != "0" || set[6] != "2" {
+		t.Fatalf("set change = %v", set)
+	}
+	if data, _ := reader.ReadBytes('\n'); string(data) != "v1\r\n" {
+		t.Fatalf("set value = %q", data)
+	}
+	cas := fields(next(reader))
+	next(reader)
+	del := fields(next(reader))
+	if len(cas) != 7 || cas[2] != "cas" || len(del) != 5 || del[2] != "delete" || del[4] != "1" {
+		t.Fatalf("cas change = %v, delete change = %v", cas, del)
+	}
+	end := fields(next(reader))
+	if len(end) != 2 || end[0] != "END" {
+		t.Fatalf("end = %v", end)
+	}
+
+	/*
+		Resuming after the set only replies the later changes
+	*/
+	io.Copy(conn, bytes.NewBufferString("changes since "+set[1]+" limit 1\r\n"))
+	if line := fields(next(reader)); line[1] != cas[1] {
+		t.Errorf("resumed at %v, want %s", line, cas[1])
+	}
+	next(reader)
+	if line := next(reader); line != "END "+cas[1]+"\r\n" {
+		t.Errorf("end = %q", line)
+	}
+
+	io.Copy(conn, bytes.NewBufferString("changes since 99999999999 limit 1\r\nchanges until 1\r\n"))
+	if line := next(reader); strings.HasPrefix(line, "BEHIND ") == false {
+		t.Errorf("position ahead of the log = %q", line)
+	}
+	if line := next(reader); line != "ERRCMDERR\r\n" {
+		t.Errorf("changes without since = %q", line)
+	}
+
+	/*
+		A stream sends the changes made after it started
+	*/
+	stream, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream_reader := bufio.NewReader(stream)
+	io.Copy(stream, bytes.NewBufferString("changes since "+del[1]+"\r\n"))
+	time.Sleep(100 * time.Millisecond)
+	io.Copy(conn, bytes.NewBufferString("set changes:b 0 1\r\nx\r\n"))
+	reader.ReadBytes('\n')
+	stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if line := fields(next(stream_reader)); line[2] != "set" || line[3] != "changes:b" {
+		t.Errorf("streamed %v", line)
+	}
+
+	/*
+		A position dropped from the log is behind
+	*/
+	changelog.mutex.Lock()
+	limit := changelog.limit
+	changelog.limit = 1
+	changelog.mutex.Unlock()
+	defer func() {
+		changelog.mutex.Lock()
+		changelog.limit = limit
+		changelog.mutex.Unlock()
+	}()
+	io.Copy(conn, bytes.NewBufferString("set changes:c 0 1\r\nx\r\nchanges since "+pos+"\r\n"))
+	reader.ReadBytes('\n')
+	if line := next(reader); strings.HasPrefix(line, "BEHIND ") == false {
+		t.Errorf("dropped position = %q", line)
+	}
+}
+
+/*
+TestReplication() follows the server with a follower store, checks that it gets the keys by a full sync and the
+following changes by the stream, that it resumes after a disconnect without another full sync unless it fell behind,
+and that a follower rejects writes
+*/
+func TestReplication(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(command string, want string) {
+		t.Helper()
+		io.Copy(conn, bytes.NewBufferString(command))
+		if data, _ := reader.ReadBytes('\n'); string(data) != want {
+			t.Fatalf("%q replied %q, want %q", command, data, want)
+		}
+	}
+	f := &follower{leader: "127.0.0.1:9000", s: new_store(4)}
+	connect := func() (net.Conn, chan error) {
+		t.Helper()
+		con, err := net.Dial("tcp", f.leader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- f.replicate(con) }()
+		return con, done
+	}
+	wait_for := func(key string, present bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if _, ok := f.s.get(key); ok == present {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("%s present = %v on the follower", key, !present)
+	}
+
+	send("set repl:a 3600 1\r\na\r\n", "OK 0\r\n")
+	con, done := connect()
+	wait_for("repl:a", true)
+	send("set repl:b 0 1\r\nb\r\n", "OK 0\r\n")
+	send("delete repl:a\r\n", "DELETED\r\n")
+	wait_for("repl:b", true)
+	wait_for("repl:a", false)
+
+	con.Close()
+	<-done
+	send("set repl:c 0 1\r\nc\r\n", "OK 0\r\n")
+	con, done = connect()
+	wait_for("repl:c", true)
+	if n := atomic.LoadInt64(&f.full_syncs); n != 1 {
+		t.Errorf("%d full syncs after a reconnect, want 1", n)
+	}
+	con.Close()
+	<-done
+
+	/*
+		A follower whose position was dropped from the change log does a full sync again
+	*/
+	changelog.mutex.Lock()
+	limit := changelog.limit
+	changelog.limit = 1
+	changelog.mutex.Unlock()
+	send("set repl:d 0 1\r\nd\r\n", "OK 0\r\n")
+	send("set repl:e 0 1\r\ne\r\n", "OK 0\r\n")
+	changelog.mutex.Lock()
+	changelog.limit = limit
+	changelog.mutex.Unlock()
+
+	con, done = connect()
+	wait_for("repl:d", true)
+	wait_for("repl:e", true)
+	if n := atomic.LoadInt64(&f.full_syncs); n < 2 {
+		t.Errorf("%d full syncs after falling behind, want 2", n)
+	}
+	if val, _ := f.s.get("repl:b"); string(val.value) != "b" {
+		t.Errorf("repl:b = %q after the full sync", val.value)
+	}
+	con.Close()
+	<-done
+
+	/*
+		A follower of another change log, as after a restart of the leader, does a full sync even though its position
+		is in the log
+	*/
+	f.log_id = "restarted"
+	f.s.delete("repl:b")
+	con, done = connect()
+	wait_for("repl:b", true)
+	con.Close()
+	<-done
+	if n := atomic.LoadInt64(&f.full_syncs); n < 3 || f.log_id != changelog.id {
+		t.Errorf("%d full syncs from log %q, want 3 from %q", n, f.log_id, changelog.id)
+	}
+
+	/*
+		As a follower the server rejects writes and serves reads
+	*/
+	replica_of = "127.0.0.1:9001"
+	defer func() { replica_of = "" }()
+	send("set repl:b 0 1\r\nx\r\n", "ERR_REDIRECT 127.0.0.1:9001\r\n")
+	send("delete repl:b\r\n", "ERR_REDIRECT 127.0.0.1:9001\r\n")
+	send("get repl:b\r\n", "VALUE 1\r\n")
+}
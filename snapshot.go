@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A snapshot is a point in time copy of the store written to its own file, named dump-<unix nanoseconds>.snap so that
+the newest one sorts last. The file starts with a fixed size header
+
+	magic "KVSS" | format version uint16 | reserved uint16 | entry count uint64 | body length uint64 | crc32 of body uint32
+
+followed by the body, which is every entry as <payload length uvarint><payload> where payload is an aof set record.
+A file whose header, length or checksum doesn't match is rejected as a whole rather than loaded partially.
+*/
+
+const (
+	snapshot_magic       = "KVSS"
+	snapshot_version     = 1
+	snapshot_header_size = 4 + 2 + 2 + 8 + 8 + 4
+	snapshot_prefix      = "dump-"
+	snapshot_suffix      = ".snap"
+	snapshots_kept       = 2
+)
+
+var errBadSnapshot = errors.New("snapshot: corrupted file")
+
+/*
+snapshot_dir is where snapshots are written and loaded from. Snapshots are disabled when it is empty.
+*/
+var snapshot_dir string
+
+/*
+snapshot_mutex makes sure only one snapshot is written at a time, whether started by the timer or by save
+*/
+var snapshot_mutex = &sync.Mutex{}
+
+type snapshot_entry struct {
+	key string
+	val mapval
+}
+
+/*
+save_snapshot() copies the store while holding the read lock of every shard, which only costs a walk over the maps,
+and then writes the copy to disk without any lock held so that clients are served during the slow part. Once the file
+is durable the aof records which it already contains are dropped from the log. It returns the path of the new
+snapshot.
+*/
+func save_snapshot() (string, error) {
+
+	if snapshot_dir == "" {
+		return "", errors.New("snapshot: no snapshot directory configured")
+	}
+
+	snapshot_mutex.Lock()
+	defer snapshot_mutex.Unlock()
+
+	now := time.Now().UnixNano()
+
+	kv.rlock_all()
+	var entries []snapshot_entry
+	for _, sh := range kv.shards {
+		for key, val := range sh.memmap {
+			if !is_expired(val, now) {
+				entries = append(entries, snapshot_entry{key, val})
+			}
+		}
+	}
+	var aof_offset int64
+	if aof != nil {
+		aof_offset = aof.offset()
+	}
+	kv.runlock_all()
+
+	path := filepath.Join(snapshot_dir, fmt.Sprintf("%s%019d%s", snapshot_prefix, time.Now().UnixNano(), snapshot_suffix))
+	if err := write_snapshot(path, entries); err != nil {
+		return "", err
+	}
+
+	if aof != nil {
+		if err := aof.compact(aof_offset); err != nil {
+			return path, err
+		}
+	}
+
+	remove_old_snapshots()
+	return path, nil
+}
+
+/*
+write_snapshot() writes entries to a temporary file, fills in the header once the checksum of the body is known, and
+renames it to path only after it has been synced
+*/
+func write_snapshot(path string, entries []snapshot_entry) error {
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	if _, err := file.Write(make([]byte, snapshot_header_size)); err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(file, crc))
+	var body_len uint64
+	var length [binary.MaxVarintLen64]byte
+
+	for _, entry := range entries {
+		payload := encode_set_record(entry.key, entry.val)
+		n := binary.PutUvarint(length[:], uint64(len(payload)))
+		if _, err := writer.Write(length[:n]); err != nil {
+			return err
+		}
+		if _, err := writer.Write(payload); err != nil {
+			return err
+		}
+		body_len += uint64(n + len(payload))
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, snapshot_header_size)
+	header = append(header, snapshot_magic...)
+	header = binary.BigEndian.AppendUint16(header, snapshot_version)
+	header = binary.BigEndian.AppendUint16(header, 0)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(entries)))
+	header = binary.BigEndian.AppendUint64(header, body_len)
+	header = binary.BigEndian.AppendUint32(header, crc.Sum32())
+	if _, err := file.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return sync_dir(filepath.Dir(path))
+}
+
+/*
+read_snapshot() validates the snapshot at path and returns its entries. Nothing is returned unless the whole file
+checks out.
+*/
+func read_snapshot(path string) ([]snapshot_entry, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < snapshot_header_size || string(data[0:4]) != snapshot_magic {
+		return nil, errBadSnapshot
+	}
+	if version := binary.BigEndian.Uint16(data[4:6]); version != snapshot_version {
+		return nil, fmt.Errorf("snapshot: unsupported format version %d", version)
+	}
+	count := binary.BigEndian.Uint64(data[8:16])
+	body_len := binary.BigEndian.Uint64(data[16:24])
+	checksum := binary.BigEndian.Uint32(data[24:28])
+
+	body := data[snapshot_header_size:]
+	if uint64(len(body)) != body_len || crc32.ChecksumIEEE(body) != checksum {
+		return nil, errBadSnapshot
+	}
+
+	entries := make([]snapshot_entry, 0, count)
+	reader := bytes.NewReader(body)
+	for reader.Len() > 0 {
+		n, err := binary.ReadUvarint(reader)
+		if err != nil || n > uint64(reader.Len()) {
+			return nil, errBadSnapshot
+		}
+		payload := make([]byte, n)
+		io.ReadFull(reader, payload)
+
+		op, key, val, err := decode_record(payload)
+		if err != nil || op != aof_op_set {
+			return nil, errBadSnapshot
+		}
+		entries = append(entries, snapshot_entry{key, val})
+	}
+	if uint64(len(entries)) != count {
+		return nil, errBadSnapshot
+	}
+	return entries, nil
+}
+
+/*
+list_snapshots() returns the snapshot files in dir, oldest first
+*/
+func list_snapshots(dir string) ([]string, error) {
+
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range names {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, snapshot_prefix) && strings.HasSuffix(name, snapshot_suffix) {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+/*
+load_snapshot() loads the newest valid snapshot in snapshot_dir into the store. Corrupted snapshots are
+reported and skipped in favour of the next older one, unless the aof is in use: it was compacted up to the newest
+snapshot, so an older one plus the aof would miss the writes in between, and startup fails instead. It returns the
+path loaded, or "" if there was none.
+*/
+func load_snapshot() (string, error) {
+
+	paths, err := list_snapshots(snapshot_dir)
+	if err != nil {
+		return "", err
+	}
+
+	for i := len(paths) - 1; i >= 0; i-- {
+		entries, err := read_snapshot(paths[i])
+		if err != nil {
+			fmt.Printf("INT_ERR: Rejecting snapshot %s: %s\n", paths[i], err)
+			if aof_path != "" {
+				return "", fmt.Errorf("snapshot %s is rejected and the aof only holds the writes after it", paths[i])
+			}
+			continue
+		}
+
+		for _, entry := range entries {
+			kv.apply_record(aof_op_set, entry.key, entry.val)
+		}
+		return paths[i], nil
+	}
+	return "", nil
+}
+
+func remove_old_snapshots() {
+
+	paths, err := list_snapshots(snapshot_dir)
+	if err != nil {
+		return
+	}
+	for len(paths) > snapshots_kept {
+		os.Remove(paths[0])
+		paths = paths[1:]
+	}
+}
+
+/*
+periodic_snapshot() saves a snapshot every interval
+*/
+func periodic_snapshot(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if path, err := save_snapshot(); err != nil {
+			fmt.Printf("INT_ERR: Saving snapshot: %s\n", err)
+		} else {
+			fmt.Printf("Saved snapshot %s\n", path)
+		}
+	}
+}
+
+func sync_dir(dir string) error {
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
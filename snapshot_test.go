@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+TestSnapshotSaveAndLoad() triggers a snapshot with the save command and checks that it holds the key with its version
+and expiry timestamp
+*/
+func TestSnapshotSaveAndLoad(t *testing.T) {
+
+	snapshot_dir = t.TempDir()
+	defer func() { snapshot_dir = "" }()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	io.Copy(conn, bytes.NewBufferString("set snapkey 100 5\r\nmayur\r\n"))
+	reader.ReadBytes('\n')
+	io.Copy(conn, bytes.NewBufferString("set snapkey 100 4\r\nkale\r\n"))
+	reader.ReadBytes('\n')
+
+	io.Copy(conn, bytes.NewBufferString("save\r\n"))
+	data, _ := reader.ReadBytes('\n')
+	if strings.TrimRight(string(data), "\r\n") != "SAVED" {
+		t.Fatalf("save replied %q", data)
+	}
+
+	paths, _ := list_snapshots(snapshot_dir)
+	if len(paths) != 1 {
+		t.Fatalf("found %d snapshots", len(paths))
+	}
+	entries, err := read_snapshot(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := kv.get("snapkey")
+
+	found := false
+	for _, entry := range entries {
+		if entry.key == "snapkey" {
+			found = true
+			if entry.val.version != want.version || entry.val.timestamp != want.timestamp || string(entry.val.value) != "kale" {
+				t.Errorf("snapshot has %+v, store has %+v", entry.val, want)
+			}
+		}
+	}
+	if !found {
+		t.Error("snapkey missing from snapshot")
+	}
+}
+
+/*
+TestSnapshotSkipsExpired() checks that a key which expired but was not removed from the store yet is left out of the
+snapshot, while a key expiring later is kept
+*/
+func TestSnapshotSkipsExpired(t *testing.T) {
+
+	snapshot_dir = t.TempDir()
+	defer func() { snapshot_dir = "" }()
+
+	kv.set("snapexpiring", time.Hour, []byte("kept"))
+
+	/*
+		The key is put in the map only, so the expiry cycle can't remove it before the snapshot
+	*/
+	sh := kv.shard_for("snapexpired")
+	sh.mutex.Lock()
+	sh.memmap["snapexpired"] = new_mapval(-time.Millisecond, []byte("gone"), time.Now())
+	sh.mutex.Unlock()
+	defer func() {
+		sh.mutex.Lock()
+		delete(sh.memmap, "snapexpired")
+		sh.mutex.Unlock()
+	}()
+
+	path, err := save_snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := read_snapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := false
+	for _, entry := range entries {
+		if entry.key == "snapexpired" {
+			t.Error("expired key saved in the snapshot")
+		}
+		kept = kept || entry.key == "snapexpiring"
+	}
+	if kept == false {
+		t.Error("key expiring in an hour missing from the snapshot")
+	}
+}
+
+/*
+TestSnapshotRejectsCorruption() flips a byte in the newest snapshot and checks that loading falls back to the older
+valid one instead of loading a damaged file, and fails when the aof is in use, as it was compacted past the older one
+*/
+func TestSnapshotRejectsCorruption(t *testing.T) {
+
+	snapshot_dir = t.TempDir()
+	defer func() { snapshot_dir = "" }()
+
+	now := time.Now().UnixNano()
+	old := filepath.Join(snapshot_dir, "dump-0000000000000000001.snap")
+	write_snapshot(old, []snapshot_entry{{"snapold", mapval{expirytime: 0, version: 3, numbytes: 5, value: []byte("older"), timestamp: now}}})
+	newer := filepath.Join(snapshot_dir, "dump-0000000000000000002.snap")
+	write_snapshot(newer, []snapshot_entry{{"snapnew", mapval{expirytime: 0, version: 9, numbytes: 5, value: []byte("newer"), timestamp: now}}})
+
+	data, _ := os.ReadFile(newer)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(newer, data, 0644)
+
+	if _, err := read_snapshot(newer); err == nil {
+		t.Error("corrupted snapshot was accepted")
+	}
+
+	aof_path = filepath.Join(snapshot_dir, "appendonly.aof")
+	path, err := load_snapshot()
+	aof_path = ""
+	if err == nil {
+		t.Errorf("loaded %q with an aof compacted up to the rejected snapshot", path)
+	}
+
+	path, err = load_snapshot()
+	if err != nil || path != old {
+		t.Fatalf("loaded %q, err %v", path, err)
+	}
+
+	val, ok := kv.get("snapold")
+	_, ok2 := kv.get("snapnew")
+	if !ok || val.version != 3 || ok2 {
+		t.Errorf("snapold = %+v, snapnew present = %v", val, ok2)
+	}
+}
+
+/*
+TestSnapshotCompactsAof() checks that records covered by a snapshot are dropped from the log and that the snapshot
+plus the remaining log still rebuild the store
+*/
+func TestSnapshotCompactsAof(t *testing.T) {
+
+	dir := t.TempDir()
+	snapshot_dir = dir
+	log, err := open_aof(filepath.Join(dir, "appendonly.aof"), fsync_always)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof = log
+	defer func() {
+		aof = nil
+		snapshot_dir = ""
+		log.close()
+	}()
+
+	kv.set("compact1", 0, []byte("mayur"))
+	kv.set("compact2", 0, []byte("mayur"))
+
+	if _, err := save_snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if size := log.offset(); size != 0 {
+		t.Errorf("aof holds %d bytes after snapshot", size)
+	}
+
+	kv.delete("compact1")
+
+	sh := kv.shard_for("compact2")
+	sh.mutex.Lock()
+	delete(sh.memmap, "compact2")
+	sh.mutex.Unlock()
+
+	load_snapshot()
+	if _, err := replay_aof(log.path); err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok1 := kv.get("compact1")
+	_, ok2 := kv.get("compact2")
+	if ok1 || !ok2 {
+		t.Errorf("compact1 present = %v, compact2 present = %v", ok1, ok2)
+	}
+}
@@ -0,0 +1,761 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The key space is split into shards by a hash of the key. Every shard has its own map, lock and expiry heap, so
+commands on keys in different shards never wait for each other and the expiry check only blocks one shard at a time.
+*/
+
+const default_shards = 16
+
+/*
+Tuning of the active expiry cycle: how often it runs, which share of each tick it may use and how many keys a shard
+expires per lock acquisition
+*/
+const (
+	expire_hz             = 10
+	expire_budget_percent = 25
+	expire_batch          = 20
+)
+
+type shard struct {
+	mutex     sync.RWMutex
+	memmap    map[string]mapval
+	exp_heap  PriorityQueue
+	exp_nodes map[string]*exp_struct // the heap node of every key with an expiry time
+	index     *skiplist              // the keys of memmap in lexical order
+	used      int64                  // bytes accounted to the entries of memmap, updated atomically
+	s         *store                 // the store of the shard, whose memory limit put() checks
+}
+
+type store struct {
+	shards     []*shard
+	max_memory int64 // 0 means no limit
+	policy     string
+	log_expiry bool // expired keys are only deleted by the raft log, see raft.go
+}
+
+/*
+kv is the key value store served by handleconnection
+*/
+var kv = new_store(default_shards)
+
+/*
+Errors returned by the store operations. Their text is the reply sent to the client.
+*/
+var (
+	errNotFound = errors.New("ERRNOTFOUND")
+	errVersion  = errors.New("ERR_VERSION")
+	errExists   = errors.New("ERR_EXISTS")
+	errNotInt   = errors.New("ERR_NOTINT")
+	errOverflow = errors.New("ERR_OVERFLOW")
+)
+
+/*
+Conditions under which set_if() writes the key
+*/
+const (
+	cond_always  = iota
+	cond_absent  // the key is missing or expired
+	cond_present // the key exists and is not expired
+)
+
+func new_store(n int) *store {
+
+	if n < 1 {
+		n = 1
+	}
+	s := &store{shards: make([]*shard, n), policy: policy_noeviction}
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			memmap:    make(map[string]mapval),
+			exp_heap:  make(PriorityQueue, 0),
+			exp_nodes: make(map[string]*exp_struct),
+			index:     new_skiplist(),
+			s:         s,
+		}
+		heap.Init(&s.shards[i].exp_heap)
+	}
+	return s
+}
+
+/*
+shard_for() returns the shard owning key, chosen by the 32 bit FNV-1a hash of the key
+*/
+func (s *store) shard_for(key string) *shard {
+	return s.shards[s.shard_index(key)]
+}
+
+func (s *store) shard_index(key string) int {
+
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(len(s.shards)))
+}
+
+/*
+shards_of() returns the distinct shards owning keys in shard order, which is the order their locks must be taken in
+*/
+func (s *store) shards_of(keys []string) []*shard {
+
+	owned := make([]bool, len(s.shards))
+	for _, key := range keys {
+		owned[s.shard_index(key)] = true
+	}
+	var shards []*shard
+	for i, sh := range s.shards {
+		if owned[i] {
+			shards = append(shards, sh)
+		}
+	}
+	return shards
+}
+
+/*
+rlock_all() and runlock_all() hold the read lock of every shard, always taken in the same order, for operations which
+need a consistent view of the whole store
+*/
+func (s *store) rlock_all() {
+	for _, sh := range s.shards {
+		sh.mutex.RLock()
+	}
+}
+
+func (s *store) runlock_all() {
+	for _, sh := range s.shards {
+		sh.mutex.RUnlock()
+	}
+}
+
+/*
+error_message() converts an error returned by a store operation to the reply for the client
+*/
+func error_message(err error) string {
+
+	switch err {
+	case errNotFound, errVersion, errExists, errNotInt, errOverflow, errOutOfMemory, errNoScript:
+		return err.Error() + "\r\n"
+	case errRaftBusy, errTimeout, errNotReplicated, errCrossSlot:
+		return err.Error() + "\r\n"
+	}
+	if err == errReadOnly {
+		return err.Error() + " " + replica_of + "\r\n"
+	}
+	if err == errNotLeader {
+		_, _, leader, _ := raft_cluster.status()
+		if leader == "" {
+			leader = "-"
+		}
+		return err.Error() + " " + leader + "\r\n"
+	}
+	if _, ok := err.(*script_error); ok {
+		return strings.ReplaceAll(err.Error(), "\r\n", " ") + "\r\n"
+	}
+	fmt.Printf("INT_ERR: %s\n", err)
+	return "ERR_INTERNAL\r\n"
+}
+
+/*
+get() returns the value of key unless it is missing or expired
+*/
+func (s *store) get(key string) (mapval, bool) {
+
+	sh := s.shard_for(key)
+	now := time.Now()
+	sh.mutex.RLock()
+	val, ok := sh.memmap[key]
+	sh.mutex.RUnlock()
+
+	if ok == false {
+		return mapval{}, false
+	}
+	if is_expired(val, now.UnixNano()) {
+		if s.log_expiry == false {
+			sh.expire_key(key, now.UnixNano())
+		}
+		return mapval{}, false
+	}
+	val.stats.touch(now)
+	return val, true
+}
+
+/*
+get_many() looks up every key while holding the read locks of all their shards at once, so the values found are a
+consistent view of the store. found[i] tells whether keys[i] exists.
+*/
+func (s *store) get_many(keys []string) (vals []mapval, found []bool) {
+
+	shards := s.shards_of(keys)
+	now := time.Now()
+	vals = make([]mapval, len(keys))
+	found = make([]bool, len(keys))
+
+	for _, sh := range shards {
+		sh.mutex.RLock()
+	}
+	var expired []string
+	for i, key := range keys {
+		val, ok := s.shard_for(key).memmap[key]
+		if ok == true && !is_expired(val, now.UnixNano()) {
+			vals[i] = val
+			found[i] = true
+		} else if ok == true && s.log_expiry == false {
+			expired = append(expired, key)
+		}
+	}
+	for _, sh := range shards {
+		sh.mutex.RUnlock()
+	}
+
+	for i := range vals {
+		if found[i] {
+			vals[i].stats.touch(now)
+		}
+	}
+	for _, key := range expired {
+		s.shard_for(key).expire_key(key, now.UnixNano())
+	}
+	return vals, found
+}
+
+type scan_entry struct {
+	key string
+	val mapval
+}
+
+/*
+scan() returns up to limit keys from start up to but not including end, in lexical order, which have the given prefix.
+An empty end means no upper bound. When there are more keys in the range, cursor is the first key which was left out
+and the next scan starts there. Every shard is read under its own lock, so keys written while the scan runs may or may
+not be seen.
+*/
+func (s *store) scan(start string, end string, prefix string, limit int) (entries []scan_entry, cursor string) {
+
+	if prefix > start {
+		start = prefix
+	}
+	now := time.Now().UnixNano()
+
+	for _, sh := range s.shards {
+		sh.mutex.RLock()
+		found := 0
+		for node := sh.index.seek(start); node != nil && found <= limit; node = node.next[0] {
+			if (end != "" && node.key >= end) || !strings.HasPrefix(node.key, prefix) {
+				break
+			}
+			if val := sh.memmap[node.key]; !is_expired(val, now) {
+				entries = append(entries, scan_entry{node.key, val})
+				found++
+			}
+		}
+		sh.mutex.RUnlock()
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	if len(entries) > limit {
+		cursor = entries[limit].key
+		entries = entries[:limit]
+	}
+	return entries, cursor
+}
+
+/*
+set() creates or overwrites key and returns its new version
+*/
+func (s *store) set(key string, ttl time.Duration, value []byte) (int64, error) {
+	return s.set_if(key, ttl, value, cond_always)
+}
+
+/*
+add() creates key only if it doesn't exist yet
+*/
+func (s *store) add(key string, ttl time.Duration, value []byte) (int64, error) {
+	return s.set_if(key, ttl, value, cond_absent)
+}
+
+/*
+replace() overwrites key only if it already exists
+*/
+func (s *store) replace(key string, ttl time.Duration, value []byte) (int64, error) {
+	return s.set_if(key, ttl, value, cond_present)
+}
+
+func (s *store) set_if(key string, ttl time.Duration, value []byte, cond int) (int64, error) {
+
+	var version int64
+	err := s.write(key, func(sh *shard) (err error) {
+		version, err = sh.set_if(key, ttl, value, cond)
+		return err
+	})
+	return version, err
+}
+
+/*
+The shard methods below are the store operations for callers which already hold the shard's write lock
+*/
+
+func (sh *shard) set_if(key string, ttl time.Duration, value []byte, cond int) (int64, error) {
+
+	if err := read_only(); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	old, ok := sh.memmap[key]
+	live := ok == true && !is_expired(old, now.UnixNano())
+	if cond == cond_absent && live {
+		return 0, errExists
+	}
+	if cond == cond_present && !live {
+		return 0, errNotFound
+	}
+
+	new_val := new_mapval(ttl, value, now)
+	if ok == true {
+		new_val.version = old.version + 1
+	}
+
+	if err := sh.put(key, new_val, "set"); err != nil {
+		return 0, err
+	}
+	return new_val.version, nil
+}
+
+/*
+cas() overwrites key only if its current version is version, and returns the new version
+*/
+func (s *store) cas(key string, ttl time.Duration, version int64, value []byte) (int64, error) {
+
+	var new_version int64
+	err := s.write(key, func(sh *shard) (err error) {
+		new_version, err = sh.cas(key, ttl, version, value)
+		return err
+	})
+	return new_version, err
+}
+
+func (sh *shard) cas(key string, ttl time.Duration, version int64, value []byte) (int64, error) {
+
+	if err := read_only(); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	old, ok := sh.memmap[key]
+	if ok == false || is_expired(old, now.UnixNano()) {
+		return 0, errNotFound
+	}
+	if old.version != version {
+		return 0, errVersion
+	}
+
+	new_val := new_mapval(ttl, value, now)
+	new_val.version = old.version + 1
+	if err := sh.put(key, new_val, "cas"); err != nil {
+		return 0, err
+	}
+	return new_val.version, nil
+}
+
+/*
+update() is a read-modify-write of key under the shard lock. fn gets the current value, or nil when the key is
+missing or expired, and returns the value to store, whose version is then set to one more than the previous one. If
+fn returns an error nothing is written.
+*/
+func (s *store) update(key string, fn func(old *mapval) (mapval, error)) (mapval, error) {
+
+	var val mapval
+	err := s.write(key, func(sh *shard) (err error) {
+		val, err = sh.update(key, fn)
+		return err
+	})
+	return val, err
+}
+
+func (sh *shard) update(key string, fn func(old *mapval) (mapval, error)) (mapval, error) {
+
+	if err := read_only(); err != nil {
+		return mapval{}, err
+	}
+	raw, ok := sh.memmap[key]
+	var old *mapval
+	if ok == true && !is_expired(raw, time.Now().UnixNano()) {
+		old = &raw
+	}
+
+	new_val, err := fn(old)
+	if err != nil {
+		return mapval{}, err
+	}
+	new_val.version = 0
+	if ok == true {
+		new_val.version = raw.version + 1
+	}
+	new_val.numbytes = len(new_val.value)
+
+	if err := sh.put(key, new_val, "set"); err != nil {
+		return mapval{}, err
+	}
+	return new_val, nil
+}
+
+/*
+incr() adds delta to the 64 bit integer stored at key and returns the result. The key keeps its remaining time to
+live. A missing key is created with the value initial, expiring after ttl, when create is true and is errNotFound
+otherwise.
+*/
+func (s *store) incr(key string, delta int64, create bool, initial int64, ttl time.Duration) (int64, error) {
+
+	var result int64
+	_, err := s.update(key, incr_fn(delta, create, initial, ttl, &result))
+	return result, err
+}
+
+/*
+incr_fn(), touch_fn() and append_fn() return the read-modify-write of incr(), touch() and append_value() for update().
+incr_fn() stores the new value of the counter in result.
+*/
+func incr_fn(delta int64, create bool, initial int64, ttl time.Duration, result *int64) func(old *mapval) (mapval, error) {
+
+	return func(old *mapval) (mapval, error) {
+		if old == nil {
+			if create == false {
+				return mapval{}, errNotFound
+			}
+			*result = initial
+			return new_mapval(ttl, []byte(strconv.FormatInt(initial, 10)), time.Now()), nil
+		}
+
+		current, err := strconv.ParseInt(string(old.value), 10, 64)
+		if err != nil {
+			return mapval{}, errNotInt
+		}
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return mapval{}, errOverflow
+		}
+		*result = current + delta
+
+		new_val := *old
+		new_val.value = []byte(strconv.FormatInt(*result, 10))
+		return new_val, nil
+	}
+}
+
+/*
+touch() makes key expire ttl from now, or never when ttl is 0, without changing its value
+*/
+func (s *store) touch(key string, ttl time.Duration) (mapval, error) {
+	return s.update(key, touch_fn(ttl))
+}
+
+func touch_fn(ttl time.Duration) func(old *mapval) (mapval, error) {
+
+	return func(old *mapval) (mapval, error) {
+		if old == nil {
+			return mapval{}, errNotFound
+		}
+		new_val := *old
+		new_val.set_expiry(ttl, time.Now())
+		return new_val, nil
+	}
+}
+
+/*
+append_value() adds value to the end of the value of key, or to its start when prepend is true, and returns the new
+version. The key keeps its remaining time to live.
+*/
+func (s *store) append_value(key string, value []byte, prepend bool) (int64, error) {
+
+	val, err := s.update(key, append_fn(value, prepend))
+	return val.version, err
+}
+
+func append_fn(value []byte, prepend bool) func(old *mapval) (mapval, error) {
+
+	return func(old *mapval) (mapval, error) {
+		if old == nil {
+			return mapval{}, errNotFound
+		}
+		new_val := *old
+		if prepend {
+			new_val.value = concat(value, old.value)
+		} else {
+			new_val.value = concat(old.value, value)
+		}
+		return new_val, nil
+	}
+}
+
+/*
+concat() returns a new slice holding a followed by b. Values are shared with readers outside the shard lock, so they
+are never appended to in place.
+*/
+func concat(a []byte, b []byte) []byte {
+
+	joined := make([]byte, 0, len(a)+len(b))
+	joined = append(joined, a...)
+	return append(joined, b...)
+}
+
+/*
+delete() removes key
+*/
+func (s *store) delete(key string) error {
+	return s.delete_if(key, -1)
+}
+
+/*
+delete_if() removes key only if its version is version, or whatever its version when version is negative
+*/
+func (s *store) delete_if(key string, version int64) error {
+
+	sh := s.shard_for(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	return sh.delete_if(key, version)
+}
+
+func (sh *shard) delete_if(key string, version int64) error {
+
+	if err := read_only(); err != nil {
+		return err
+	}
+	val, ok := sh.memmap[key]
+	if ok == false || is_expired(val, time.Now().UnixNano()) {
+		return errNotFound
+	}
+	if version >= 0 && val.version != version {
+		return errVersion
+	}
+	if err := aof_log_delete(key); err != nil {
+		return err
+	}
+	sh.remove(key)
+	record_change("delete", key, val)
+	return nil
+}
+
+/*
+new_mapval() returns a value for the store which expires ttl after now
+*/
+func new_mapval(ttl time.Duration, value []byte, now time.Time) mapval {
+
+	val := mapval{numbytes: len(value), value: value}
+	val.set_expiry(ttl, now)
+	return val
+}
+
+/*
+set_expiry() makes val expire ttl after now, or never when ttl is 0. A negative ttl, which is what an absolute expiry
+time in the past turns into, leaves val expired right away. expirytime is the ttl in milliseconds, rounded up, and
+timestamp the deadline in unix nanoseconds.
+*/
+func (val *mapval) set_expiry(ttl time.Duration, now time.Time) {
+
+	val.timestamp = now.UnixNano()
+	val.expirytime = 0
+	if ttl == 0 {
+		return
+	}
+	val.timestamp += int64(ttl)
+	val.expirytime = int((ttl + time.Millisecond - 1) / time.Millisecond)
+	if val.expirytime < 1 {
+		val.expirytime = 1
+	}
+}
+
+/*
+put() logs val to the aof, stores it and records event in the change log and for the watchers of key. The caller
+must hold the shard's write lock, under which the memory limit is checked with what val adds to the current entry.
+*/
+func (sh *shard) put(key string, val mapval, event string) error {
+
+	if err := sh.room(key, val); err != nil {
+		return err
+	}
+	if err := aof_log_set(key, val); err != nil {
+		return err
+	}
+	sh.store_entry(key, val)
+	record_change(event, key, val)
+	return nil
+}
+
+/*
+apply_record() applies one record read from the aof or a snapshot without logging it again
+*/
+func (s *store) apply_record(op byte, key string, val mapval) {
+
+	sh := s.shard_for(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	if op == aof_op_delete || is_expired(val, time.Now().UnixNano()) {
+		sh.remove(key)
+		return
+	}
+
+	sh.store_entry(key, val)
+}
+
+/*
+expire() deletes every key of the shard which has expired at now, one batch at a time
+*/
+func (sh *shard) expire(now int64) {
+
+	for {
+		if sh.expire_batch(now, expire_batch) < expire_batch {
+			return
+		}
+	}
+}
+
+/*
+expire_batch() deletes up to max keys of the shard which have expired at now and returns how many it deleted. Every
+key has at most one heap node, which is moved whenever the key's expiry time changes, so the keys at the top of the
+heap are exactly the expired ones.
+*/
+func (sh *shard) expire_batch(now int64, max int) int {
+
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	n := 0
+	for n < max && sh.exp_heap.Len() > 0 && sh.exp_heap[0].priority < now {
+		key := sh.exp_heap[0].value
+		val := sh.memmap[key]
+		sh.remove(key)
+		record_change("expired", key, val)
+		n++
+	}
+	return n
+}
+
+/*
+expire_key() deletes key if it is still expired at now. It is the lazy side of expiry, called when a read finds an
+expired key.
+*/
+func (sh *shard) expire_key(key string, now int64) {
+
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	if val, ok := sh.memmap[key]; ok == true && is_expired(val, now) {
+		sh.remove(key)
+		record_change("expired", key, val)
+	}
+}
+
+/*
+active_expire() is one cycle of active expiry. It goes over the shards, starting at a random one so that all of them
+get their turn when the budget runs out, and expires a batch of keys in each. Where Redis samples random keys with an
+expiry time, the heap lets every batch take exactly keys which are expired. Shards whose batch was full most likely
+have more expired keys and get another batch in the next round. It returns the number of keys deleted.
+*/
+func (s *store) active_expire(now int64, budget time.Duration) int {
+
+	if s.log_expiry {
+		return 0
+	}
+	start := time.Now()
+	offset := rand.Intn(len(s.shards))
+	busy := make([]bool, len(s.shards))
+	for i := range busy {
+		busy[i] = true
+	}
+
+	deleted := 0
+	for more := true; more; {
+		more = false
+		for i := range s.shards {
+			j := (offset + i) % len(s.shards)
+			if busy[j] == false {
+				continue
+			}
+			n := s.shards[j].expire_batch(now, expire_batch)
+			deleted += n
+			busy[j] = n == expire_batch
+			more = more || busy[j]
+			if time.Since(start) > budget {
+				return deleted
+			}
+		}
+	}
+	return deleted
+}
+
+/*
+store_entry() and remove() are the only places memmap is modified, so that the memory accounting of the shard stays
+exact, the index holds every key and the expiry heap holds exactly one node for every key with an expiry time.
+store_entry() gives val fresh access statistics, keeping the LFU counter of the value it replaces. The caller must
+hold the write lock.
+*/
+func (sh *shard) store_entry(key string, val mapval) {
+
+	now := time.Now()
+	stats := new_stats(now)
+	if old, ok := sh.memmap[key]; ok {
+		atomic.AddInt64(&sh.used, -entry_size(key, old))
+		if old.stats != nil {
+			stats.lfu_counter = old.stats.lfu(now.Unix())
+		}
+	} else {
+		sh.index.insert(key)
+	}
+	val.stats = stats
+	sh.memmap[key] = val
+	atomic.AddInt64(&sh.used, entry_size(key, val))
+	sh.schedule(key, val)
+}
+
+func (sh *shard) remove(key string) {
+
+	if old, ok := sh.memmap[key]; ok {
+		atomic.AddInt64(&sh.used, -entry_size(key, old))
+		delete(sh.memmap, key)
+		sh.index.delete(key)
+	}
+	sh.unschedule(key)
+}
+
+/*
+schedule() moves the heap node of key to the expiry time of val, pushing a node if the key has none yet, or removes
+it if val never expires
+*/
+func (sh *shard) schedule(key string, val mapval) {
+
+	if val.expirytime == 0 {
+		sh.unschedule(key)
+		return
+	}
+	item, ok := sh.exp_nodes[key]
+	if ok == false {
+		item = &exp_struct{value: key, priority: val.timestamp}
+		sh.exp_nodes[key] = item
+		heap.Push(&sh.exp_heap, item)
+	} else if item.priority != val.timestamp {
+		sh.exp_heap.update_node(item, key, val.timestamp)
+	}
+}
+
+func (sh *shard) unschedule(key string) {
+
+	if item, ok := sh.exp_nodes[key]; ok {
+		heap.Remove(&sh.exp_heap, item.index)
+		delete(sh.exp_nodes, key)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+TestShardExpiry() checks that keys spread over several shards are each expired by their own shard's heap, and that a
+key overwritten without expiry survives its old heap node
+*/
+func TestShardExpiry(t *testing.T) {
+
+	s := new_store(4)
+	for i := 0; i < 100; i++ {
+		s.set("shardkey"+strconv.Itoa(i), time.Second, []byte("mayur"))
+	}
+	s.set("shardkey0", 0, []byte("kale"))
+
+	used := 0
+	for _, sh := range s.shards {
+		if len(sh.memmap) > 0 {
+			used++
+		}
+	}
+	if used != len(s.shards) {
+		t.Errorf("keys landed in %d of %d shards", used, len(s.shards))
+	}
+
+	now := time.Now().Add(2 * time.Second).UnixNano()
+	for _, sh := range s.shards {
+		sh.expire(now)
+	}
+
+	total := 0
+	for _, sh := range s.shards {
+		total += len(sh.memmap)
+	}
+	if val, ok := s.get("shardkey0"); total != 1 || !ok || string(val.value) != "kale" {
+		t.Errorf("%d keys left after expiry, shardkey0 = %+v", total, val)
+	}
+}
+
+/*
+The benchmarks below run a read heavy (90% get, 10% set) and a write only workload from parallel clients. The 1 shard
+variants behave like the original single memmap behind one RWMutex, so comparing them with the default shard count
+shows what sharding buys. Run them with
+
+	go test -run '^$' -bench Store -cpu 1,4,8 .
+*/
+
+const bench_keys = 10000
+
+func bench_store_mixed(b *testing.B, s *store) {
+
+	value := []byte("mayur")
+	for i := 0; i < bench_keys; i++ {
+		s.set("benchkey"+strconv.Itoa(i), 0, value)
+	}
+
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddInt64(&seed, 7919)
+		for pb.Next() {
+			key := "benchkey" + strconv.Itoa(int(i%bench_keys))
+			if i%10 == 0 {
+				s.set(key, 0, value)
+			} else {
+				s.get(key)
+			}
+			i++
+		}
+	})
+}
+
+func bench_store_set(b *testing.B, s *store) {
+
+	value := []byte("mayur")
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddInt64(&seed, 7919)
+		for pb.Next() {
+			s.set("benchkey"+strconv.Itoa(int(i%bench_keys)), 10*time.Second, value)
+			i++
+		}
+	})
+}
+
+func BenchmarkStoreMixed1Shard(b *testing.B) {
+	bench_store_mixed(b, new_store(1))
+}
+
+func BenchmarkStoreMixedSharded(b *testing.B) {
+	bench_store_mixed(b, new_store(default_shards))
+}
+
+func BenchmarkStoreSet1Shard(b *testing.B) {
+	bench_store_set(b, new_store(1))
+}
+
+func BenchmarkStoreSetSharded(b *testing.B) {
+	bench_store_set(b, new_store(default_shards))
+}
+
+/*
+TestConcurrentIncr() increments one counter from many goroutines and checks that no increment was lost
+*/
+func TestConcurrentIncr(t *testing.T) {
+
+	s := new_store(4)
+	done := make(chan bool)
+	for i := 0; i < 50; i++ {
+		go func() {
+			for j := 0; j < 100; j++ {
+				s.incr("incrkey", 1, true, 1, 0)
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		<-done
+	}
+
+	val, _ := s.get("incrkey")
+	if string(val.value) != "5000" || val.version != 4999 {
+		t.Errorf("counter is %s at version %d", val.value, val.version)
+	}
+	if _, err := s.incr("incrkey", math.MaxInt64, false, 0, 0); err != errOverflow {
+		t.Errorf("overflowing increment returned %v", err)
+	}
+}
+
+/*
+TestTouchMovesHeapNode() checks that changing the expiry time of a key moves its heap node instead of adding one
+*/
+func TestTouchMovesHeapNode(t *testing.T) {
+
+	s := new_store(1)
+	sh := s.shards[0]
+	s.set("touchkey", 100*time.Second, []byte("mayur"))
+	for i := 1; i <= 10; i++ {
+		s.touch("touchkey", time.Duration(100+i)*time.Second)
+	}
+	val, _ := s.get("touchkey")
+	if sh.exp_heap.Len() != 1 || sh.exp_heap[0].priority != val.timestamp || val.expirytime != 110000 {
+		t.Errorf("heap has %d nodes after touching one key", sh.exp_heap.Len())
+	}
+
+	s.touch("touchkey", 0)
+	if sh.exp_heap.Len() != 0 || len(sh.exp_nodes) != 0 {
+		t.Errorf("heap has %d nodes after persisting the only key", sh.exp_heap.Len())
+	}
+
+	s.touch("touchkey", time.Second)
+	sh.expire(time.Now().Add(2 * time.Second).UnixNano())
+	if _, ok := s.get("touchkey"); ok || sh.exp_heap.Len() != 0 {
+		t.Error("touched key did not expire")
+	}
+}
+
+/*
+TestActiveExpiry() expires many keys with one active cycle, checks that a cycle without budget stops after a batch and
+that reading an expired key deletes it
+*/
+func TestActiveExpiry(t *testing.T) {
+
+	s := new_store(4)
+	for i := 0; i < 1000; i++ {
+		s.set("activekey"+strconv.Itoa(i), time.Millisecond, []byte("mayur"))
+	}
+	s.set("activekey0", 0, []byte("kale"))
+	now := time.Now().Add(10 * time.Millisecond).UnixNano()
+
+	if n := s.active_expire(now, 0); n != expire_batch {
+		t.Errorf("cycle without budget deleted %d keys", n)
+	}
+	if n := s.active_expire(now, time.Second); n != 999-expire_batch {
+		t.Errorf("cycle deleted %d keys", n)
+	}
+	if used := s.memory_used(); used != int64(len("activekey0")+len("kale")+entry_overhead) {
+		t.Errorf("memory used = %d after expiry", used)
+	}
+
+	s.set("lazykey", time.Millisecond, []byte("mayur"))
+	time.Sleep(2 * time.Millisecond)
+	if _, ok := s.get("lazykey"); ok {
+		t.Error("expired key was returned")
+	}
+	if _, ok := s.shard_for("lazykey").memmap["lazykey"]; ok {
+		t.Error("expired key was not deleted when read")
+	}
+}
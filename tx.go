@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"time"
+)
+
+/*
+Transactions of the text protocol. multi starts queueing the commands of the connection instead of running them, and
+exec runs the queue while holding the write lock of every shard, so no other client sees the store between two of its
+commands. watch remembers the version of keys; if any of them was written or deleted before exec, exec runs nothing
+and replies ERR_VERSION, like cas does for a single key.
+
+The commands which can be queued run against store_ops, which is the store itself outside a transaction and a txn,
+whose operations expect the locks to be held already, inside one.
+*/
+
+type store_ops interface {
+	get(key string) (mapval, bool)
+	get_many(keys []string) ([]mapval, []bool)
+	set(key string, ttl time.Duration, value []byte) (int64, error)
+	add(key string, ttl time.Duration, value []byte) (int64, error)
+	replace(key string, ttl time.Duration, value []byte) (int64, error)
+	append_value(key string, value []byte, prepend bool) (int64, error)
+	cas(key string, ttl time.Duration, version int64, value []byte) (int64, error)
+	delete(key string) error
+	incr(key string, delta int64, create bool, initial int64, ttl time.Duration) (int64, error)
+	touch(key string, ttl time.Duration) (mapval, error)
+}
+
+/*
+transaction is the transaction state of a connection. queued holds the commands received since multi, each writing its
+reply to out when exec runs it, and grow the most they can add to the memory used.
+*/
+type transaction struct {
+	active  bool
+	queued  []func(ops store_ops, out *bufio.Writer)
+	grow    int64
+	watched map[string]watched_key
+}
+
+/*
+add() queues run if a transaction was started with multi and returns whether it did
+*/
+func (tx *transaction) add(run func(ops store_ops, out *bufio.Writer), grow int) bool {
+
+	if tx.active == false {
+		return false
+	}
+	tx.queued = append(tx.queued, run)
+	tx.grow += int64(grow)
+	return true
+}
+
+/*
+reset() ends the transaction and forgets the watched keys, which exec and discard do
+*/
+func (tx *transaction) reset() {
+	*tx = transaction{}
+}
+
+/*
+txn runs the operations of an exec while the store's locks are held
+*/
+type txn struct {
+	s *store
+}
+
+/*
+watched_key is the state of a watched key when it was watched. Every write gives the entry fresh access statistics,
+so comparing them too tells a key deleted and created again, whose version starts over at 0, from one never touched.
+*/
+type watched_key struct {
+	exists  bool
+	version int64
+	stats   *entry_stats
+}
+
+/*
+watch_state() returns the current state of key for watch
+*/
+func (s *store) watch_state(key string) watched_key {
+
+	sh := s.shard_for(key)
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+	return sh.watch_state(key)
+}
+
+func (sh *shard) watch_state(key string) watched_key {
+
+	val, ok := sh.memmap[key]
+	if ok == false || is_expired(val, time.Now().UnixNano()) {
+		return watched_key{}
+	}
+	return watched_key{true, val.version, val.stats}
+}
+
+/*
+lock_all() and unlock_all() hold the write lock of every shard, taken in shard order
+*/
+func (s *store) lock_all() {
+	for _, sh := range s.shards {
+		sh.mutex.Lock()
+	}
+}
+
+func (s *store) unlock_all() {
+	for _, sh := range s.shards {
+		sh.mutex.Unlock()
+	}
+}
+
+/*
+exec() runs fn with every shard locked, unless a key of watched no longer has the state it was watched in, in which
+case it returns errVersion without running fn. grow is the most the commands of fn can add to the memory used; room
+for it is made before the locks are taken, as eviction can't run while they are held, and writes which don't fit in it
+fail with errOutOfMemory.
+*/
+func (s *store) exec(watched map[string]watched_key, grow int64, fn func(ops store_ops)) error {
+
+	if err := s.make_room(grow); err != nil {
+		return err
+	}
+
+	s.lock_all()
+	defer s.unlock_all()
+
+	for key, state := range watched {
+		if s.shard_for(key).watch_state(key) != state {
+			return errVersion
+		}
+	}
+	fn(&txn{s})
+	return nil
+}
+
+func (t *txn) get(key string) (mapval, bool) {
+
+	now := time.Now()
+	val, ok := t.s.shard_for(key).memmap[key]
+	if ok == false || is_expired(val, now.UnixNano()) {
+		return mapval{}, false
+	}
+	val.stats.touch(now)
+	return val, true
+}
+
+func (t *txn) get_many(keys []string) (vals []mapval, found []bool) {
+
+	vals = make([]mapval, len(keys))
+	found = make([]bool, len(keys))
+	for i, key := range keys {
+		vals[i], found[i] = t.get(key)
+	}
+	return vals, found
+}
+
+func (t *txn) set_if(key string, ttl time.Duration, value []byte, cond int) (int64, error) {
+	return t.s.shard_for(key).set_if(key, ttl, value, cond)
+}
+
+func (t *txn) set(key string, ttl time.Duration, value []byte) (int64, error) {
+	return t.set_if(key, ttl, value, cond_always)
+}
+
+func (t *txn) add(key string, ttl time.Duration, value []byte) (int64, error) {
+	return t.set_if(key, ttl, value, cond_absent)
+}
+
+func (t *txn) replace(key string, ttl time.Duration, value []byte) (int64, error) {
+	return t.set_if(key, ttl, value, cond_present)
+}
+
+func (t *txn) append_value(key string, value []byte, prepend bool) (int64, error) {
+
+	val, err := t.s.shard_for(key).update(key, append_fn(value, prepend))
+	return val.version, err
+}
+
+func (t *txn) cas(key string, ttl time.Duration, version int64, value []byte) (int64, error) {
+	return t.s.shard_for(key).cas(key, ttl, version, value)
+}
+
+func (t *txn) delete(key string) error {
+	return t.s.shard_for(key).delete_if(key, -1)
+}
+
+func (t *txn) incr(key string, delta int64, create bool, initial int64, ttl time.Duration) (int64, error) {
+
+	var result int64
+	_, err := t.s.shard_for(key).update(key, incr_fn(delta, create, initial, ttl, &result))
+	return result, err
+}
+
+func (t *txn) touch(key string, ttl time.Duration) (mapval, error) {
+	return t.s.shard_for(key).update(key, touch_fn(ttl))
+}
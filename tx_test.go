@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+/*
+TestExecIsAtomic() moves units between two counters in transactions while other goroutines read both counters with
+get_many, and checks that no reader ever sees a transfer half done
+*/
+func TestExecIsAtomic(t *testing.T) {
+
+	s := new_store(4)
+	s.set("account:a", 0, []byte("1000"))
+	s.set("account:b", 0, []byte("1000"))
+
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 200; j++ {
+				s.exec(nil, 0, func(ops store_ops) {
+					ops.incr("account:a", -1, false, 0, 0)
+					ops.incr("account:b", 1, false, 0, 0)
+				})
+			}
+			done <- true
+		}()
+	}
+
+	torn := 0
+	for finished := 0; finished < 4; {
+		select {
+		case <-done:
+			finished++
+		default:
+			vals, _ := s.get_many([]string{"account:a", "account:b"})
+			a, _ := strconv.Atoi(string(vals[0].value))
+			b, _ := strconv.Atoi(string(vals[1].value))
+			if a+b != 2000 {
+				torn++
+			}
+		}
+	}
+	if torn > 0 {
+		t.Errorf("readers saw %d half done transfers", torn)
+	}
+	if val, _ := s.get("account:a"); string(val.value) != "200" {
+		t.Errorf("account:a = %s after 800 transfers", val.value)
+	}
+}
+
+/*
+TestExecWatch() checks that exec runs nothing once a watched key was written, deleted or created, even when a key
+deleted and created again is back at the version it was watched at
+*/
+func TestExecWatch(t *testing.T) {
+
+	s := new_store(4)
+	s.set("watchkey", 0, []byte("mayur"))
+	run := func(watched map[string]watched_key) error {
+		return s.exec(watched, 0, func(ops store_ops) {
+			ops.set("watchresult", 0, []byte("ran"))
+		})
+	}
+	watch := func(key string) map[string]watched_key {
+		return map[string]watched_key{key: s.watch_state(key)}
+	}
+
+	watched := watch("watchkey")
+	if err := run(watched); err != nil {
+		t.Errorf("exec without changes returned %v", err)
+	}
+
+	watched = watch("watchkey")
+	s.set("watchkey", 0, []byte("kale"))
+	if err := run(watched); err != errVersion {
+		t.Errorf("exec after a write returned %v", err)
+	}
+
+	s.delete("watchkey")
+	s.set("watchkey", 0, []byte("mayur"))
+	watched = watch("watchkey")
+	s.delete("watchkey")
+	s.set("watchkey", 0, []byte("mayur"))
+	if err := run(watched); err != errVersion {
+		t.Errorf("exec after the key was created again returned %v", err)
+	}
+
+	watched = watch("missingkey")
+	s.set("missingkey", 0, []byte("mayur"))
+	if err := run(watched); err != errVersion {
+		t.Errorf("exec after a watched key was created returned %v", err)
+	}
+}